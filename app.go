@@ -6,6 +6,7 @@ import (
 	"github.com/bingoohuang/filestash/server/plugin/plg_starter_http"
 	"github.com/gorilla/mux"
 	"io/fs"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
@@ -33,6 +34,7 @@ func POST(r *mux.Router, p string, h http.HandlerFunc)   { r.HandleFunc(p, h).Me
 func DELETE(r *mux.Router, p string, h http.HandlerFunc) { r.HandleFunc(p, h).Methods("DELETE") }
 
 type AppConfig struct {
+	Host            string
 	Port            int
 	R               *mux.Router
 	AutoOpenBrowser bool
@@ -80,10 +82,14 @@ func (appConfig AppConfig) Start() bool {
 
 func (appConfig AppConfig) Init(a *App) (result InitResult) {
 	if appConfig.Port > 0 {
-		port := plg_starter_http.Register(appConfig.Port)
+		port := plg_starter_http.Register(appConfig.Host, appConfig.Port)
 		result.Port = port
 		if appConfig.AutoOpenBrowser {
-			go OpenBrowser(fmt.Sprintf("http://127.0.0.1:%d", port))
+			host := appConfig.Host
+			if host == "" || host == "0.0.0.0" || host == "::" {
+				host = "127.0.0.1"
+			}
+			go OpenBrowser(fmt.Sprintf("http://%s", net.JoinHostPort(host, strconv.Itoa(port))))
 		}
 	}
 
@@ -94,9 +100,9 @@ func (appConfig AppConfig) Init(a *App) (result InitResult) {
 	session := r.PathPrefix("/api/session").Subrouter()
 	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, SessionStart}
 	GET(session, "", Chain(SessionGet, middlewares, *a))
-	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, BodyParser}
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, RateLimit, BodyParser, Audit}
 	POST(session, "", Chain(SessionAuthenticate, middlewares, *a))
-	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, SessionTry}
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, SessionTry, Audit}
 	DELETE(session, "", Chain(SessionLogout, middlewares, *a))
 	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax}
 	GET(session, "/auth/{service}", Chain(SessionOAuthBackend, middlewares, *a))
@@ -105,19 +111,47 @@ func (appConfig AppConfig) Init(a *App) (result InitResult) {
 	middlewares = []Middleware{ApiHeaders, SecureAjax}
 	admin := r.PathPrefix("/admin/api").Subrouter()
 	GET(admin, "/session", Chain(AdminSessionGet, middlewares, *a))
+	middlewares = []Middleware{ApiHeaders, SecureAjax, RateLimit, Audit}
 	POST(admin, "/session", Chain(AdminSessionAuthenticate, middlewares, *a))
-	middlewares = []Middleware{ApiHeaders, AdminOnly, SecureAjax}
+	middlewares = []Middleware{ApiHeaders, AdminOnly, SecureAjax, Audit}
 	admin.HandleFunc("/config", Chain(PrivateConfigHandler, middlewares, *a)).Methods("GET")
 	admin.HandleFunc("/config", Chain(PrivateConfigUpdateHandler, middlewares, *a)).Methods("POST")
+	GET(admin, "/health", Chain(AdminHealthHandler, middlewares, *a))
+	GET(admin, "/config/history", Chain(PrivateConfigHistoryList, middlewares, *a))
+	GET(admin, "/config/history/{id}", Chain(PrivateConfigHistoryGet, middlewares, *a))
+	POST(admin, "/config/history/{id}/rollback", Chain(PrivateConfigRollback, middlewares, *a))
+	GET(admin, "/config/diff", Chain(PrivateConfigDiff, middlewares, *a))
 	middlewares = []Middleware{IndexHeaders, AdminOnly, SecureAjax}
 	admin.HandleFunc("/log", Chain(FetchLogHandler, middlewares, *a)).Methods("GET")
+	middlewares = []Middleware{ApiHeaders, AdminOnly, SecureAjax, Audit}
+	GET(admin, "/users", Chain(AdminUserList, middlewares, *a))
+	POST(admin, "/users/{username}", Chain(AdminUserUpsert, middlewares, *a))
+	DELETE(admin, "/users/{username}", Chain(AdminUserDelete, middlewares, *a))
+	GET(admin, "/groups", Chain(AdminGroupList, middlewares, *a))
+	POST(admin, "/groups/{group}", Chain(AdminGroupUpsert, middlewares, *a))
+	DELETE(admin, "/groups/{group}", Chain(AdminGroupDelete, middlewares, *a))
+	GET(admin, "/rules", Chain(AdminAccessRuleList, middlewares, *a))
+	POST(admin, "/rules", Chain(AdminAccessRuleCreate, middlewares, *a))
+	DELETE(admin, "/rules/{id}", Chain(AdminAccessRuleDelete, middlewares, *a))
+	GET(admin, "/shares", Chain(AdminShareList, middlewares, *a))
+	POST(admin, "/shares/revoke", Chain(AdminShareRevoke, middlewares, *a))
+	GET(admin, "/sessions", Chain(AdminUserSessionList, middlewares, *a))
+	DELETE(admin, "/sessions/{id}", Chain(AdminUserSessionDelete, middlewares, *a))
+	GET(admin, "/totp", Chain(AdminTotpGet, middlewares, *a))
+	POST(admin, "/totp", Chain(AdminTotpSetup, middlewares, *a))
+	POST(admin, "/totp/enable", Chain(AdminTotpEnable, middlewares, *a))
+	POST(admin, "/totp/disable", Chain(AdminTotpDisable, middlewares, *a))
+	GET(admin, "/audit", Chain(AdminAuditList, middlewares, *a))
+	GET(admin, "/audit/verify", Chain(AdminAuditVerify, middlewares, *a))
+	middlewares = []Middleware{AdminOnly, SecureAjax}
+	GET(admin, "/audit/export", Chain(AdminAuditExport, middlewares, *a))
 
 	// API for File management
 	files := r.PathPrefix("/api/files").Subrouter()
-	middlewares = []Middleware{ApiHeaders, SecureHeaders, SessionStart, LoggedInOnly}
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, RateLimit, SessionStart, Audit, LoggedInOnly, ShareDownloadLimit}
 	files.HandleFunc("/cat", Chain(FileCat, middlewares, *a)).Methods("GET", "HEAD")
 	files.HandleFunc("/zip", Chain(FileDownloader, middlewares, *a)).Methods("GET")
-	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, SessionStart, LoggedInOnly}
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, RateLimit, SessionStart, Audit, LoggedInOnly}
 	files.HandleFunc("/cat", Chain(FileAccess, middlewares, *a)).Methods("OPTIONS")
 	files.HandleFunc("/cat", Chain(FileSave, middlewares, *a)).Methods("POST")
 	GET(files, "/ls", Chain(FileLs, middlewares, *a))
@@ -125,28 +159,42 @@ func (appConfig AppConfig) Init(a *App) (result InitResult) {
 	files.HandleFunc("/rm", Chain(FileRm, middlewares, *a)).Methods("GET")
 	files.HandleFunc("/mkdir", Chain(FileMkdir, middlewares, *a)).Methods("GET")
 	files.HandleFunc("/touch", Chain(FileTouch, middlewares, *a)).Methods("GET")
-	middlewares = []Middleware{ApiHeaders, SessionStart, LoggedInOnly}
+	middlewares = []Middleware{ApiHeaders, RateLimit, SessionStart, Audit, LoggedInOnly}
 	files.HandleFunc("/search", Chain(FileSearch, middlewares, *a)).Methods("GET")
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, BodyParser, SessionStart, Audit, LoggedInOnly}
+	POST(files, "/sign", Chain(SignedUrlCreate, middlewares, *a))
+	POST(files, "/sign/revoke", Chain(SignedUrlRevoke, middlewares, *a))
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, RateLimit, SignedUrlStart, Audit, LoggedInOnly}
+	files.HandleFunc("/signed", Chain(FileCat, middlewares, *a)).Methods("GET", "HEAD")
 
 	// API for exporter
-	middlewares = []Middleware{ApiHeaders, SecureHeaders, RedirectSharedLoginIfNeeded, SessionStart, LoggedInOnly}
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, RateLimit, RedirectSharedLoginIfNeeded, SessionStart, Audit, LoggedInOnly, ShareDownloadLimit}
 	r.PathPrefix("/api/export/{share}/{mtype0}/{mtype1}").Handler(Chain(FileExport, middlewares, *a))
 
 	// API for Shared link
 	share := r.PathPrefix("/api/share").Subrouter()
 	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, SessionStart, LoggedInOnly}
 	share.HandleFunc("", Chain(ShareList, middlewares, *a)).Methods("GET")
-	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, BodyParser}
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, RateLimit, BodyParser, Audit}
 	share.HandleFunc("/{share}/proof", Chain(ShareVerifyProof, middlewares, *a)).Methods("POST")
-	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, CanManageShare}
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, CanManageShare, Audit}
 	share.HandleFunc("/{share}", Chain(ShareDelete, middlewares, *a)).Methods("DELETE")
-	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, BodyParser, CanManageShare}
+	share.HandleFunc("/{share}/activity", Chain(ShareActivity, middlewares, *a)).Methods("GET")
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, BodyParser, CanManageShare, Audit}
 	share.HandleFunc("/{share}", Chain(ShareUpsert, middlewares, *a)).Methods("POST")
 
+	// API for personal tokens
+	tokens := r.PathPrefix("/api/tokens").Subrouter()
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, SessionStart, Audit, LoggedInOnly}
+	GET(tokens, "", Chain(TokenList, middlewares, *a))
+	DELETE(tokens, "/{token}", Chain(TokenDelete, middlewares, *a))
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureAjax, BodyParser, SessionStart, Audit, LoggedInOnly}
+	POST(tokens, "", Chain(TokenCreate, middlewares, *a))
+
 	// Webdav server / Shared Link
 	middlewares = []Middleware{IndexHeaders, SecureHeaders}
 	r.HandleFunc("/s/{share}", Chain(IndexHandler(FileIndex), middlewares, *a)).Methods("GET")
-	middlewares = []Middleware{WebdavBlacklist, SessionStart}
+	middlewares = []Middleware{WebdavBlacklist, RateLimit, SessionStart, Audit, ShareDownloadLimit}
 	r.PathPrefix("/s/{share}").Handler(Chain(WebdavHandler, middlewares, *a))
 
 	// Application Resources
@@ -168,6 +216,8 @@ func (appConfig AppConfig) Init(a *App) (result InitResult) {
 	})
 	r.HandleFunc("/.well-known/security.txt", Chain(WellKnownSecurityHandler, []Middleware{}, *a)).Methods("GET")
 	r.HandleFunc("/healthz", Chain(HealthHandler, []Middleware{}, *a)).Methods("GET")
+	r.HandleFunc("/healthz/ready", Chain(HealthReadyHandler, []Middleware{}, *a)).Methods("GET")
+	r.HandleFunc("/metrics", Chain(MetricsHandler, []Middleware{}, *a)).Methods("GET")
 	r.HandleFunc("/custom.css", Chain(CustomCssHandler, []Middleware{}, *a)).Methods("GET")
 
 	if os.Getenv("DEBUG") == "true" {
@@ -16,6 +16,7 @@ export class SharePage extends React.Component {
             path: null,
             key: null,
             error: null,
+            verification: null,
             loading: false
         };
     }
@@ -31,7 +32,11 @@ export class SharePage extends React.Component {
     submitProof(e, type, value){
         e.preventDefault();
         this.setState({loading: true});
-        this._proofQuery(this.props.match.params.id, {type: type, value:value});
+        const data = {type: type, value: value};
+        if(type === "code"){
+            data.id = this.state.verification;
+        }
+        this._proofQuery(this.props.match.params.id, data);
     }
 
     _proofQuery(id, data = {}){
@@ -46,6 +51,10 @@ export class SharePage extends React.Component {
                 share: res.id,
                 loading: false
             };
+            if(res.key === "code"){
+                // the code is verified against the request it was sent for
+                st.verification = res.id;
+            }
             if(res.message){
                 notify.send(res.message, "info");
             }else if(res.error){
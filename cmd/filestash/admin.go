@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+	"github.com/tidwall/sjson"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+func adminCommand(args []string) int {
+	if len(args) == 0 || args[0] != "set-password" {
+		return fail("Usage: filestash admin set-password [-stdin]")
+	}
+	fs := newFlagSet("admin set-password", "admin set-password [-stdin]")
+	stdin := fs.Bool("stdin", false, "read the password from the standard input instead of prompting for it")
+	fs.Parse(args[1:])
+
+	password, err := readPassword(*stdin)
+	if err != nil {
+		return fail("%s", err.Error())
+	} else if len(password) < 8 {
+		return fail("the password needs at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fail("%s", err.Error())
+	}
+	b, err := os.ReadFile(common.ConfigJSONPath)
+	if err != nil {
+		return fail("can't read the config: %s", err.Error())
+	}
+	if b, err = sjson.SetBytes(b, common.AuthAdmin, string(hash)); err != nil {
+		return fail("%s", err.Error())
+	}
+	if err := model.ConfigUpdate(b, "cli"); err != nil {
+		return fail("%s", err.Error())
+	}
+	for _, env := range []string{"ADMIN_PASSWORD", common.ConfigEnvName(common.AuthAdmin)} {
+		if os.Getenv(env) != "" {
+			fmt.Fprintf(os.Stderr, "warning: the %s environment variable overrides the password on startup\n", env)
+		}
+	}
+	fmt.Println("admin password updated")
+	return 0
+}
+
+func readPassword(fromStdin bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if fromStdin || !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("can't read the password: %s", err.Error())
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, "New password: ")
+	p1, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	p2, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	} else if string(p1) != string(p2) {
+		return "", fmt.Errorf("the passwords don't match")
+	}
+	return string(p1), nil
+}
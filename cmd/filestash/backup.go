@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bingoohuang/filestash/server/model"
+)
+
+func backup(args []string) int {
+	fs := newFlagSet("backup", "backup [-o FILE]")
+	output := fs.String("o", fmt.Sprintf("filestash_%s.tar.gz", time.Now().Format("20060102_150405")), "where to write the backup, - for the standard output")
+	fs.Parse(args)
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+		if err != nil {
+			return fail("%s", err.Error())
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := model.StateBackup(w); err != nil {
+		if *output != "-" {
+			os.Remove(*output)
+		}
+		return fail("backup failed: %s", err.Error())
+	}
+	if *output != "-" {
+		fmt.Printf("backup written to %s\n", *output)
+	}
+	return 0
+}
+
+func restore(args []string) int {
+	fs := newFlagSet("restore", "restore FILE")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fail("%s", err.Error())
+	}
+	defer f.Close()
+	if err := model.StateRestore(f); err != nil {
+		return fail("restore failed: %s", err.Error())
+	}
+	fmt.Println("backup restored, the previous state was kept aside with a .bak suffix")
+	return 0
+}
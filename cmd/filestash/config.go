@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+	"github.com/tidwall/sjson"
+)
+
+func configCommand(args []string) int {
+	if len(args) == 0 {
+		return fail("Usage: filestash config get [KEY] | set KEY VALUE | validate [FILE]")
+	}
+	switch args[0] {
+	case "get":
+		return configGet(args[1:])
+	case "set":
+		return configSet(args[1:])
+	case "validate":
+		return configValidate(args[1:])
+	}
+	return fail("unknown config command '%s'", args[0])
+}
+
+// configGet prints the value of a key, decrypted and with what comes from the environment taken
+// into account. Without a key, the config file is printed as is
+func configGet(args []string) int {
+	fs := newFlagSet("config get", "config get [KEY]")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		b, err := os.ReadFile(common.ConfigJSONPath)
+		if err != nil {
+			return fail("can't read the config: %s", err.Error())
+		}
+		os.Stdout.Write(b)
+		return 0
+	}
+	switch v := common.Config.Get(fs.Arg(0)).Interface().(type) {
+	case nil:
+		fmt.Println("")
+	case string:
+		fmt.Println(v)
+	default:
+		b, _ := json.Marshal(v)
+		fmt.Println(string(b))
+	}
+	return 0
+}
+
+// configSet goes through the same validation and history as a change made from the admin console
+func configSet(args []string) int {
+	fs := newFlagSet("config set", "config set KEY VALUE")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	key := fs.Arg(0)
+	if key == common.AuthAdmin {
+		return fail("use 'filestash admin set-password' to change the admin password")
+	}
+	var value interface{} = fs.Arg(1)
+	switch common.Config.Get(key).Debug().Type {
+	case "boolean", "enable":
+		b, err := strconv.ParseBool(fs.Arg(1))
+		if err != nil {
+			return fail("%s expects a boolean", key)
+		}
+		value = b
+	case "number":
+		n, err := strconv.ParseFloat(fs.Arg(1), 64)
+		if err != nil {
+			return fail("%s expects a number", key)
+		}
+		value = n
+	}
+	b, err := os.ReadFile(common.ConfigJSONPath)
+	if err != nil {
+		return fail("can't read the config: %s", err.Error())
+	}
+	if b, err = sjson.SetBytes(b, key, value); err != nil {
+		return fail("can't set %s: %s", key, err.Error())
+	}
+	if err := model.ConfigUpdate(b, "cli"); err != nil {
+		return fail("%s", err.Error())
+	}
+	if env := common.ConfigEnvName(key); os.Getenv(env) != "" {
+		fmt.Fprintf(os.Stderr, "warning: %s is set from the %s environment variable which takes precedence\n", key, env)
+	}
+	return 0
+}
+
+func configValidate(args []string) int {
+	fs := newFlagSet("config validate", "config validate [FILE]")
+	fs.Parse(args)
+	path := common.ConfigJSONPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fail("can't read %s: %s", path, err.Error())
+	}
+	if err := common.Config.Validate(b); err != nil {
+		return fail("%s", err.Error())
+	}
+	fmt.Printf("%s is valid\n", path)
+	return 0
+}
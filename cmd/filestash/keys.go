@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+)
+
+// rotateKeys implements `filestash rotate-keys`. It is meant to run while the server is stopped as
+// the server only picks up the new keys when it starts
+func rotateKeys(args []string) int {
+	fs := newFlagSet("rotate-keys", "rotate-keys [-master] [-secret]")
+	master := fs.Bool("master", false, "encrypt the secrets of the config with a new master key. It gets written to FILESTASH_MASTER_KEY_FILE, or printed out when FILESTASH_MASTER_KEY is used")
+	secret := fs.Bool("secret", false, "replace the secret key while keeping the shared links working")
+	fs.Parse(args)
+	if !*master && !*secret {
+		fs.Usage()
+		return 2
+	}
+
+	if *secret {
+		r, err := model.SecretKeyRotate("cli")
+		if err != nil {
+			return fail("secret key rotation failed: %s", err.Error())
+		}
+		fmt.Printf("secret key rotated: %d shares, %d api tokens and %d sessions carried over, %d api tokens and %d sessions revoked\n", r.Shares, r.Tokens, r.Sessions, r.RevokedTokens, r.RevokedSessions)
+	}
+
+	if *master {
+		key := common.RandomString(32)
+		file := common.ConfigMasterKeyFile()
+		if os.Getenv("FILESTASH_MASTER_KEY") == "" && file == "" {
+			return fail("no master key: set FILESTASH_MASTER_KEY_FILE to where the master key should be kept")
+		}
+		if os.Getenv("FILESTASH_MASTER_KEY") == "" {
+			// the key is kept aside until the config is encrypted with it so that we never end up
+			// with a config nobody can decrypt
+			if err := os.WriteFile(file+".new", []byte(key+"\n"), 0600); err != nil {
+				return fail("can't write the master key: %s", err.Error())
+			}
+		}
+		r, err := model.MasterKeyRotate(key, "cli")
+		if err != nil {
+			os.Remove(file + ".new")
+			return fail("master key rotation failed: %s", err.Error())
+		}
+		fmt.Printf("master key rotated: config and %d versions of its history encrypted\n", r.ConfigVersions)
+		if os.Getenv("FILESTASH_MASTER_KEY") != "" {
+			fmt.Printf("set FILESTASH_MASTER_KEY=%s before starting filestash again\n", key)
+		} else if err := os.Rename(file+".new", file); err != nil {
+			return fail("can't move the new master key in place, move '%s.new' to '%s': %s", file, file, err.Error())
+		}
+	}
+	return 0
+}
@@ -1,22 +1,79 @@
 package main
 
 import (
-	"github.com/bingoohuang/filestash"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
 	"github.com/bingoohuang/filestash/server/common"
 	_ "github.com/bingoohuang/filestash/server/plugin"
-	"github.com/gorilla/mux"
 )
 
+type command struct {
+	name        string
+	description string
+	run         func(args []string) int
+}
+
+var commands = []command{
+	{"serve", "Start the server, the default when no command is given", serve},
+	{"config", "Read, change or check the config", configCommand},
+	{"admin", "Change the password of the admin console", adminCommand},
+	{"share", "Manage the shared links", shareCommand},
+	{"search", "Rebuild the full text search index", searchCommand},
+	{"backup", "Save the config and the state directory to a tarball", backup},
+	{"restore", "Restore a backup, the server must be stopped", restore},
+	{"rotate-keys", "Change the master key and/or the secret key", rotateKeys},
+}
+
 func main() {
-	app := common.App{}
-	config := filestash.AppConfig{
-		Port:            8334,
-		R:               mux.NewRouter(),
-		AutoOpenBrowser: true,
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		// filestash has always started the server when called without anything else
+		os.Exit(serve(args))
+	}
+	if args[0] == "help" {
+		usage(os.Stdout)
+		os.Exit(0)
+	}
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		if c.name != "serve" {
+			// the output of a command shouldn't get mixed up with what the background tasks log
+			common.Log.Enable(false)
+		}
+		os.Exit(c.run(args[1:]))
 	}
+	fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n", args[0])
+	usage(os.Stderr)
+	os.Exit(2)
+}
+
+func usage(w *os.File) {
+	fmt.Fprintf(w, "Usage: filestash COMMAND [ARGS]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", c.name, c.description)
+	}
+	fmt.Fprintf(w, "\nThe state lives in ~/.filestash unless -data-dir or FILESTASH_PATH says otherwise.\n")
+	fmt.Fprintf(w, "Run 'filestash COMMAND -h' for the details of a command.\n")
+}
 
-	config.Init(&app)
-	if config.Start() {
-		select {}
+// newFlagSet gives the flags of a command. They all accept -data-dir even though it gets picked up
+// before we reach this point, see common.GetHomeDir
+func newFlagSet(name string, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.String("data-dir", "", "directory holding the config and the state (default ~/.filestash)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: filestash %s\n\nFlags:\n", usage)
+		fs.PrintDefaults()
 	}
+	return fs
+}
+
+func fail(format string, v ...interface{}) int {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+	return 1
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bingoohuang/filestash/server/model"
+)
+
+// searchCommand can't walk through the storage by itself as it doesn't hold the credentials of the
+// users. What it does is flag the indexes for the running server to rebuild them
+func searchCommand(args []string) int {
+	if len(args) == 0 || args[0] != "reindex" {
+		return fail("Usage: filestash search reindex [-backend ID] [-full]")
+	}
+	fs := newFlagSet("search reindex", "search reindex [-backend ID] [-full]")
+	backend := fs.String("backend", "", "only reindex the given backend, all of them when empty")
+	full := fs.Bool("full", false, "empty the index instead of only refreshing the content of the files")
+	fs.Parse(args[1:])
+	ids, err := model.SearchIndexReset(*backend, *full)
+	if err != nil {
+		return fail("%s", err.Error())
+	}
+	for _, id := range ids {
+		fmt.Printf("%s scheduled for reindex\n", id)
+	}
+	if len(ids) == 0 {
+		fmt.Println("no search index yet")
+	}
+	return 0
+}
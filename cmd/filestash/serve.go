@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/bingoohuang/filestash"
+	"github.com/bingoohuang/filestash/server/common"
+	"github.com/gorilla/mux"
+)
+
+func serve(args []string) int {
+	fs := newFlagSet("serve", "serve [flags]")
+	port := fs.Int("port", common.Config.Get("general.port").Int(), "port to listen on, the next free one is used when taken")
+	bind := fs.String("bind", "", "address to listen on, all interfaces when empty")
+	noBrowser := fs.Bool("no-browser", false, "don't open a browser once the server has started")
+	fs.Parse(args)
+
+	app := common.App{}
+	config := filestash.AppConfig{
+		Host:            *bind,
+		Port:            *port,
+		R:               mux.NewRouter(),
+		AutoOpenBrowser: !*noBrowser,
+	}
+	config.Init(&app)
+	if !config.Start() {
+		return 1
+	}
+	select {}
+}
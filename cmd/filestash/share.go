@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+)
+
+func shareCommand(args []string) int {
+	if len(args) == 0 {
+		return fail("Usage: filestash share list | create [flags] PATH... | revoke ID...")
+	}
+	switch args[0] {
+	case "list":
+		return shareList(args[1:])
+	case "create":
+		return shareCreate(args[1:])
+	case "revoke":
+		return shareRevoke(args[1:])
+	}
+	return fail("unknown share command '%s'", args[0])
+}
+
+func shareList(args []string) int {
+	fs := newFlagSet("share list", "share list [-json]")
+	asJson := fs.Bool("json", false, "print the shared links as json")
+	fs.Parse(args)
+	shares, err := model.ShareListAll()
+	if err != nil {
+		return fail("%s", err.Error())
+	}
+	if *asJson {
+		type share struct {
+			Id          string   `json:"id"`
+			Backend     string   `json:"backend"`
+			Path        string   `json:"path"`
+			Paths       []string `json:"paths,omitempty"`
+			Permissions []string `json:"permissions"`
+			Protection  []string `json:"protection"`
+			Expire      *int64   `json:"expire,omitempty"`
+			Downloads   *int64   `json:"remaining_downloads,omitempty"`
+			Visits      *int64   `json:"remaining_visits,omitempty"`
+		}
+		out := make([]share, len(shares))
+		for i, s := range shares {
+			downloads, visits := s.Remaining()
+			out[i] = share{s.Id, s.Backend, s.Path, s.Paths, sharePermissions(s), shareProtection(s), s.Expire, downloads, visits}
+		}
+		b, _ := json.MarshalIndent(out, "", "  ")
+		fmt.Println(string(b))
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tBACKEND\tPATH\tPERMISSIONS\tPROTECTION\tEXPIRE\tREMAINING")
+	for _, s := range shares {
+		expire := "-"
+		if s.Expire != nil {
+			expire = time.UnixMilli(*s.Expire).Format(time.RFC3339)
+		}
+		protection := strings.Join(shareProtection(s), ",")
+		if protection == "" {
+			protection = "-"
+		}
+		path := s.Path
+		if s.Collection {
+			path = fmt.Sprintf("%s (%d items)", s.Path, len(s.Paths))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Id, s.Backend, path, strings.Join(sharePermissions(s), ","), protection, expire, shareRemaining(s))
+	}
+	w.Flush()
+	return 0
+}
+
+// shareCreate makes a shared link onto one of the connections of the config. Credentials which aren't
+// part of the connection are given with -param and get checked before anything is created. Giving
+// more than one path makes a collection
+func shareCreate(args []string) int {
+	fs := newFlagSet("share create", "share create -connection LABEL [flags] PATH...")
+	connection := fs.String("connection", "", "label of the connection the path belongs to")
+	params := stringsFlag{}
+	fs.Var(&params, "param", "parameter of the connection as key=value, eg: -param password=xxx. Can be repeated")
+	id := fs.String("id", "", "id of the link, generated when empty")
+	password := fs.String("password", "", "password protecting the link")
+	users := fs.String("users", "", "comma separated emails of the people allowed to open the link")
+	expire := fs.String("expire", "", "expiration of the link, as a duration (eg: 72h) or a date (eg: 2030-01-31)")
+	canWrite := fs.Bool("write", false, "allow changes to the files")
+	canUpload := fs.Bool("upload", false, "allow uploads")
+	canShare := fs.Bool("reshare", false, "allow people with the link to share it further")
+	maxDownloads := fs.Int64("max-downloads", 0, "number of downloads the link allows, no limit when 0")
+	maxVisits := fs.Int64("max-visits", 0, "number of visits the link allows, no limit when 0")
+	oneShot := fs.Bool("one-shot", false, "remove the link once it's been downloaded")
+	maxUploads := fs.Int64("max-uploads", 0, "number of files that can be uploaded, no limit when 0")
+	maxUploadSize := fs.Int64("max-upload-size", 0, "total size in bytes of the files that can be uploaded, no limit when 0")
+	extensions := fs.String("upload-extensions", "", "comma separated extensions of the files that can be uploaded, eg: pdf,docx")
+	notifyEmail := fs.String("notify-email", "", "comma separated emails to notify of the uploads")
+	notifyWebhook := fs.String("notify-webhook", "", "url called on uploads")
+	notifyDigest := fs.Bool("notify-digest", false, "send the upload notifications as a periodic digest")
+	viewOnly := fs.Bool("view-only", false, "serve images and pdfs stamped with a watermark, without any way to download them")
+	watermark := fs.String("watermark", "", "template of the watermark of a view only link, eg: '{{ .Email }} {{ .Date }}'")
+	proofs := stringsFlag{}
+	fs.Var(&proofs, "proof", "proof provided by a plugin as key=value, eg: -proof ip=10.0.0.0/8. Can be repeated")
+	fs.Parse(args)
+	if fs.NArg() == 0 || *connection == "" {
+		fs.Usage()
+		return 2
+	}
+
+	session := map[string]string{}
+	for _, conn := range common.Config.Conn {
+		if common.NewStringFromInterface(conn["label"]) == *connection {
+			session = model.MapStringInterfaceToMapStringString(conn)
+			break
+		}
+	}
+	if len(session) == 0 {
+		return fail("no connection labelled '%s' in the config", *connection)
+	}
+	delete(session, "label")
+	for _, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return fail("invalid -param '%s', expected key=value", p)
+		}
+		session[kv[0]] = kv[1]
+	}
+	session["path"] = common.EnforceDirectory(session["path"])
+
+	app := common.App{Context: context.Background(), Session: session}
+	backend, err := model.NewBackend(&app, session)
+	if err != nil {
+		return fail("can't connect to '%s': %s", *connection, err.Error())
+	}
+	if _, err := model.GetHome(backend, session["path"]); err != nil {
+		return fail("can't connect to '%s': %s", *connection, err.Error())
+	}
+	j, _ := json.Marshal(session)
+	auth, err := common.EncryptString(common.SecretKeyDerivateForUser, string(j))
+	if err != nil {
+		return fail("%s", err.Error())
+	}
+
+	s := common.Share{
+		Id:        *id,
+		Backend:   common.GenerateID(&app),
+		Auth:      auth,
+		Path:      session["path"] + strings.TrimPrefix(fs.Arg(0), "/"),
+		CanRead:   true,
+		CanWrite:  *canWrite,
+		CanUpload: *canUpload,
+		CanShare:  *canShare,
+		OneShot:   *oneShot,
+		ViewOnly:  *viewOnly,
+	}
+	if fs.NArg() > 1 {
+		for _, path := range fs.Args() {
+			s.Paths = append(s.Paths, session["path"]+strings.TrimPrefix(path, "/"))
+		}
+	}
+	if s.Id == "" {
+		s.Id = common.RandomString(10)
+	} else if _, err := model.ShareGet(s.Id); err == nil {
+		return fail("a link with the id '%s' already exists", s.Id)
+	}
+	if *password != "" {
+		s.Password = password
+	}
+	if *users != "" {
+		s.Users = users
+	}
+	if *maxDownloads > 0 {
+		s.MaxDownloads = maxDownloads
+	}
+	if *maxVisits > 0 {
+		s.MaxVisits = maxVisits
+	}
+	if *maxUploads > 0 {
+		s.MaxUploads = maxUploads
+	}
+	if *maxUploadSize > 0 {
+		s.MaxUploadSize = maxUploadSize
+	}
+	if *extensions != "" {
+		s.UploadExtensions = extensions
+	}
+	if *watermark != "" {
+		s.Watermark = watermark
+	}
+	if *notifyEmail != "" || *notifyWebhook != "" {
+		s.Notify = &common.ShareNotify{Email: *notifyEmail, Webhook: *notifyWebhook, Digest: *notifyDigest}
+	}
+	for _, p := range proofs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return fail("invalid -proof '%s', expected key=value", p)
+		}
+		if s.Proofs == nil {
+			s.Proofs = map[string]string{}
+		}
+		s.Proofs[kv[0]] = kv[1]
+	}
+	if *expire != "" {
+		t, err := parseExpire(*expire)
+		if err != nil {
+			return fail("%s", err.Error())
+		}
+		s.Expire = common.NewInt64(t.UnixMilli())
+	}
+	if err := model.ShareUpsert(&s); err != nil {
+		return fail("%s", err.Error())
+	}
+	url := "/s/" + s.Id
+	if host := common.Config.Get("general.host").String(); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "https://" + host
+		}
+		url = strings.TrimSuffix(host, "/") + url
+	}
+	fmt.Println(url)
+	return 0
+}
+
+func shareRevoke(args []string) int {
+	fs := newFlagSet("share revoke", "share revoke ID...")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	code := 0
+	for _, id := range fs.Args() {
+		if _, err := model.ShareGet(id); err != nil {
+			code = fail("%s: %s", id, err.Error())
+			continue
+		}
+		if err := model.ShareDelete(id); err != nil {
+			code = fail("%s: %s", id, err.Error())
+			continue
+		}
+		fmt.Printf("%s revoked\n", id)
+	}
+	return code
+}
+
+func sharePermissions(s common.Share) []string {
+	perms := []string{}
+	for _, p := range []struct {
+		name string
+		ok   bool
+	}{{"read", s.CanRead && !s.ViewOnly}, {"view", s.ViewOnly}, {"write", s.CanWrite}, {"upload", s.CanUpload}, {"reshare", s.CanShare}} {
+		if p.ok {
+			perms = append(perms, p.name)
+		}
+	}
+	return perms
+}
+
+func shareProtection(s common.Share) []string {
+	protection := []string{}
+	if s.Password != nil {
+		protection = append(protection, "password")
+	}
+	if s.Users != nil {
+		protection = append(protection, "email")
+	}
+	if s.Totp != nil {
+		protection = append(protection, "totp")
+	}
+	keys := []string{}
+	for key := range s.Proofs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return append(protection, keys...)
+}
+
+func shareRemaining(s common.Share) string {
+	remaining := []string{}
+	downloads, visits := s.Remaining()
+	if downloads != nil {
+		remaining = append(remaining, fmt.Sprintf("%d downloads", *downloads))
+	}
+	if visits != nil {
+		remaining = append(remaining, fmt.Sprintf("%d visits", *visits))
+	}
+	if len(remaining) == 0 {
+		return "-"
+	}
+	return strings.Join(remaining, ",")
+}
+
+func parseExpire(str string) (time.Time, error) {
+	if d, err := time.ParseDuration(str); err == nil {
+		return time.Now().Add(d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, str, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiration '%s'", str)
+}
+
+// stringsFlag is a flag that can be given multiple times
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
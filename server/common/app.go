@@ -1,12 +1,18 @@
 package common
 
-import "github.com/gorilla/mux"
+import (
+	"context"
+	"github.com/gorilla/mux"
+)
 
 type App struct {
 	Backend    IBackend
 	Body       map[string]interface{}
 	Session    map[string]string
 	Share      Share
+	Token      Token
 	LogEnabled bool
+	RequestId  string
+	Context    context.Context
 	R          *mux.Router
 }
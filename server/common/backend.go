@@ -40,6 +40,18 @@ func (d *Driver) Drivers() map[string]IBackend {
 	return d.ds
 }
 
+// UnwrapBackend gives back the actual implementation of a backend that was decorated, eg: to collect
+// metrics. This is what needs checking against optional capabilities like Meta or Close
+func UnwrapBackend(b IBackend) IBackend {
+	for {
+		u, ok := b.(interface{ Unwrap() IBackend })
+		if !ok {
+			return b
+		}
+		b = u.Unwrap()
+	}
+}
+
 type Nothing struct{}
 
 func (b Nothing) Init(params map[string]string, app *App) (IBackend, error) {
@@ -10,6 +10,8 @@ import (
 
 type AppCache struct {
 	Cache *cache.Cache
+	// Name is used to report the hit ratio of the cache in the metrics, unnamed caches aren't reported
+	Name string
 }
 
 func (a *AppCache) Get(key interface{}) interface{} {
@@ -18,6 +20,13 @@ func (a *AppCache) Get(key interface{}) interface{} {
 		return nil
 	}
 	value, found := a.Cache.Get(fmt.Sprintf("%d", hash))
+	if a.Name != "" {
+		if found {
+			MetricCacheRequests.WithLabelValues(a.Name, "hit").Inc()
+		} else {
+			MetricCacheRequests.WithLabelValues(a.Name, "miss").Inc()
+		}
+	}
 	if !found {
 		return nil
 	}
@@ -10,8 +10,13 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -55,6 +60,10 @@ type FormElement struct {
 	Datalist    []string    `json:"datalist,omitempty"`
 	Order       int         `json:"-"`
 	Required    bool        `json:"required"`
+	Secret      bool        `json:"-"`
+	env         string
+	envValue    string
+	implicit    bool
 }
 
 func init() {
@@ -62,6 +71,7 @@ func init() {
 	Config.Load()
 	Config.Save()
 	Config.Initialise()
+	go Config.watch()
 }
 
 func NewConfiguration() Configuration {
@@ -76,7 +86,7 @@ func NewConfiguration() Configuration {
 					{Name: "name", Type: "text", Default: "Filestash", Description: "Name has shown in the UI", Placeholder: "Default: \"Filestash\""},
 					{Name: "port", Type: "number", Default: 8334, Description: "Port on which the application is available.", Placeholder: "Default: 8334"},
 					{Name: "host", Type: "text", Description: "The host people need to use to access this server", Placeholder: "Eg: \"demo.filestash.app\""},
-					{Name: "secret_key", Type: "password", Description: "The key that's used to encrypt and decrypt content. Update this settings will invalidate existing user sessions and shared links, use with caution!"},
+					{Name: "secret_key", Type: "password", Description: "The key that's used to encrypt and decrypt content. Update this settings will invalidate existing user sessions and shared links, use with caution! Run \"filestash rotate-keys -secret\" instead to keep the shared links working"},
 					{Name: "force_ssl", Type: "boolean", Description: "Enable the web security mechanism called 'Strict Transport Security'"},
 					{Name: "editor", Type: "select", Default: "emacs", Opts: []string{"base", "emacs", "vim"}, Description: "Keybinding to be use in the editor. Default: \"emacs\""},
 					{Name: "fork_button", Type: "boolean", Default: true, Description: "Display the fork button in the login screen"},
@@ -95,6 +105,11 @@ func NewConfiguration() Configuration {
 						Title: "share",
 						Elmnts: []FormElement{
 							{Name: "enable", Type: "boolean", Default: true, Description: "Enable/Disable the share feature"},
+							{Name: "max_expiry", Type: "number", Default: 0, Description: "Number of days after which a shared link has to expire. Set to 0 to allow links that never expire", Placeholder: "Default: 0"},
+							{Name: "require_password", Type: "boolean", Default: false, Description: "Shared links have to be protected by a password"},
+							{Name: "allow_reshare", Type: "boolean", Default: true, Description: "People with a shared link can be allowed to share it further"},
+							{Name: "purge_after", Type: "number", Default: 30, Description: "Number of days an expired shared link is kept around before being removed for good. Set to 0 to keep them forever", Placeholder: "Default: 30"},
+							{Name: "activity_retention", Type: "number", Default: 90, Description: "Number of days the accesses made through shared links are kept. Set to 0 to keep them forever", Placeholder: "Default: 90"},
 						},
 					},
 				},
@@ -105,6 +120,26 @@ func NewConfiguration() Configuration {
 					{Name: "enable", Type: "enable", Target: []string{"log_level"}, Default: true},
 					{Name: "level", Type: "select", Default: "INFO", Opts: []string{"DEBUG", "INFO", "WARNING", "ERROR"}, Id: "log_level", Description: "Default: \"INFO\". This setting determines the level of detail at which log events are written to the log file"},
 					{Name: "telemetry", Type: "boolean", Default: false, Description: "We won't share anything with any third party. This will only to be used to improve Filestash"},
+					{Name: "audit", Type: "boolean", Default: true, Description: "Keep a tamper evident record of who accessed, modified or shared what. The records are available from the admin console"},
+					{Name: "audit_retention", Type: "number", Default: 365, Description: "Number of days the records of the audit log are kept. Set to 0 to keep them forever", Placeholder: "Default: 365"},
+					{Name: "format", Type: "select", Default: "text", Opts: []string{"text", "json"}, Description: "Default: \"text\". Use json to feed the logs into a log aggregator"},
+					{Name: "rotate_size", Type: "number", Default: 100, Description: "Size in MB after which the log file gets rotated. Set to 0 for the default of 100MB", Placeholder: "Default: 100"},
+					{Name: "rotate_age", Type: "number", Default: 30, Description: "Number of days to keep the rotated log files. Set to 0 to keep them forever", Placeholder: "Default: 30"},
+					{Name: "rotate_backups", Type: "number", Default: 10, Description: "Number of rotated log files to keep. Set to 0 to keep them all", Placeholder: "Default: 10"},
+					{Name: "compress", Type: "boolean", Default: true, Description: "Compress the rotated log files with gzip"},
+				},
+				Form: []Form{
+					{
+						Title: "subsystem",
+						Elmnts: []FormElement{
+							{Name: "search", Type: "select", Default: "DEFAULT", Opts: []string{"DEFAULT", "DEBUG", "INFO", "WARNING", "ERROR"}, Description: "Log level of the search indexers. DEFAULT follows the log level set above"},
+							{Name: "webdav", Type: "select", Default: "DEFAULT", Opts: []string{"DEFAULT", "DEBUG", "INFO", "WARNING", "ERROR"}, Description: "Log level of the webdav server"},
+							{Name: "backend", Type: "select", Default: "DEFAULT", Opts: []string{"DEFAULT", "DEBUG", "INFO", "WARNING", "ERROR"}, Description: "Log level of the storage backends. At DEBUG, every operation made onto a backend gets logged"},
+							{Name: "share", Type: "select", Default: "DEFAULT", Opts: []string{"DEFAULT", "DEBUG", "INFO", "WARNING", "ERROR"}, Description: "Log level of the shared links"},
+							{Name: "email", Type: "select", Default: "DEFAULT", Opts: []string{"DEFAULT", "DEBUG", "INFO", "WARNING", "ERROR"}, Description: "Log level of the outbound email queue"},
+							{Name: "maintenance", Type: "select", Default: "DEFAULT", Opts: []string{"DEFAULT", "DEBUG", "INFO", "WARNING", "ERROR"}, Description: "Log level of the maintenance tasks cleaning up the database"},
+						},
+					},
 				},
 			},
 			{
@@ -115,6 +150,21 @@ func NewConfiguration() Configuration {
 					{Name: "username", Type: "text", Description: "The username for authenticating to the SMTP server.", Placeholder: "Eg: username@gmail.com"},
 					{Name: "password", Type: "password", Description: "The password associated with the SMTP username.", Placeholder: "Eg: Your google password"},
 					{Name: "from", Type: "text", Description: "Email address visible on sent messages.", Placeholder: "Eg: username@gmail.com"},
+					{Name: "security", Type: "select", Default: "auto", Opts: []string{"auto", "starttls", "tls", "none"}, Description: "Encryption of the connection to the SMTP server. \"auto\" uses TLS on port 465 and STARTTLS whenever the server offers it, \"starttls\" refuses servers which don't, \"tls\" is for servers expecting TLS from the start and \"none\" is only meant for a relay on the same machine", Placeholder: "Default: auto"},
+					{Name: "skip_verify", Type: "boolean", Default: false, Description: "Accept the certificate of the SMTP server without checking it. Only for servers using a self signed certificate"},
+				},
+				Form: []Form{
+					{
+						Title: "template",
+						Elmnts: []FormElement{
+							{Name: "verification_subject", Type: "text", Default: "", Description: "Subject of the emails sending a verification code to open a shared link. Leave empty for the default", Placeholder: "Eg: Your code for {{ .Share }}"},
+							{Name: "verification_html", Type: "long_text", Default: "", Description: "HTML template of the emails sending a verification code. The variables are {{ .Code }}, {{ .Email }}, {{ .Share }} and {{ .Username }}, the username of the network drive. Leave empty for the default"},
+							{Name: "verification_text", Type: "long_text", Default: "", Description: "Plain text version of the emails sending a verification code, same variables as the HTML template. Leave empty for the default"},
+							{Name: "upload_subject", Type: "text", Default: "", Description: "Subject of the emails notifying of the files uploaded onto a shared link. Leave empty for the default", Placeholder: "Eg: {{ len .Uploads }} new file(s) on {{ .Share.Id }}"},
+							{Name: "upload_html", Type: "long_text", Default: "", Description: "HTML template of the emails notifying of the uploads. The variables are {{ .Share }} and {{ .Uploads }}, a list of files with a Name, Path, Size, Identity and Time, along with the functions size and date. Leave empty for the default"},
+							{Name: "upload_text", Type: "long_text", Default: "", Description: "Plain text version of the emails notifying of the uploads, same variables as the HTML template. Leave empty for the default"},
+						},
+					},
 				},
 			},
 			{
@@ -130,6 +180,11 @@ func NewConfiguration() Configuration {
 
 func (f Form) MarshalJSON() ([]byte, error) {
 	return []byte(f.toJSON(func(el FormElement) string {
+		if el.env != "" {
+			el.ReadOnly = true
+			el.Value = el.envInterface()
+			el.Description = strings.TrimSpace(fmt.Sprintf("Set from the %s environment variable. %s", el.env, el.Description))
+		}
 		a, e := json.Marshal(el)
 		if e != nil {
 			return ""
@@ -218,6 +273,7 @@ func (c *Configuration) Load() {
 		Log.Warning("Can't parse config file")
 		return
 	}
+	configFileHash.Store(QuickHash(string(cFile), 20))
 
 	// Extract enabled backends
 	c.Conn = func(cFile []byte) []map[string]interface{} {
@@ -225,6 +281,11 @@ func (c *Configuration) Load() {
 			Connections []map[string]interface{} `json:"connections"`
 		}
 		json.Unmarshal(cFile, &d)
+		for i := range d.Connections {
+			for key := range d.Connections[i] {
+				d.Connections[i][key] = configOpenValue(fmt.Sprintf("connections.%d.%s", i, key), d.Connections[i][key])
+			}
+		}
 		return d.Connections
 	}(cFile)
 
@@ -232,13 +293,18 @@ func (c *Configuration) Load() {
 	d := JsonIterator(string(cFile))
 	for i := range d {
 		c = c.Get(d[i].Path)
-		if c.Interface() != d[i].Value {
-			c.currentElement.Value = d[i].Value
+		if c.currentElement.env != "" {
+			// values coming from the environment are never persisted
+			continue
+		}
+		value := configOpenValue(d[i].Path, d[i].Value)
+		if c.Interface() != value {
+			c.currentElement.Value = value
 		}
 	}
 	c.cache.Clear()
 
-	Log.SetVisibility(c.Get("log.level").String())
+	logConfigure(c)
 
 	go func() { // Trigger all the event listeners
 		for i := 0; i < len(c.onChange); i++ {
@@ -334,13 +400,17 @@ func (c *Configuration) Save() *Configuration {
 	// convert config data to an appropriate json struct
 	form := append(c.form, Form{Title: "connections"})
 	v := Form{Form: form}.toJSON(func(el FormElement) string {
-		a, e := json.Marshal(el.Value)
+		value := el.Value
+		if str, ok := value.(string); ok && el.sensitive() {
+			value = configSecrets.seal(str)
+		}
+		a, e := json.Marshal(value)
 		if e != nil {
 			return "null"
 		}
 		return string(a)
 	})
-	v, _ = sjson.Set(v, "connections", c.Conn)
+	v, _ = sjson.Set(v, "connections", configSealConnections(c.Conn))
 
 	// deploy the config in our config.json
 	file, err := os.Create(ConfigJSONPath)
@@ -349,11 +419,21 @@ func (c *Configuration) Save() *Configuration {
 		return c
 	}
 	defer file.Close()
-	file.Write(PrettyPrint([]byte(v)))
+	b := PrettyPrint([]byte(v))
+	file.Write(b)
+	configFileHash.Store(QuickHash(string(b), 20))
 	return c
 }
 
 func (c *Configuration) Export() interface{} {
+	// templated connections hold credentials the user isn't meant to see
+	connections := make([]map[string]interface{}, 0, len(c.Conn))
+	for i := range c.Conn {
+		if IsConnectionTemplate(c.Conn[i]) {
+			continue
+		}
+		connections = append(connections, c.Conn[i])
+	}
 	return struct {
 		Editor        string            `json:"editor"`
 		ForkButton    bool              `json:"fork_button"`
@@ -374,7 +454,7 @@ func (c *Configuration) Export() interface{} {
 		Name:          c.Get("general.name").String(),
 		RememberMe:    c.Get("general.remember_me").Bool(),
 		UploadButton:  c.Get("general.upload_button").Bool(),
-		Connections:   c.Conn,
+		Connections:   connections,
 		EnableShare:   c.Get("features.share.enable").Bool(),
 		Logout:        c.Get("general.logout").String(),
 		MimeTypes:     AllMimeTypes(),
@@ -399,7 +479,7 @@ func (c *Configuration) Get(key string) *Configuration {
 						}
 					}
 					// 2) `formElement` does not exist, let's create it
-					(*forms)[i].Elmnts = append(currentForm.Elmnts, FormElement{Name: path[1], Type: "text"})
+					(*forms)[i].Elmnts = append(currentForm.Elmnts, FormElement{Name: path[1], Type: "text", implicit: true})
 					return &(*forms)[i].Elmnts[len(currentForm.Elmnts)]
 				} else {
 					// we are NOT on a leaf, let's continue our tree transversal
@@ -417,6 +497,7 @@ func (c *Configuration) Get(key string) *Configuration {
 	tmp := c.cache.Get(key)
 	if tmp == nil {
 		c.currentElement = traverse(&c.form, strings.Split(key, "."))
+		c.currentElement.loadEnv(key)
 		c.cache.Set(key, c.currentElement)
 	} else {
 		c.currentElement = tmp.(*FormElement)
@@ -427,6 +508,9 @@ func (c *Configuration) Get(key string) *Configuration {
 
 func (c *Configuration) Schema(fn func(*FormElement) *FormElement) *Configuration {
 	fn(c.currentElement)
+	if c.currentElement != nil {
+		c.currentElement.implicit = false
+	}
 	c.cache.Clear()
 	return c
 }
@@ -501,6 +585,9 @@ func (c *Configuration) Interface() interface{} {
 	if c.currentElement == nil {
 		return nil
 	}
+	if c.currentElement.env != "" {
+		return c.currentElement.envInterface()
+	}
 	val := c.currentElement.Value
 	if val == nil {
 		val = c.currentElement.Default
@@ -508,6 +595,166 @@ func (c *Configuration) Interface() interface{} {
 	return val
 }
 
+// Validate checks a config file against the definition of the form elements: the type of the values,
+// the options of the select fields and the required fields. Keys we know nothing about are left
+// alone as plugins can register new ones at any time
+func (c *Configuration) Validate(b []byte) error {
+	var d struct {
+		Connections interface{} `json:"connections"`
+	}
+	if err := json.Unmarshal(b, &d); err != nil {
+		return NewError("Invalid config: "+err.Error(), 400)
+	}
+	errs := []string{}
+	if d.Connections != nil {
+		conns, ok := d.Connections.([]interface{})
+		if !ok {
+			errs = append(errs, "connections: expected a list")
+		}
+		for i := range conns {
+			conn, ok := conns[i].(map[string]interface{})
+			if !ok || NewStringFromInterface(conn["type"]) == "" || NewStringFromInterface(conn["label"]) == "" {
+				errs = append(errs, fmt.Sprintf("connections[%d]: a type and a label are required", i))
+			}
+		}
+	}
+
+	values := make(map[string]interface{})
+	for _, v := range JsonIterator(string(b)) {
+		values[v.Path] = v.Value
+	}
+	c.mu.Lock()
+	form := Form{Form: c.form}
+	elements := form.Iterator()
+	c.mu.Unlock()
+	for _, el := range elements {
+		if el.implicit {
+			// nobody told us what this key is about
+			continue
+		}
+		key := el.Name
+		if el.Path != "" {
+			key = el.Path + "." + strings.Replace(el.Name, " ", "_", -1)
+		}
+		if err := el.FormElement.validate(values[key]); err != nil {
+			errs = append(errs, key+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return NewError("Invalid config: "+strings.Join(errs, ", "), 400)
+	}
+	return nil
+}
+
+func (el *FormElement) validate(value interface{}) error {
+	if value == nil {
+		if el.Required && el.env == "" && (el.Default == nil || el.Default == "") {
+			return fmt.Errorf("is required")
+		}
+		return nil
+	}
+	switch el.Type {
+	case "boolean", "enable":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("expected a boolean")
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("expected a number")
+		}
+	case "select":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a string")
+		} else if str == "" || len(el.Opts) == 0 {
+			return nil
+		}
+		for _, opt := range el.Opts {
+			if opt == str {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %s", strings.Join(el.Opts, ", "))
+	case "text", "string", "password", "long_password", "long_text", "bcrypt", "hidden", "directory":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("expected a string")
+		}
+	}
+	if el.Required && value == "" && el.env == "" {
+		return fmt.Errorf("is required")
+	}
+	return nil
+}
+
+// ConfigEnvName gives the environment variable overriding a config key, eg: "features.share.enable"
+// can be set with FILESTASH_FEATURES_SHARE_ENABLE
+func ConfigEnvName(key string) string {
+	return "FILESTASH_" + strings.ToUpper(configEnvReplacer.ReplaceAllString(key, "_"))
+}
+
+var configEnvReplacer = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+func (el *FormElement) loadEnv(key string) {
+	if el == nil {
+		return
+	}
+	name := ConfigEnvName(key)
+	if v := os.Getenv(name); v != "" {
+		el.env = name
+		el.envValue = v
+		return
+	}
+	el.env = ""
+	el.envValue = ""
+}
+
+func (el *FormElement) envInterface() interface{} {
+	switch el.Type {
+	case "boolean", "enable":
+		if b, err := strconv.ParseBool(el.envValue); err == nil {
+			return b
+		}
+	case "number":
+		if n, err := strconv.ParseFloat(el.envValue, 64); err == nil {
+			return n
+		}
+	}
+	return el.envValue
+}
+
+// configFileHash is the hash of the config file as we last read or wrote it, anything else means
+// someone edited the file by hand
+var configFileHash atomic.Value
+
+// watch reloads the config when the file gets edited on disk. The listeners registered through
+// ListenForChange get notified as with any other change
+func (c *Configuration) watch() {
+	var last time.Time
+	for {
+		time.Sleep(5 * time.Second)
+		s, err := os.Stat(ConfigJSONPath)
+		if err != nil || s.ModTime().Equal(last) {
+			continue
+		}
+		last = s.ModTime()
+		b, err := os.ReadFile(ConfigJSONPath)
+		if err != nil {
+			continue
+		}
+		if h, _ := configFileHash.Load().(string); h == QuickHash(string(b), 20) {
+			continue
+		}
+		if err := c.Validate(b); err != nil {
+			Log.Warning("config::watch '%s' change is ignored: %s", ConfigJSONPath, err.Error())
+			configFileHash.Store(QuickHash(string(b), 20))
+			continue
+		}
+		Log.Info("config::watch '%s' has changed, reloading", ConfigJSONPath)
+		c.Load()
+	}
+}
+
 func (c *Configuration) MarshalJSON() ([]byte, error) {
 	form := c.form
 	form = append(form, Form{
@@ -571,3 +818,58 @@ type ChangeListener struct {
 	Id       string
 	Listener chan interface{}
 }
+
+var connectionTemplateMatcher = regexp.MustCompile(`{{\s*[a-z_]+\s*}}`)
+
+// IsConnectionTemplate tells if a connection contains templated values like {{username}}. Those
+// connections can't be used as is, they are meant to be filled by an authentication plugin
+func IsConnectionTemplate(conn map[string]interface{}) bool {
+	for _, v := range conn {
+		if str, ok := v.(string); ok && connectionTemplateMatcher.MatchString(str) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectionTemplateApply creates a session out of a connection by substituting its templated values.
+// Templated values often end up in a path, eg: "/home/{{username}}/", so they are escaped to stay
+// within a single segment of the path
+func ConnectionTemplateApply(conn map[string]interface{}, values map[string]string) map[string]string {
+	session := make(map[string]string)
+	for k, v := range conn {
+		if k == "label" || v == nil {
+			continue
+		}
+		session[k] = connectionTemplateMatcher.ReplaceAllStringFunc(fmt.Sprintf("%v", v), func(m string) string {
+			return connectionTemplateEscape(values[strings.TrimSpace(strings.Trim(m, "{}"))])
+		})
+	}
+	return session
+}
+
+func connectionTemplateEscape(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, value)
+	if value == "." || value == ".." {
+		return strings.Repeat("_", len(value))
+	}
+	return value
+}
+
+// ConnectionTemplateMatch tells if a value could have been generated from a templated value
+func ConnectionTemplateMatch(tmpl string, value string) bool {
+	if !connectionTemplateMatcher.MatchString(tmpl) {
+		return tmpl == value
+	}
+	parts := connectionTemplateMatcher.Split(tmpl, -1)
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	matched, _ := regexp.MatchString("^"+strings.Join(parts, `[^/]+`)+"$", value)
+	return matched
+}
@@ -7,6 +7,7 @@ import (
 
 const (
 	AppVersion      = "v0.5"
+	StatePath       = "data/state/"
 	LogPath         = "data/state/log/"
 	ConfigPath      = "data/state/config/"
 	DbPath          = "data/state/db/"
@@ -40,6 +41,7 @@ var (
 	SecretKeyDerivateForAdmin string
 	SecretKeyDerivateForUser  string
 	SecretKeyDerivateForHash  string
+	SecretKeyDerivateForAudit string
 )
 
 // InitSecretDerivate Improve security by calculating derivative of the secret key to restrict the attack surface
@@ -50,4 +52,5 @@ func InitSecretDerivate(secret string) {
 	SecretKeyDerivateForAdmin = Hash("ADMIN_"+SecretKey, len(SecretKey))
 	SecretKeyDerivateForUser = Hash("USER_"+SecretKey, len(SecretKey))
 	SecretKeyDerivateForHash = Hash("HASH_"+SecretKey, len(SecretKey))
+	SecretKeyDerivateForAudit = Hash("AUDIT_"+SecretKey, len(SecretKey))
 }
@@ -220,6 +220,9 @@ func GenerateID(ctx *App) string {
 	if params["token"] != "" {
 		p += "token =>" + params["token"]
 	}
+	if params["identity"] != "" {
+		p += "identity =>" + params["identity"]
+	}
 
 	if p == "" {
 		return Hash("N/A", 20)
@@ -3,6 +3,7 @@ package common
 import (
 	"crypto/tls"
 	"fmt"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"net"
 	"net/http"
 	"time"
@@ -54,14 +55,21 @@ var DefaultTLSConfig = tls.Config{
 }
 
 func NewTransformedTransport(transport http.Transport) http.RoundTripper {
-	return &TransformedTransport{&transport}
+	return &TransformedTransport{
+		Orig:   &transport,
+		traced: otelhttp.NewTransport(&transport),
+	}
 }
 
 type TransformedTransport struct {
-	Orig http.RoundTripper
+	Orig   http.RoundTripper
+	traced http.RoundTripper
 }
 
 func (t *TransformedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	req.Header.Add("User-Agent", UserAgent)
+	if TracingEnabled() {
+		return t.traced.RoundTrip(req)
+	}
 	return t.Orig.RoundTrip(req)
 }
@@ -27,6 +27,7 @@ var (
 	ErrAuthenticationFailed = NewError("Invalid account", 400)
 	ErrCongestion           = NewError("Traffic congestion, try again later", 500)
 	ErrTimeout              = NewError("Timeout", 500)
+	ErrShareExhausted       = NewError("Link has reached its limit", 410)
 )
 
 type AppError struct {
@@ -8,7 +8,28 @@ import (
 
 var MockCurrentDir string
 
+// dataDir is where the config and the state live when not in ~/.filestash. It comes from the
+// FILESTASH_PATH environment variable or from the -data-dir flag of the command line, which is looked
+// at right away as the config gets loaded before the command line is parsed
+var dataDir = func() string {
+	for i := 1; i < len(os.Args); i++ {
+		if !strings.HasPrefix(os.Args[i], "-") {
+			continue
+		}
+		arg := strings.TrimLeft(os.Args[i], "-")
+		if arg == "data-dir" && i+1 < len(os.Args) {
+			return os.Args[i+1]
+		} else if strings.HasPrefix(arg, "data-dir=") {
+			return strings.TrimPrefix(arg, "data-dir=")
+		}
+	}
+	return os.Getenv("FILESTASH_PATH")
+}()
+
 func GetHomeDir() string {
+	if dataDir != "" {
+		return dataDir
+	}
 	homeDir, _ := os.UserHomeDir()
 	return filepath.Join(homeDir, ".filestash")
 }
@@ -1,125 +1,219 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
-	slog "log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-var logfile *os.File
+const (
+	logDebug = iota
+	logInfo
+	logWarning
+	logError
+)
 
-func init() {
-	var err error
-	logPath := filepath.Join(GetCurrentDir(), LogPath)
-	logfile, err = os.OpenFile(filepath.Join(logPath, "access.log"), os.O_APPEND|os.O_WRONLY|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		slog.Printf("ERROR log file: %+v", err)
-		return
-	}
-	logfile.WriteString("")
+var logLevels = map[string]int{
+	"DEBUG":   logDebug,
+	"INFO":    logInfo,
+	"WARNING": logWarning,
+	"ERROR":   logError,
+}
+
+// LogSubsystems are the parts of the application which can be given a log level of their own
+var LogSubsystems = []string{"search", "webdav", "backend", "share", "email", "maintenance"}
+
+type logger struct {
+	mu         sync.RWMutex
+	enable     bool
+	level      int
+	json       bool
+	subsystems map[string]int
+	file       *lumberjack.Logger
 }
 
+// log is a view onto the shared logger. Views created with Subsystem and Request tag every line
+// they write so that all the lines related to a same request or a same feature can be found back
 type log struct {
-	enable bool
-	debug  bool
-	info   bool
-	warn   bool
-	error  bool
+	*logger
+	subsystem string
+	request   string
 }
 
-func (l *log) Info(format string, v ...interface{}) {
-	if l.info && l.enable {
-		message := fmt.Sprintf("%s INFO ", l.now())
-		message = fmt.Sprintf(message+format+"\n", v...)
+func (l log) Info(format string, v ...interface{}) {
+	l.write(logInfo, format, v...)
+}
 
-		logfile.WriteString(message)
-		fmt.Printf(strings.Replace(message, "%", "%%", -1))
-	}
+func (l log) Warning(format string, v ...interface{}) {
+	l.write(logWarning, format, v...)
 }
 
-func (l *log) Warning(format string, v ...interface{}) {
-	if l.warn && l.enable {
-		message := fmt.Sprintf("%s WARN ", l.now())
-		message = fmt.Sprintf(message+format+"\n", v...)
+func (l log) Error(format string, v ...interface{}) {
+	l.write(logError, format, v...)
+}
 
-		logfile.WriteString(message)
-		fmt.Printf(strings.Replace(message, "%", "%%", -1))
-	}
+func (l log) Debug(format string, v ...interface{}) {
+	l.write(logDebug, format, v...)
 }
 
-func (l *log) Error(format string, v ...interface{}) {
-	if l.error && l.enable {
-		message := fmt.Sprintf("%s ERROR ", l.now())
-		message = fmt.Sprintf(message+format+"\n", v...)
+func (l log) Stdout(format string, v ...interface{}) {
+	os.Stdout.WriteString(fmt.Sprintf("%s %s\n", l.now(), fmt.Sprintf(format, v...)))
+}
 
-		logfile.WriteString(message)
-		fmt.Printf(strings.Replace(message, "%", "%%", -1))
-	}
+// Subsystem gives a logger following the log level set for that subsystem, falling back onto the
+// global level when none is set
+func (l log) Subsystem(name string) log {
+	l.subsystem = name
+	return l
 }
 
-func (l *log) Debug(format string, v ...interface{}) {
-	if l.debug && l.enable {
-		message := fmt.Sprintf("%s DEBUG ", l.now())
-		message = fmt.Sprintf(message+format+"\n", v...)
+// Request gives a logger which tags every line with the correlation ID of a request
+func (l log) Request(id string) log {
+	l.request = id
+	return l
+}
 
-		logfile.WriteString(message)
-		fmt.Printf(strings.Replace(message, "%", "%%", -1))
+func (l log) write(level int, format string, v ...interface{}) {
+	l.mu.RLock()
+	enable, threshold, asJson := l.enable, l.level, l.json
+	if lvl, ok := l.subsystems[l.subsystem]; ok {
+		threshold = lvl
+	}
+	l.mu.RUnlock()
+	if !enable || level < threshold {
+		return
 	}
+
+	message := fmt.Sprintf(format, v...)
+	var line string
+	if asJson {
+		b, _ := json.Marshal(struct {
+			Time      string `json:"time"`
+			Level     string `json:"level"`
+			Subsystem string `json:"subsystem,omitempty"`
+			Request   string `json:"request_id,omitempty"`
+			Message   string `json:"message"`
+		}{time.Now().Format(time.RFC3339Nano), l.levelName(level), l.subsystem, l.request, message})
+		line = string(b) + "\n"
+	} else {
+		line = l.now() + " " + l.levelName(level) + " "
+		if l.subsystem != "" {
+			line += "[" + l.subsystem + "] "
+		}
+		if l.request != "" {
+			line += "[" + l.request + "] "
+		}
+		line += message + "\n"
+	}
+
+	l.mu.Lock()
+	l.file.Write([]byte(line))
+	l.mu.Unlock()
+	os.Stdout.WriteString(line)
 }
 
-func (l *log) Stdout(format string, v ...interface{}) {
-	message := fmt.Sprintf("%s ", l.now())
-	message = fmt.Sprintf(message+format+"\n", v...)
-	fmt.Printf(strings.Replace(message, "%", "%%", -1))
+func (l log) levelName(level int) string {
+	switch level {
+	case logDebug:
+		return "DEBUG"
+	case logWarning:
+		return "WARN"
+	case logError:
+		return "ERROR"
+	default:
+		return "INFO"
+	}
 }
 
-func (l *log) now() string {
+func (l log) now() string {
 	return time.Now().Format("2006/01/02 15:04:05")
 }
 
-func (l *log) Close() {
-	logfile.Close()
-}
-
-func (l *log) SetVisibility(str string) {
-	switch str {
-	case "WARNING":
-		l.debug = false
-		l.info = false
-		l.warn = true
-		l.error = true
-	case "ERROR":
-		l.debug = false
-		l.info = false
-		l.warn = false
-		l.error = true
-	case "DEBUG":
-		l.debug = true
-		l.info = true
-		l.warn = true
-		l.error = true
-	case "INFO":
-		l.debug = false
-		l.info = true
-		l.warn = true
-		l.error = true
-	default:
-		l.debug = false
-		l.info = true
-		l.warn = true
-		l.error = true
+func (l log) Close() {
+	l.mu.Lock()
+	l.file.Close()
+	l.mu.Unlock()
+}
+
+func (l log) SetVisibility(str string) {
+	lvl, ok := logLevels[str]
+	if !ok {
+		lvl = logInfo
+	}
+	l.mu.Lock()
+	l.level = lvl
+	l.mu.Unlock()
+}
+
+// SetSubsystemVisibility overrides the log level of a subsystem. An unknown level, like an empty
+// string, makes the subsystem follow the global level again
+func (l log) SetSubsystemVisibility(subsystem string, str string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lvl, ok := logLevels[str]; ok {
+		l.subsystems[subsystem] = lvl
+		return
 	}
+	delete(l.subsystems, subsystem)
 }
 
-func (l *log) Enable(val bool) {
+func (l log) SetFormat(format string) {
+	l.mu.Lock()
+	l.json = format == "json"
+	l.mu.Unlock()
+}
+
+// SetRotation controls when the log file gets rotated: maxSize is in MB, maxAge in days and
+// maxBackups is the number of rotated files to keep around. A value of 0 disables the criteria
+func (l log) SetRotation(maxSize int, maxAge int, maxBackups int, compress bool) {
+	l.mu.Lock()
+	l.file.MaxSize = maxSize
+	l.file.MaxAge = maxAge
+	l.file.MaxBackups = maxBackups
+	l.file.Compress = compress
+	l.mu.Unlock()
+}
+
+func (l log) Enable(val bool) {
+	l.mu.Lock()
 	l.enable = val
+	l.mu.Unlock()
 }
 
 var Log = func() log {
-	l := log{}
+	l := log{logger: &logger{
+		level:      logInfo,
+		subsystems: make(map[string]int),
+		file: &lumberjack.Logger{
+			Filename:   filepath.Join(GetCurrentDir(), LogPath, "access.log"),
+			MaxSize:    100,
+			MaxAge:     30,
+			MaxBackups: 10,
+			Compress:   true,
+			LocalTime:  true,
+		},
+	}}
 	l.Enable(true)
 	return l
 }()
+
+// logConfigure applies the log section of the configuration
+func logConfigure(c *Configuration) {
+	Log.SetVisibility(c.Get("log.level").String())
+	Log.SetFormat(c.Get("log.format").String())
+	Log.SetRotation(
+		c.Get("log.rotate_size").Int(),
+		c.Get("log.rotate_age").Int(),
+		c.Get("log.rotate_backups").Int(),
+		c.Get("log.compress").Bool(),
+	)
+	for _, s := range LogSubsystems {
+		Log.SetSubsystemVisibility(s, strings.ToUpper(c.Get("log.subsystem."+s).String()))
+	}
+}
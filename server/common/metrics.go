@@ -0,0 +1,84 @@
+package common
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Metrics exposed on /metrics. Every subsystem records its own data onto those collectors, subsystems
+// which already keep their state somewhere (eg: the search indexers) can register their own
+// collector onto the MetricsRegistry
+
+var (
+	MetricsRegistry = prometheus.NewRegistry()
+
+	MetricHttpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filestash_http_requests_total",
+		Help: "Number of HTTP requests handled",
+	}, []string{"route", "method", "status"})
+	MetricHttpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "filestash_http_request_duration_seconds",
+		Help:    "Time spent handling HTTP requests",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	MetricHttpBytesIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filestash_http_request_bytes_total",
+		Help: "Bytes received in the body of HTTP requests",
+	}, []string{"route"})
+	MetricHttpBytesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filestash_http_response_bytes_total",
+		Help: "Bytes sent in the body of HTTP responses",
+	}, []string{"route"})
+	MetricBackendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "filestash_backend_operation_duration_seconds",
+		Help:    "Time spent waiting for the storage backends",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+	MetricBackendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filestash_backend_operation_errors_total",
+		Help: "Number of failed operations on the storage backends",
+	}, []string{"backend", "operation"})
+	MetricCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filestash_cache_requests_total",
+		Help: "Lookups made onto the internal caches, by result (hit or miss)",
+	}, []string{"cache", "result"})
+	MetricTranscodes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "filestash_video_transcodes_active",
+		Help: "Number of videos currently being transcoded",
+	})
+	MetricMaintenanceRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filestash_maintenance_runs_total",
+		Help: "Number of maintenance tasks run, by result (ok or error)",
+	}, []string{"task", "result"})
+	MetricMaintenanceRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filestash_maintenance_removed_total",
+		Help: "Rows removed from the database by the maintenance tasks",
+	}, []string{"task"})
+	MetricMaintenanceLastRun = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "filestash_maintenance_last_run_timestamp_seconds",
+		Help: "Time at which a maintenance task last completed successfully",
+	}, []string{"task"})
+	MetricEventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filestash_events_dropped_total",
+		Help: "Events that couldn't be recorded because the queue they go through was full, by queue (audit or share_activity)",
+	}, []string{"queue"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		MetricHttpRequests,
+		MetricHttpDuration,
+		MetricHttpBytesIn,
+		MetricHttpBytesOut,
+		MetricBackendDuration,
+		MetricBackendErrors,
+		MetricCacheRequests,
+		MetricTranscodes,
+		MetricMaintenanceRuns,
+		MetricMaintenanceRemoved,
+		MetricMaintenanceLastRun,
+		MetricEventsDropped,
+	)
+}
@@ -49,6 +49,20 @@ func (g Get) Starter() []func(*mux.Router) {
 	return starter_process
 }
 
+/*
+ * Health checks
+ * They are run by the readiness probe. A failing critical check makes the instance not ready while
+ * the others only show up as a warning
+ */
+var health_checks []HealthCheck
+
+func (r Register) HealthCheck(name string, critical bool, fn func() error) {
+	health_checks = append(health_checks, HealthCheck{Name: name, Critical: critical, Check: fn})
+}
+func (g Get) HealthCheck() []HealthCheck {
+	return health_checks
+}
+
 /*
  * UI Overrides
  * They are the means by which server plugin change the frontend behaviors.
@@ -0,0 +1,295 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManyRequests = NewError("Too many requests, try again later", 429)
+
+	RateLimitPerMinute func() int
+	LockoutAttempts    func() int
+	LockoutDuration    func() time.Duration
+	TrustedProxies     func() string
+
+	// AuthLockout keeps track of the failed authentication attempts: the login screen, the admin
+	// console and the proofs of shared links
+	AuthLockout = NewLockout()
+)
+
+func init() {
+	RateLimitPerMinute = func() int {
+		return Config.Get("features.protection.rate_limit").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "rate_limit"
+			f.Type = "number"
+			f.Default = 1200
+			f.Description = `Maximum number of requests per minute that can be made from the same IP, the same session
+ or against the same shared link. Set to 0 to disable`
+			f.Placeholder = fmt.Sprintf("Default: %d", f.Default)
+			return f
+		}).Int()
+	}
+	RateLimitPerMinute()
+	LockoutAttempts = func() int {
+		return Config.Get("features.protection.login_attempts").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "login_attempts"
+			f.Type = "number"
+			f.Default = 5
+			f.Description = "Number of failed authentication attempts before the client gets locked out"
+			f.Placeholder = fmt.Sprintf("Default: %d", f.Default)
+			return f
+		}).Int()
+	}
+	LockoutAttempts()
+	LockoutDuration = func() time.Duration {
+		return time.Duration(Config.Get("features.protection.lockout_time").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "lockout_time"
+			f.Type = "number"
+			f.Default = 30
+			f.Description = "Duration of the first lockout in seconds. It doubles on every further failure, up to an hour"
+			f.Placeholder = fmt.Sprintf("Default: %ds", f.Default)
+			return f
+		}).Int()) * time.Second
+	}
+	LockoutDuration()
+	TrustedProxies = func() string {
+		return Config.Get("features.protection.trusted_proxies").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "trusted_proxies"
+			f.Type = "text"
+			f.Default = ""
+			f.Description = `Comma separated list of the IPs or ranges of the reverse proxies in front of Filestash. The
+ client IP is taken from the X-Forwarded-For header they set, for requests coming from anywhere else the header is ignored`
+			f.Placeholder = "Eg: 127.0.0.1, 10.0.0.0/8"
+			return f
+		}).String()
+	}
+	TrustedProxies()
+}
+
+// RateLimiter is a set of token buckets. Each bucket holds up to a minute worth of requests and
+// is refilled continuously.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	r := &RateLimiter{buckets: make(map[string]*tokenBucket)}
+	go func() {
+		for range time.Tick(5 * time.Minute) {
+			r.mu.Lock()
+			for key, b := range r.buckets {
+				if time.Since(b.last) > time.Minute {
+					delete(r.buckets, key)
+				}
+			}
+			r.mu.Unlock()
+		}
+	}()
+	return r
+}
+
+// Allow consumes a token from the bucket. When the bucket is empty, it gives back how long the
+// caller should wait before trying again
+func (r *RateLimiter) Allow(key string, perMinute int) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+	capacity := float64(perMinute)
+	refill := capacity / 60
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		r.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*refill)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / refill * float64(time.Second))
+	}
+	b.tokens -= 1
+	return true, 0
+}
+
+// Lockout tracks failures and locks a key out with an exponential backoff once the number of
+// allowed attempts is exhausted. A successful attempt resets the counter.
+type Lockout struct {
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+}
+
+type lockoutEntry struct {
+	failures int
+	until    time.Time
+	last     time.Time
+}
+
+func NewLockout() *Lockout {
+	l := &Lockout{entries: make(map[string]*lockoutEntry)}
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			l.mu.Lock()
+			for key, e := range l.entries {
+				if time.Since(e.last) > 24*time.Hour && time.Now().After(e.until) {
+					delete(l.entries, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+	return l
+}
+
+func (l *Lockout) Wait(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if e, ok := l.entries[key]; ok {
+			if w := time.Until(e.until); w > wait {
+				wait = w
+			}
+		}
+	}
+	return wait
+}
+
+func (l *Lockout) Fail(keys ...string) {
+	attempts := LockoutAttempts()
+	if attempts <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		e, ok := l.entries[key]
+		if !ok {
+			e = &lockoutEntry{}
+			l.entries[key] = e
+		}
+		e.failures += 1
+		e.last = time.Now()
+		if e.failures < attempts {
+			continue
+		}
+		wait := LockoutDuration() << uint(math.Min(float64(e.failures-attempts), 16))
+		if wait > time.Hour || wait <= 0 {
+			wait = time.Hour
+		}
+		e.until = time.Now().Add(wait)
+		Log.Warning("Intrusion detection: locking out '%s' for %s after %d failed attempts", key, wait, e.failures)
+	}
+}
+
+func (l *Lockout) Reset(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.entries, key)
+	}
+}
+
+func SendTooManyRequests(res http.ResponseWriter, wait time.Duration) {
+	res.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+	SendErrorResult(res, ErrTooManyRequests)
+}
+
+// RemoteIP gives the IP of the client. Behind a reverse proxy, X-Forwarded-For is read from right to
+// left, as every proxy appends the address it got the request from, up to the first address that isn't
+// one of the trusted proxies. Anybody can set that header so it's ignored for requests that don't come
+// from a trusted proxy
+func RemoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	proxies := trustedProxies()
+	if !ipInRanges(host, proxies) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		host = ip
+		if !ipInRanges(ip, proxies) {
+			break
+		}
+	}
+	return host
+}
+
+var trustedProxiesCache struct {
+	sync.Mutex
+	raw    string
+	ranges []*net.IPNet
+}
+
+func trustedProxies() []*net.IPNet {
+	raw := TrustedProxies()
+	trustedProxiesCache.Lock()
+	defer trustedProxiesCache.Unlock()
+	if raw == trustedProxiesCache.raw {
+		return trustedProxiesCache.ranges
+	}
+	ranges := []*net.IPNet{}
+	for _, r := range strings.FieldsFunc(raw, func(c rune) bool { return c == ',' || c == ' ' }) {
+		cidr := r
+		if ip := net.ParseIP(r); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else if ip != nil {
+			cidr += "/128"
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			Log.Warning("common::ratelimit invalid trusted proxy '%s'", r)
+			continue
+		}
+		ranges = append(ranges, n)
+	}
+	trustedProxiesCache.raw = raw
+	trustedProxiesCache.ranges = ranges
+	return ranges
+}
+
+func ipInRanges(ip string, ranges []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, r := range ranges {
+		if r.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
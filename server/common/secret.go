@@ -0,0 +1,257 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ConfigSecretPrefix marks the values of the config file that are encrypted with the master key
+const ConfigSecretPrefix = "enc:v1:"
+
+// configConnectionSecrets are the connection parameters considered sensitive when the backend
+// doesn't tell us through its login form
+var configConnectionSecrets = []string{
+	"password", "passphrase", "private_key", "secret_access_key",
+	"client_secret", "token", "access_token", "refresh_token",
+}
+
+// configSecrets encrypts the sensitive values of the config file at rest. Without a master key,
+// values are stored in plain text as they always were
+var configSecrets = func() *secretBox {
+	s := &secretBox{sealed: make(map[string]string)}
+	s.setKey(configMasterKeyLoad())
+	return s
+}()
+
+type secretBox struct {
+	mu  sync.RWMutex
+	raw string
+	key string
+	// sealed remembers the cipher text of every value we've seen so that saving the config doesn't
+	// give a different file every time
+	sealed map[string]string
+}
+
+func (s *secretBox) setKey(raw string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.raw
+	s.raw = raw
+	s.key = ""
+	if raw != "" {
+		s.key = Hash("MASTER_"+raw, 32)
+	}
+	s.sealed = make(map[string]string)
+	return previous
+}
+
+func (s *secretBox) enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.key != ""
+}
+
+func (s *secretBox) seal(value string) string {
+	if value == "" || strings.HasPrefix(value, ConfigSecretPrefix) {
+		return value
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key == "" {
+		return value
+	}
+	if c, ok := s.sealed[value]; ok {
+		return c
+	}
+	c, err := EncryptString(s.key, value)
+	if err != nil {
+		Log.Error("config::secret encryption error %s", err.Error())
+		return value
+	}
+	s.sealed[value] = ConfigSecretPrefix + c
+	return ConfigSecretPrefix + c
+}
+
+func (s *secretBox) open(value string) (string, error) {
+	if !strings.HasPrefix(value, ConfigSecretPrefix) {
+		return value, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key == "" {
+		return value, ErrMissingDependency
+	}
+	plain, err := DecryptString(s.key, strings.TrimPrefix(value, ConfigSecretPrefix))
+	if err != nil {
+		return value, ErrNotValid
+	}
+	s.sealed[plain] = value
+	return plain, nil
+}
+
+// ConfigMasterKeyFile is the file the master key is read from when it isn't given directly through
+// the FILESTASH_MASTER_KEY environment variable
+func ConfigMasterKeyFile() string {
+	return os.Getenv("FILESTASH_MASTER_KEY_FILE")
+}
+
+func configMasterKeyLoad() string {
+	if key := os.Getenv("FILESTASH_MASTER_KEY"); key != "" {
+		return key
+	}
+	path := ConfigMasterKeyFile()
+	if path == "" {
+		return ""
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		Log.Warning("config::secret master key file '%s' doesn't exist, secrets are stored in plain text", path)
+		return ""
+	} else if err != nil {
+		Log.Error("config::secret can't read the master key file '%s': %s", path, err.Error())
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// ConfigEncrypted tells if the sensitive values of the config file are encrypted at rest
+func ConfigEncrypted() bool {
+	return configSecrets.enabled()
+}
+
+// ConfigMasterKeySet changes the key used to encrypt the config and gives back the previous one.
+// Nothing gets written to disk until the config is saved
+func ConfigMasterKeySet(raw string) string {
+	return configSecrets.setKey(raw)
+}
+
+// ConfigOpen decrypts all the encrypted values of a config file
+func ConfigOpen(b []byte) ([]byte, error) {
+	s := string(b)
+	var err error
+	for _, v := range JsonIterator(s) {
+		if s, err = configOpenPath(s, v.Path, v.Value); err != nil {
+			return b, err
+		}
+	}
+	for i, conn := range gjson.Get(s, "connections").Array() {
+		for key, value := range conn.Map() {
+			if s, err = configOpenPath(s, fmt.Sprintf("connections.%d.%s", i, key), value.Value()); err != nil {
+				return b, err
+			}
+		}
+	}
+	return []byte(s), nil
+}
+
+func configOpenPath(s string, path string, value interface{}) (string, error) {
+	str, ok := value.(string)
+	if !ok || !strings.HasPrefix(str, ConfigSecretPrefix) {
+		return s, nil
+	}
+	plain, err := configSecrets.open(str)
+	if err != nil {
+		return s, fmt.Errorf("can't decrypt '%s': %s", path, err.Error())
+	}
+	return sjson.Set(s, path, plain)
+}
+
+// Seal encrypts the sensitive values of a config file, that is the password fields, the fields
+// marked as secret and the credentials of the connections
+func (c *Configuration) Seal(b []byte) []byte {
+	if !configSecrets.enabled() {
+		return b
+	}
+	return c.mapSecrets(b, false, configSecrets.seal)
+}
+
+// ConfigRedacted stands in for the sensitive values of a config file when they're shown to the admin
+const ConfigRedacted = "********"
+
+// Redact hides the sensitive values of a config file, encrypted or not, along with the password hashes.
+// It's what the admin gets to see of the versions of the config kept in the history
+func (c *Configuration) Redact(b []byte) []byte {
+	return c.mapSecrets(b, true, func(value string) string {
+		if value == "" {
+			return value
+		}
+		return ConfigRedacted
+	})
+}
+
+func (c *Configuration) mapSecrets(b []byte, hashes bool, fn func(string) string) []byte {
+	secrets := make(map[string]bool)
+	for _, el := range (&Form{Form: c.form}).Iterator() {
+		if el.sensitive() || (hashes && el.Type == "bcrypt") {
+			secrets[el.Path+"."+el.Name] = true
+		}
+	}
+	s := string(b)
+	for _, v := range JsonIterator(s) {
+		if str, ok := v.Value.(string); ok && secrets[v.Path] {
+			s, _ = sjson.Set(s, v.Path, fn(str))
+		}
+	}
+	for i, conn := range gjson.Get(s, "connections").Array() {
+		typ := conn.Get("type").String()
+		for key, value := range conn.Map() {
+			if value.Type == gjson.String && configConnectionSecret(typ, key) {
+				s, _ = sjson.Set(s, fmt.Sprintf("connections.%d.%s", i, key), fn(value.String()))
+			}
+		}
+	}
+	return []byte(s)
+}
+
+func (el FormElement) sensitive() bool {
+	return el.Secret || el.Type == "password" || el.Type == "long_password"
+}
+
+func configConnectionSecret(typ string, key string) bool {
+	for _, el := range Backend.Get(typ).LoginForm().Elmnts {
+		if el.Name == key {
+			return el.sensitive()
+		}
+	}
+	for _, name := range configConnectionSecrets {
+		if name == key {
+			return true
+		}
+	}
+	return false
+}
+
+func configSealConnections(conns []map[string]interface{}) []map[string]interface{} {
+	if !configSecrets.enabled() {
+		return conns
+	}
+	sealed := make([]map[string]interface{}, len(conns))
+	for i := range conns {
+		sealed[i] = make(map[string]interface{}, len(conns[i]))
+		typ := NewStringFromInterface(conns[i]["type"])
+		for key, value := range conns[i] {
+			if str, ok := value.(string); ok && configConnectionSecret(typ, key) {
+				value = configSecrets.seal(str)
+			}
+			sealed[i][key] = value
+		}
+	}
+	return sealed
+}
+
+func configOpenValue(path string, value interface{}) interface{} {
+	str, ok := value.(string)
+	if !ok {
+		return value
+	}
+	plain, err := configSecrets.open(str)
+	if err != nil {
+		Log.Error("config::secret can't decrypt '%s' with the master key: %s", path, err.Error())
+	}
+	return plain
+}
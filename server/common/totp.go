@@ -0,0 +1,78 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time based one time password as described in RFC 6238, with the parameters every authenticator app
+// understands: SHA1, 6 digits and a 30 seconds period
+
+const (
+	TotpPeriod = 30
+	TotpDigits = 6
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func TotpGenerateSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+func TotpProvisioningURI(secret string, account string) string {
+	issuer := "Filestash"
+	if host := Config.Get("general.host").String(); host != "" {
+		issuer += " - " + host
+	}
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", TotpDigits))
+	v.Set("period", fmt.Sprintf("%d", TotpPeriod))
+	return fmt.Sprintf(
+		"otpauth://totp/%s:%s?%s",
+		url.PathEscape(issuer), url.PathEscape(account), v.Encode(),
+	)
+}
+
+func TotpIsValidSecret(secret string) bool {
+	b, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	return err == nil && len(b) >= 10
+}
+
+// TotpVerify checks the code against the current time step, tolerating one step of clock drift. It
+// gives back the step that matched so that the caller can refuse the same code from being used twice
+func TotpVerify(secret string, code string) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil || len(code) != TotpDigits {
+		return 0, false
+	}
+	now := time.Now().Unix() / TotpPeriod
+	for _, step := range []int64{now - 1, now, now + 1} {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
@@ -0,0 +1,142 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	TracingExporter func() string
+	TracingEndpoint func() string
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "filestash"),
+			attribute.String("service.version", AppVersion),
+		)),
+	)
+	tracer = tracerProvider.Tracer("github.com/bingoohuang/filestash")
+
+	tracing struct {
+		mu        sync.Mutex
+		enabled   atomic.Bool
+		current   string
+		processor sdktrace.SpanProcessor
+	}
+)
+
+func init() {
+	TracingExporter = func() string {
+		return Config.Get("features.tracing.exporter").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "exporter"
+			f.Type = "select"
+			f.Opts = []string{"none", "stdout", "otlp"}
+			f.Default = "none"
+			f.Description = `Where to send the OpenTelemetry traces. "otlp" sends them to a collector using OTLP over HTTP,
+ "stdout" prints them out`
+			return f
+		}).String()
+	}
+	TracingExporter()
+	TracingEndpoint = func() string {
+		return Config.Get("features.tracing.endpoint").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "endpoint"
+			f.Type = "text"
+			f.Default = "http://localhost:4318/v1/traces"
+			f.Description = "URL of the OTLP collector the traces are sent to"
+			f.Placeholder = "Default: http://localhost:4318/v1/traces"
+			return f
+		}).String()
+	}
+	TracingEndpoint()
+
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracingConfigure()
+	go func() {
+		onChange := Config.ListenForChange()
+		for range onChange.Listener {
+			tracingConfigure()
+		}
+	}()
+}
+
+// tracingConfigure plugs the exporter selected in the config onto the tracer provider. The provider
+// itself never changes as the tracers handed out by otel would otherwise keep pointing to the old one
+func tracingConfigure() {
+	exporter, endpoint := TracingExporter(), TracingEndpoint()
+	tracing.mu.Lock()
+	defer tracing.mu.Unlock()
+	if tracing.current == exporter+"::"+endpoint {
+		return
+	}
+	tracing.current = exporter + "::" + endpoint
+
+	if old := tracing.processor; old != nil {
+		tracing.enabled.Store(false)
+		tracerProvider.UnregisterSpanProcessor(old)
+		tracing.processor = nil
+		go old.Shutdown(context.Background())
+	}
+
+	var (
+		exp sdktrace.SpanExporter
+		err error
+	)
+	switch exporter {
+	case "stdout":
+		exp, err = stdouttrace.New()
+	case "otlp":
+		exp, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	default:
+		return
+	}
+	if err != nil {
+		Log.Error("tracing::configure exporter '%s' error: %s", exporter, err.Error())
+		return
+	}
+	tracing.processor = sdktrace.NewBatchSpanProcessor(exp)
+	tracerProvider.RegisterSpanProcessor(tracing.processor)
+	tracing.enabled.Store(true)
+}
+
+func TracingEnabled() bool {
+	return tracing.enabled.Load()
+}
+
+// StartSpan starts a span as a child of whatever span ctx carries. When tracing is off, the context is
+// given back untouched along with a span that does nothing
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !TracingEnabled() {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+func SpanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
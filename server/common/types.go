@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -75,6 +76,7 @@ type Share struct {
 	Path         string  `json:"path"`
 	Password     *string `json:"password,omitempty"`
 	Users        *string `json:"users,omitempty"`
+	Totp         *string `json:"totp,omitempty"`
 	Expire       *int64  `json:"expire,omitempty"`
 	Url          *string `json:"url,omitempty"`
 	CanShare     bool    `json:"can_share"`
@@ -82,6 +84,90 @@ type Share struct {
 	CanRead      bool    `json:"can_read"`
 	CanWrite     bool    `json:"can_write"`
 	CanUpload    bool    `json:"can_upload"`
+	MaxDownloads *int64  `json:"max_downloads,omitempty"`
+	MaxVisits    *int64  `json:"max_visits,omitempty"`
+	OneShot      bool    `json:"one_shot"`
+	Downloads    int64   `json:"downloads"`
+	Visits       int64   `json:"visits"`
+
+	Notify           *ShareNotify `json:"notify,omitempty"`
+	MaxUploads       *int64       `json:"max_uploads,omitempty"`
+	MaxUploadSize    *int64       `json:"max_upload_size,omitempty"`
+	UploadExtensions *string      `json:"upload_extensions,omitempty"`
+
+	// Collection links are made of a list of files and folders rather than a single path, they show up
+	// as a virtual directory whose Path is the common parent of all of them
+	Collection bool     `json:"collection,omitempty"`
+	Paths      []string `json:"paths,omitempty"`
+
+	// ViewOnly links can't be downloaded as such, what they serve is stamped with the watermark
+	ViewOnly  bool    `json:"view_only"`
+	Watermark *string `json:"watermark,omitempty"`
+
+	// Proofs are the settings of the proofs plugins bring, by key of the proof
+	Proofs map[string]string `json:"proofs,omitempty"`
+}
+
+// ShareNotify is who gets told about the files uploaded onto a shared link. Without a digest, a
+// notification goes out on every upload
+type ShareNotify struct {
+	Email   string `json:"email,omitempty"`
+	Webhook string `json:"webhook,omitempty"`
+	Digest  bool   `json:"digest,omitempty"`
+}
+
+func NewShareProofsFromInterface(val interface{}) map[string]string {
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	proofs := map[string]string{}
+	for key, value := range m {
+		proofs[key] = strings.TrimSpace(NewStringFromInterface(value))
+	}
+	return proofs
+}
+
+func NewShareNotifyFromInterface(val interface{}) *ShareNotify {
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	n := ShareNotify{
+		Email:   strings.TrimSpace(NewStringFromInterface(m["email"])),
+		Webhook: strings.TrimSpace(NewStringFromInterface(m["webhook"])),
+		Digest:  NewBoolFromInterface(m["digest"]),
+	}
+	if n.Email == "" && n.Webhook == "" {
+		return nil
+	}
+	return &n
+}
+
+type Token struct {
+	Id        string  `json:"id"`
+	Name      string  `json:"name"`
+	Backend   string  `json:"-"`
+	Auth      string  `json:"-"`
+	Path      string  `json:"path"`
+	Expire    *int64  `json:"expire,omitempty"`
+	Created   int64   `json:"created"`
+	LastUsed  *int64  `json:"last_used,omitempty"`
+	Value     *string `json:"token,omitempty"`
+	CanRead   bool    `json:"can_read"`
+	CanWrite  bool    `json:"can_write"`
+	CanUpload bool    `json:"can_upload"`
+	CanShare  bool    `json:"can_share"`
+}
+
+func (t Token) IsValid() error {
+	if t.Expire != nil {
+		now := time.Now().UnixNano() / 1000000
+		if now > *t.Expire {
+			return NewError("Token has expired", 401)
+		}
+	}
+	return nil
 }
 
 func (s Share) IsValid() error {
@@ -91,9 +177,29 @@ func (s Share) IsValid() error {
 			return NewError("Link has expired", 410)
 		}
 	}
+	if s.MaxDownloads != nil && s.Downloads >= *s.MaxDownloads {
+		return ErrShareExhausted
+	}
+	if s.MaxVisits != nil && s.Visits >= *s.MaxVisits {
+		return ErrShareExhausted
+	}
 	return nil
 }
 
+// Remaining gives how many more downloads and visits the link allows, nil when there's no limit
+func (s Share) Remaining() (downloads *int64, visits *int64) {
+	left := func(max *int64, used int64) *int64 {
+		if max == nil {
+			return nil
+		}
+		if used >= *max {
+			return NewInt64(0)
+		}
+		return NewInt64(*max - used)
+	}
+	return left(s.MaxDownloads, s.Downloads), left(s.MaxVisits, s.Visits)
+}
+
 func (s *Share) MarshalJSON() ([]byte, error) {
 	p := Share{
 		Id:      s.Id,
@@ -105,6 +211,12 @@ func (s *Share) MarshalJSON() ([]byte, error) {
 			}
 			return nil
 		}(s.Password),
+		Totp: func(secret *string) *string {
+			if secret != nil {
+				return NewString(PasswordDummy)
+			}
+			return nil
+		}(s.Totp),
 		Users:        s.Users,
 		Expire:       s.Expire,
 		Url:          s.Url,
@@ -113,8 +225,31 @@ func (s *Share) MarshalJSON() ([]byte, error) {
 		CanRead:      s.CanRead,
 		CanWrite:     s.CanWrite,
 		CanUpload:    s.CanUpload,
+		MaxDownloads: s.MaxDownloads,
+		MaxVisits:    s.MaxVisits,
+		OneShot:      s.OneShot,
+		Downloads:    s.Downloads,
+		Visits:       s.Visits,
+
+		Notify:           s.Notify,
+		MaxUploads:       s.MaxUploads,
+		MaxUploadSize:    s.MaxUploadSize,
+		UploadExtensions: s.UploadExtensions,
+
+		Collection: s.Collection,
+		Paths:      s.Paths,
+
+		ViewOnly:  s.ViewOnly,
+		Watermark: s.Watermark,
+
+		Proofs: s.Proofs,
 	}
-	return json.Marshal(p)
+	remainingDownloads, remainingVisits := s.Remaining()
+	return json.Marshal(struct {
+		Share
+		RemainingDownloads *int64 `json:"remaining_downloads,omitempty"`
+		RemainingVisits    *int64 `json:"remaining_visits,omitempty"`
+	}{p, remainingDownloads, remainingVisits})
 }
 func (s *Share) UnmarshallJSON(b []byte) error {
 	var tmp map[string]interface{}
@@ -127,6 +262,8 @@ func (s *Share) UnmarshallJSON(b []byte) error {
 			s.Password = NewStringpFromInterface(value)
 		case "users":
 			s.Users = NewStringpFromInterface(value)
+		case "totp":
+			s.Totp = NewStringpFromInterface(value)
 		case "expire":
 			s.Expire = NewInt64pFromInterface(value)
 		case "url":
@@ -141,7 +278,48 @@ func (s *Share) UnmarshallJSON(b []byte) error {
 			s.CanWrite = NewBoolFromInterface(value)
 		case "can_upload":
 			s.CanUpload = NewBoolFromInterface(value)
+		case "max_downloads":
+			s.MaxDownloads = NewInt64pFromInterface(value)
+		case "max_visits":
+			s.MaxVisits = NewInt64pFromInterface(value)
+		case "one_shot":
+			s.OneShot = NewBoolFromInterface(value)
+		case "notify":
+			s.Notify = NewShareNotifyFromInterface(value)
+		case "max_uploads":
+			s.MaxUploads = NewInt64pFromInterface(value)
+		case "max_upload_size":
+			s.MaxUploadSize = NewInt64pFromInterface(value)
+		case "upload_extensions":
+			s.UploadExtensions = NewStringpFromInterface(value)
+		case "collection":
+			s.Collection = NewBoolFromInterface(value)
+		case "paths":
+			s.Paths = NewStringsFromInterface(value)
+		case "view_only":
+			s.ViewOnly = NewBoolFromInterface(value)
+		case "watermark":
+			s.Watermark = NewStringpFromInterface(value)
+		case "proofs":
+			s.Proofs = NewShareProofsFromInterface(value)
 		}
 	}
 	return nil
 }
+
+type HealthCheck struct {
+	Name     string
+	Critical bool
+	Check    func() error
+}
+
+// ErrHealthSkipped is given by the health checks which don't apply, eg: a disabled feature
+var ErrHealthSkipped = NewError("Not applicable", 200)
+
+// HealthStatus is the outcome of a health check: "pass", "warn", "fail" or "skip"
+type HealthStatus struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Message  string  `json:"message,omitempty"`
+	Duration float64 `json:"duration_ms"`
+}
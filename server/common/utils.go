@@ -11,6 +11,10 @@ func NewBool(t bool) *bool {
 	return &t
 }
 
+func NewInt64(t int64) *int64 {
+	return &t
+}
+
 func NewString(t string) *string {
 	if t == "" {
 		return nil
@@ -50,6 +54,23 @@ func NewStringpFromInterface(val interface{}) *string {
 	}
 }
 
+func NewStringsFromInterface(val interface{}) []string {
+	switch val.(type) {
+	case []string:
+		return val.([]string)
+	case []interface{}:
+		v := make([]string, 0, len(val.([]interface{})))
+		for _, s := range val.([]interface{}) {
+			if str, ok := s.(string); ok {
+				v = append(v, str)
+			}
+		}
+		return v
+	default:
+		return nil
+	}
+}
+
 func NewStringFromInterface(val interface{}) string {
 	switch val.(type) {
 	case string:
@@ -3,10 +3,10 @@ package ctrl
 import (
 	"encoding/json"
 	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
 	"golang.org/x/crypto/bcrypt"
 	"io/ioutil"
 	"net/http"
-	"time"
 )
 
 func AdminSessionGet(_ App, res http.ResponseWriter, req *http.Request) {
@@ -41,8 +41,12 @@ func AdminSessionGet(_ App, res http.ResponseWriter, req *http.Request) {
 }
 
 func AdminSessionAuthenticate(ctx App, res http.ResponseWriter, req *http.Request) {
-	// Step 1: Deliberatly make the request slower to make hacking attempt harder for the attacker
-	time.Sleep(1500 * time.Millisecond)
+	// Step 1: Lock out the clients that keep on guessing
+	lockout := "admin::" + RemoteIP(req)
+	if wait := AuthLockout.Wait(lockout); wait > 0 {
+		SendTooManyRequests(res, wait)
+		return
+	}
 
 	// Step 2: Make sure current user has appropriate access
 	admin := ConfigAuthAdmin()
@@ -54,11 +58,26 @@ func AdminSessionAuthenticate(ctx App, res http.ResponseWriter, req *http.Reques
 	b, _ := ioutil.ReadAll(req.Body)
 	json.Unmarshal(b, &params)
 	if err := bcrypt.CompareHashAndPassword([]byte(admin), []byte(params["password"])); err != nil {
+		AuthLockout.Fail(lockout)
 		SendErrorResult(res, ErrInvalidPassword)
 		return
 	}
 
-	// Step 3: Send response to the client
+	// Step 3: Verify the second factor if the admin has enrolled one
+	if model.AdminTotpEnabled() {
+		if params["code"] == "" {
+			SendErrorResult(res, NewError("Missing verification code", 401))
+			return
+		}
+		if !model.AdminTotpVerify(params["code"]) {
+			AuthLockout.Fail(lockout)
+			SendErrorResult(res, NewError("Invalid verification code", 403))
+			return
+		}
+	}
+	AuthLockout.Reset(lockout)
+
+	// Step 4: Send response to the client
 	body, _ := json.Marshal(NewAdminToken())
 	obfuscate, err := EncryptString(SecretKeyDerivateForAdmin, string(body))
 	if err != nil {
@@ -84,3 +103,52 @@ func AdminBackend(ctx App, res http.ResponseWriter, req *http.Request) {
 	SendSuccessResultWithEtagAndGzip(res, req, backends)
 	return
 }
+
+func AdminTotpGet(ctx App, res http.ResponseWriter, req *http.Request) {
+	SendSuccessResult(res, struct {
+		Enabled bool `json:"enabled"`
+	}{model.AdminTotpEnabled()})
+}
+
+// AdminTotpSetup generates a new secret for the admin to scan. Nothing is stored until the admin
+// proves with AdminTotpEnable that the authenticator app was correctly setup
+func AdminTotpSetup(ctx App, res http.ResponseWriter, req *http.Request) {
+	secret := TotpGenerateSecret()
+	SendSuccessResult(res, struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{secret, TotpProvisioningURI(secret, "admin")})
+}
+
+func AdminTotpEnable(ctx App, res http.ResponseWriter, req *http.Request) {
+	var params map[string]string
+	b, _ := ioutil.ReadAll(req.Body)
+	json.Unmarshal(b, &params)
+	if _, ok := TotpVerify(params["secret"], params["code"]); !ok {
+		SendErrorResult(res, NewError("Invalid verification code", 403))
+		return
+	}
+	codes, err := model.AdminTotpEnable(params["secret"])
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes})
+}
+
+func AdminTotpDisable(ctx App, res http.ResponseWriter, req *http.Request) {
+	var params map[string]string
+	b, _ := ioutil.ReadAll(req.Body)
+	json.Unmarshal(b, &params)
+	if !model.AdminTotpVerify(params["code"]) {
+		SendErrorResult(res, NewError("Invalid verification code", 403))
+		return
+	}
+	if err := model.AdminTotpDisable(); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
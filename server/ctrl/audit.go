@@ -0,0 +1,80 @@
+package ctrl
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func AdminAuditList(ctx App, res http.ResponseWriter, req *http.Request) {
+	f := auditFilter(req)
+	if f.Limit <= 0 || f.Limit > 1000 {
+		f.Limit = 100
+	}
+	events, err := model.AuditQuery(f)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, events)
+}
+
+func AdminAuditExport(ctx App, res http.ResponseWriter, req *http.Request) {
+	events, err := model.AuditQuery(auditFilter(req))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	filename := fmt.Sprintf("audit_%s", time.Now().Format("20060102_150405"))
+	header := res.Header()
+	if req.URL.Query().Get("format") == "csv" {
+		header.Set("Content-Type", "text/csv")
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", filename))
+		w := csv.NewWriter(res)
+		w.Write([]string{"id", "time", "actor", "backend", "share", "operation", "path", "status", "outcome", "ip", "user_agent", "hash"})
+		for _, e := range events {
+			w.Write([]string{
+				strconv.FormatInt(e.Id, 10),
+				time.Unix(0, e.Time*int64(time.Millisecond)).UTC().Format(time.RFC3339),
+				e.Actor, e.Backend, e.Share, e.Operation, e.Path,
+				strconv.Itoa(e.Status), e.Outcome, e.Ip, e.UserAgent, e.Hash,
+			})
+		}
+		w.Flush()
+		return
+	}
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.json\"", filename))
+	json.NewEncoder(res).Encode(events)
+}
+
+func AdminAuditVerify(ctx App, res http.ResponseWriter, req *http.Request) {
+	v, err := model.AuditVerify()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, v)
+}
+
+func auditFilter(req *http.Request) model.AuditFilter {
+	q := req.URL.Query()
+	f := model.AuditFilter{
+		Actor:     q.Get("actor"),
+		Backend:   q.Get("backend"),
+		Share:     q.Get("share"),
+		Operation: q.Get("operation"),
+		Path:      q.Get("path"),
+		Outcome:   q.Get("outcome"),
+	}
+	f.From, _ = strconv.ParseInt(q.Get("from"), 10, 64)
+	f.To, _ = strconv.ParseInt(q.Get("to"), 10, 64)
+	f.Limit, _ = strconv.Atoi(q.Get("limit"))
+	f.Offset, _ = strconv.Atoi(q.Get("offset"))
+	return f
+}
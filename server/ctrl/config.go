@@ -1,7 +1,10 @@
 package ctrl
 
 import (
+	"fmt"
 	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+	"github.com/gorilla/mux"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -51,23 +54,84 @@ func PrivateConfigHandler(ctx App, res http.ResponseWriter, req *http.Request) {
 }
 
 func PrivateConfigUpdateHandler(ctx App, res http.ResponseWriter, req *http.Request) {
-	b, _ := ioutil.ReadAll(req.Body)
-	b = PrettyPrint(b)
-	file, err := os.Create(ConfigJSONPath)
+	b, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
-	defer file.Close()
-	if _, err := file.Write(b); err != nil {
+	if err := model.ConfigUpdate(b, "admin@"+RemoteIP(req)); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
+
+func PrivateConfigHistoryList(ctx App, res http.ResponseWriter, req *http.Request) {
+	versions, err := model.ConfigHistoryList()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, versions)
+}
+
+func PrivateConfigHistoryGet(ctx App, res http.ResponseWriter, req *http.Request) {
+	v, err := configVersion(mux.Vars(req)["id"])
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	v.Content = string(Config.Redact([]byte(v.Content)))
+	SendSuccessResult(res, v)
+}
+
+// PrivateConfigDiff gives what changed between 2 versions of the config. Without a "to" version,
+// the comparison is made against the config currently in use
+func PrivateConfigDiff(ctx App, res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	from, err := configVersion(query.Get("from"))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	var to []byte
+	if query.Get("to") == "" || query.Get("to") == "current" {
+		if to, err = os.ReadFile(ConfigJSONPath); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+	} else {
+		v, err := configVersion(query.Get("to"))
+		if err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+		to = []byte(v.Content)
+	}
+	SendSuccessResults(res, model.ConfigDiff([]byte(from.Content), to))
+}
+
+func PrivateConfigRollback(ctx App, res http.ResponseWriter, req *http.Request) {
+	v, err := configVersion(mux.Vars(req)["id"])
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	if err := model.ConfigUpdate([]byte(v.Content), fmt.Sprintf("admin@%s (rollback to #%d)", RemoteIP(req), v.Id)); err != nil {
 		SendErrorResult(res, err)
 		return
 	}
-	file.Close()
-	Config.Load()
 	SendSuccessResult(res, nil)
 }
 
+func configVersion(id string) (model.ConfigVersion, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return model.ConfigVersion{}, ErrNotValid
+	}
+	return model.ConfigHistoryGet(n)
+}
+
 func PublicConfigHandler(ctx App, res http.ResponseWriter, req *http.Request) {
 	cfg := Config.Export()
 	SendSuccessResultWithEtagAndGzip(res, req, cfg)
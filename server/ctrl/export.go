@@ -17,6 +17,14 @@ import (
 //go:generate sh -c "go run ../generator/emacs-el.go > export_generated.go && go fmt export_generated.go"
 var EmacsElConfig = ""
 
+func init() {
+	// emacs is only needed to export org documents, the rest works just fine without it
+	Hooks.Register.HealthCheck("emacs", false, func() error {
+		_, err := exec.LookPath("emacs")
+		return err
+	})
+}
+
 func FileExport(ctx App, res http.ResponseWriter, req *http.Request) {
 	http.SetCookie(res, &http.Cookie{
 		Name:   "download",
@@ -32,7 +40,7 @@ func FileExport(ctx App, res http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		SendErrorResult(res, err)
 		return
-	} else if !model.CanRead(&ctx) {
+	} else if !model.CanRead(&ctx, path) {
 		SendErrorResult(res, ErrPermissionDenied)
 		return
 	}
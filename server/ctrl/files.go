@@ -31,6 +31,7 @@ var (
 
 func init() {
 	FileCache = NewAppCache()
+	FileCache.Name = "file"
 	cachePath := filepath.Join(GetCurrentDir(), TmpPath)
 	FileCache.OnEvict(func(key string, value interface{}) {
 		os.RemoveAll(filepath.Join(cachePath, key))
@@ -49,39 +50,53 @@ func init() {
 }
 
 func FileLs(ctx App, res http.ResponseWriter, req *http.Request) {
-	if !model.CanRead(&ctx) {
-		if !model.CanUpload(&ctx) {
+	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	if !model.CanRead(&ctx, path) {
+		if !model.CanUpload(&ctx, path) {
 			SendErrorResult(res, ErrPermissionDenied)
 			return
 		}
 		SendSuccessResults(res, make([]FileInfo, 0))
 		return
 	}
-	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
-	if err != nil {
-		SendErrorResult(res, err)
-		return
-	}
 
-	entries, err := ctx.Backend.Ls(path)
-	if err != nil {
+	// the root of a collection is a virtual directory made of its items
+	virtual := ctx.Share.Collection && path == ctx.Share.Path
+	var entries []os.FileInfo
+	if virtual {
+		entries = model.ShareCollectionLs(&ctx)
+	} else if entries, err = ctx.Backend.Ls(path); err != nil {
 		SendErrorResult(res, err)
 		return
+	} else {
+		go model.SProc.HintLs(&ctx, path)
 	}
-	go model.SProc.HintLs(&ctx, path)
 
-	files := make([]FileInfo, len(entries))
+	files := make([]FileInfo, 0, len(entries))
 	etagger := fnv.New32()
 	etagger.Write([]byte(path + strconv.Itoa(len(entries))))
 	for i := 0; i < len(entries); i++ {
 		name := entries[i].Name()
 		modTime := entries[i].ModTime().UnixNano() / int64(time.Millisecond)
 
+		if !virtual {
+			if entries[i].IsDir() {
+				if !model.CanRead(&ctx, path+name+"/") {
+					continue
+				}
+			} else if !model.CanRead(&ctx, path+name) {
+				continue
+			}
+		}
 		if i < 200 { // etag is generated from a few values to avoid large memory usage
 			etagger.Write([]byte(name + strconv.Itoa(int(modTime))))
 		}
 
-		files[i] = FileInfo{
+		files = append(files, FileInfo{
 			Name: name,
 			Size: entries[i].Size(),
 			Time: modTime,
@@ -91,28 +106,28 @@ func FileLs(ctx App, res http.ResponseWriter, req *http.Request) {
 				}
 				return "directory"
 			}(entries[i].Mode()),
-		}
+		})
 	}
 
 	var perms = Metadata{}
-	if obj, ok := ctx.Backend.(interface{ Meta(path string) Metadata }); ok {
+	if obj, ok := UnwrapBackend(ctx.Backend).(interface{ Meta(path string) Metadata }); ok {
 		perms = obj.Meta(path)
 	}
 
-	if !model.CanEdit(&ctx) {
+	if !model.CanEdit(&ctx, path) {
 		perms.CanCreateFile = NewBool(false)
 		perms.CanCreateDirectory = NewBool(false)
 		perms.CanRename = NewBool(false)
 		perms.CanMove = NewBool(false)
 		perms.CanDelete = NewBool(false)
 	}
-	if !model.CanUpload(&ctx) {
+	if !model.CanUpload(&ctx, path) {
 		perms.CanCreateDirectory = NewBool(false)
 		perms.CanRename = NewBool(false)
 		perms.CanMove = NewBool(false)
 		perms.CanDelete = NewBool(false)
 	}
-	if !model.CanShare(&ctx) {
+	if !model.CanShare(&ctx, path) {
 		perms.CanShare = NewBool(false)
 	}
 
@@ -133,15 +148,15 @@ func FileCat(ctx App, res http.ResponseWriter, req *http.Request) {
 		MaxAge: -1,
 		Path:   "/",
 	})
-	if !model.CanRead(&ctx) {
-		SendErrorResult(res, ErrPermissionDenied)
-		return
-	}
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if !model.CanRead(&ctx, path) {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
 
 	var file io.ReadCloser
 	var contentLength int64 = -1
@@ -275,14 +290,19 @@ func FileCat(ctx App, res http.ResponseWriter, req *http.Request) {
 }
 
 func FileAccess(ctx App, res http.ResponseWriter, req *http.Request) {
+	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
 	allowed := []string{}
-	if model.CanRead(&ctx) {
+	if model.CanRead(&ctx, path) {
 		allowed = append(allowed, "GET")
 	}
-	if model.CanEdit(&ctx) {
+	if model.CanEdit(&ctx, path) {
 		allowed = append(allowed, "PUT")
 	}
-	if model.CanUpload(&ctx) {
+	if model.CanUpload(&ctx, path) {
 		allowed = append(allowed, "POST")
 	}
 	header := res.Header()
@@ -291,16 +311,18 @@ func FileAccess(ctx App, res http.ResponseWriter, req *http.Request) {
 }
 
 func FileSave(ctx App, res http.ResponseWriter, req *http.Request) {
-	if !model.CanEdit(&ctx) {
-		SendErrorResult(res, NewError("Permission denied", 403))
-		return
-	}
-
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if !model.CanEdit(&ctx, path) {
+		// people who can only upload mustn't be able to overwrite what's already there
+		if !model.CanUpload(&ctx, path) || fileExists(ctx, path) {
+			SendErrorResult(res, NewError("Permission denied", 403))
+			return
+		}
+	}
 
 	maxMemory := int64(32 << 20) // 32MB
 	err = req.ParseMultipartForm(maxMemory)
@@ -309,30 +331,42 @@ func FileSave(ctx App, res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	file, _, err := req.FormFile("file")
+	file, header, err := req.FormFile("file")
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
 	defer file.Close()
 
+	// uploads made through a shared link go against the limits of the link
+	var upload int64
+	if ctx.Share.Id != "" {
+		if upload, err = model.ShareUploadTake(ctx.Share, path, header.Size, model.ShareProofGetIdentity(req, ctx.Share)); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+	}
+
 	err = ctx.Backend.Save(path, file)
 	file.Close()
 	if err != nil {
+		if upload != 0 {
+			model.ShareUploadRelease(upload)
+		}
 		SendErrorResult(res, NewError(err.Error(), 403))
 		return
 	}
+	if upload != 0 {
+		if err := model.ShareUploadDone(ctx.Share, upload, header.Size); err != nil {
+			Log.Subsystem("share").Request(ctx.RequestId).Error("share %s: can't record upload %s", ctx.Share.Id, err.Error())
+		}
+	}
 	go model.SProc.HintLs(&ctx, filepath.Dir(path)+"/")
 	go model.SProc.HintFile(&ctx, path)
 	SendSuccessResult(res, nil)
 }
 
 func FileMv(ctx App, res http.ResponseWriter, req *http.Request) {
-	if !model.CanEdit(&ctx) {
-		SendErrorResult(res, NewError("Permission denied", 403))
-		return
-	}
-
 	from, err := PathBuilder(ctx, req.URL.Query().Get("from"))
 	if err != nil {
 		SendErrorResult(res, err)
@@ -347,6 +381,10 @@ func FileMv(ctx App, res http.ResponseWriter, req *http.Request) {
 		SendErrorResult(res, NewError("missing path parameter", 400))
 		return
 	}
+	if !model.CanEdit(&ctx, from) || !model.CanEdit(&ctx, to) {
+		SendErrorResult(res, NewError("Permission denied", 403))
+		return
+	}
 
 	err = ctx.Backend.Mv(from, to)
 	if err != nil {
@@ -360,16 +398,15 @@ func FileMv(ctx App, res http.ResponseWriter, req *http.Request) {
 }
 
 func FileRm(ctx App, res http.ResponseWriter, req *http.Request) {
-	if !model.CanEdit(&ctx) {
-		SendErrorResult(res, NewError("Permission denied", 403))
-		return
-	}
-
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if !model.CanEdit(&ctx, path) {
+		SendErrorResult(res, NewError("Permission denied", 403))
+		return
+	}
 	err = ctx.Backend.Rm(path)
 	if err != nil {
 		SendErrorResult(res, err)
@@ -380,16 +417,15 @@ func FileRm(ctx App, res http.ResponseWriter, req *http.Request) {
 }
 
 func FileMkdir(ctx App, res http.ResponseWriter, req *http.Request) {
-	if !model.CanUpload(&ctx) {
-		SendErrorResult(res, NewError("Permission denied", 403))
-		return
-	}
-
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if !model.CanUpload(&ctx, path) {
+		SendErrorResult(res, NewError("Permission denied", 403))
+		return
+	}
 
 	err = ctx.Backend.Mkdir(path)
 	if err != nil {
@@ -401,16 +437,15 @@ func FileMkdir(ctx App, res http.ResponseWriter, req *http.Request) {
 }
 
 func FileTouch(ctx App, res http.ResponseWriter, req *http.Request) {
-	if !model.CanUpload(&ctx) {
-		SendErrorResult(res, NewError("Permission denied", 403))
-		return
-	}
-
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if !model.CanUpload(&ctx, path) {
+		SendErrorResult(res, NewError("Permission denied", 403))
+		return
+	}
 
 	err = ctx.Backend.Touch(path)
 	if err != nil {
@@ -423,16 +458,16 @@ func FileTouch(ctx App, res http.ResponseWriter, req *http.Request) {
 
 func FileDownloader(ctx App, res http.ResponseWriter, req *http.Request) {
 	var err error
-	if !model.CanRead(&ctx) {
-		SendErrorResult(res, ErrPermissionDenied)
-		return
-	}
 	paths := req.URL.Query()["path"]
 	for i := 0; i < len(paths); i++ {
 		if paths[i], err = PathBuilder(ctx, paths[i]); err != nil {
 			SendErrorResult(res, err)
 			return
 		}
+		if !model.CanRead(&ctx, paths[i]) {
+			SendErrorResult(res, ErrPermissionDenied)
+			return
+		}
 	}
 
 	resHeader := res.Header()
@@ -444,14 +479,14 @@ func FileDownloader(ctx App, res http.ResponseWriter, req *http.Request) {
 	resHeader.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", filename))
 
 	start := time.Now()
-	var addToZipRecursive func(App, *zip.Writer, string, string) error
-	addToZipRecursive = func(c App, zw *zip.Writer, backendPath string, zipRoot string) (err error) {
+	var addToZipRecursive func(App, *zip.Writer, string, string, string) error
+	addToZipRecursive = func(c App, zw *zip.Writer, backendPath string, zipRoot string, zipPrefix string) (err error) {
 		if time.Now().Sub(start) > time.Duration(ZipTimeout)*time.Second {
 			return ErrTimeout
 		}
 		if !strings.HasSuffix(backendPath, "/") {
 			// Process File
-			zipPath := strings.TrimPrefix(backendPath, zipRoot)
+			zipPath := zipPrefix + strings.TrimPrefix(backendPath, zipRoot)
 			zipFile, err := zw.Create(zipPath)
 			if err != nil {
 				return err
@@ -478,7 +513,10 @@ func FileDownloader(ctx App, res http.ResponseWriter, req *http.Request) {
 			if entries[i].IsDir() {
 				newBackendPath += "/"
 			}
-			if err = addToZipRecursive(ctx, zw, newBackendPath, zipRoot); err != nil {
+			if !model.CanRead(&ctx, newBackendPath) {
+				continue
+			}
+			if err = addToZipRecursive(ctx, zw, newBackendPath, zipRoot, zipPrefix); err != nil {
 				return err
 			}
 		}
@@ -488,20 +526,49 @@ func FileDownloader(ctx App, res http.ResponseWriter, req *http.Request) {
 	zipWriter := zip.NewWriter(res)
 	defer zipWriter.Close()
 	for i := 0; i < len(paths); i++ {
+		if ctx.Share.Collection && paths[i] == ctx.Share.Path {
+			// the items of a collection go in the zip under their name in the collection
+			for _, item := range model.ShareCollectionItems(ctx.Share) {
+				zipPrefix := item.Name
+				if IsDirectory(item.Path) {
+					zipPrefix += "/"
+				}
+				addToZipRecursive(ctx, zipWriter, item.Path, item.Path, zipPrefix)
+			}
+			continue
+		}
 		zipRoot := ""
 		if strings.HasSuffix(paths[i], "/") {
 			zipRoot = strings.TrimSuffix(paths[i], filepath.Base(paths[i])+"/")
 		} else {
 			zipRoot = strings.TrimSuffix(paths[i], filepath.Base(paths[i]))
 		}
-		addToZipRecursive(ctx, zipWriter, paths[i], zipRoot)
+		addToZipRecursive(ctx, zipWriter, paths[i], zipRoot, "")
 	}
 }
 
+// fileExists tells if there's already something at the given path. When that can't be told, it's
+// assumed there is so that what's already there can't be overwritten by mistake
+func fileExists(ctx App, path string) bool {
+	files, err := ctx.Backend.Ls(filepath.Dir(path) + "/")
+	if err != nil {
+		return true
+	}
+	for _, f := range files {
+		if f.Name() == filepath.Base(path) {
+			return true
+		}
+	}
+	return false
+}
+
 func PathBuilder(ctx App, path string) (string, error) {
 	if path == "" {
 		return "", NewError("No path available", 400)
 	}
+	if ctx.Share.Collection {
+		return model.ShareCollectionPath(ctx.Share, path)
+	}
 	sessionPath := ctx.Session["path"]
 	basePath := filepath.ToSlash(filepath.Join(sessionPath, path))
 	if path[len(path)-1:] == "/" && basePath != "/" {
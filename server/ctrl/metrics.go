@@ -0,0 +1,61 @@
+package ctrl
+
+import (
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+)
+
+var metricsHandler = promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{})
+
+func init() {
+	Config.Get("features.metrics.enable").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Name = "enable"
+		f.Type = "enable"
+		f.Target = []string{"metrics_protected"}
+		f.Description = "Expose metrics in the Prometheus format under /metrics"
+		f.Default = false
+		return f
+	})
+	Config.Get("features.metrics.protected").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Id = "metrics_protected"
+		f.Name = "protected"
+		f.Type = "boolean"
+		f.Description = "Require the admin password to access the metrics, using HTTP basic auth with any username"
+		f.Default = true
+		return f
+	})
+}
+
+func MetricsHandler(ctx App, res http.ResponseWriter, req *http.Request) {
+	if !Config.Get("features.metrics.enable").Bool() {
+		SendErrorResult(res, ErrNotFound)
+		return
+	}
+	if admin := ConfigAuthAdmin(); admin != "" && Config.Get("features.metrics.protected").Bool() {
+		lockout := "metrics::" + RemoteIP(req)
+		if wait := AuthLockout.Wait(lockout); wait > 0 {
+			SendTooManyRequests(res, wait)
+			return
+		}
+		_, password, ok := req.BasicAuth()
+		if !ok {
+			res.Header().Set("WWW-Authenticate", `Basic realm="Filestash metrics"`)
+			SendErrorResult(res, ErrNotAuthorized)
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(admin), []byte(password)); err != nil {
+			AuthLockout.Fail(lockout)
+			SendErrorResult(res, ErrNotAuthorized)
+			return
+		}
+	}
+	metricsHandler.ServeHTTP(res, req)
+}
@@ -3,6 +3,7 @@ package ctrl
 import (
 	"fmt"
 	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
 	"net/http"
 	"os"
 )
@@ -65,3 +66,39 @@ func HealthHandler(ctx App, res http.ResponseWriter, req *http.Request) {
 	res.WriteHeader(http.StatusOK)
 	res.Write([]byte(`{"status": "pass"}`))
 }
+
+// HealthReadyHandler is meant for readiness probes: it answers with a 503 when one of the critical
+// checks fails. Anybody can reach it so it doesn't say more, the details are for the admin to see from
+// AdminHealthHandler
+func HealthReadyHandler(ctx App, res http.ResponseWriter, req *http.Request) {
+	ready, checks := model.HealthReady()
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-cache")
+	if !ready {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		res.WriteHeader(http.StatusOK)
+	}
+	res.Write([]byte(fmt.Sprintf(`{"status": "%s"}`, healthStatus(checks))))
+}
+
+// AdminHealthHandler gives the outcome of every health check
+func AdminHealthHandler(ctx App, res http.ResponseWriter, req *http.Request) {
+	_, checks := model.HealthReady()
+	SendSuccessResult(res, struct {
+		Status string         `json:"status"`
+		Checks []HealthStatus `json:"checks"`
+	}{healthStatus(checks), checks})
+}
+
+func healthStatus(checks []HealthStatus) string {
+	status := "pass"
+	for i := range checks {
+		if checks[i].Status == "fail" {
+			return "fail"
+		} else if checks[i].Status == "warn" {
+			status = "warn"
+		}
+	}
+	return status
+}
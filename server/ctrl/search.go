@@ -8,12 +8,16 @@ import (
 )
 
 func FileSearch(ctx App, res http.ResponseWriter, req *http.Request) {
+	if ctx.Share.Collection {
+		SendSuccessResults(res, make([]File, 0))
+		return
+	}
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
 		path = "/"
 	}
 	q := req.URL.Query().Get("q")
-	if !model.CanRead(&ctx) {
+	if !model.CanRead(&ctx, path) {
 		SendErrorResult(res, ErrPermissionDenied)
 		return
 	}
@@ -24,6 +28,13 @@ func FileSearch(ctx App, res http.ResponseWriter, req *http.Request) {
 	} else {
 		searchResults = model.SearchStateLess(&ctx, path, q)
 	}
+	allowedResults := make([]File, 0, len(searchResults))
+	for i := 0; i < len(searchResults); i++ {
+		if model.CanRead(&ctx, searchResults[i].FPath) {
+			allowedResults = append(allowedResults, searchResults[i])
+		}
+	}
+	searchResults = allowedResults
 
 	if ctx.Session["path"] != "" {
 		for i := 0; i < len(searchResults); i++ {
@@ -7,6 +7,7 @@ import (
 	"github.com/bingoohuang/filestash/server/model"
 	"github.com/gorilla/mux"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -35,52 +36,94 @@ func SessionGet(ctx App, res http.ResponseWriter, req *http.Request) {
 }
 
 func SessionAuthenticate(ctx App, res http.ResponseWriter, req *http.Request) {
+	// failures are tracked per IP, so that guessing from one place is slowed down whatever the account,
+	// and per account, so that spreading the guesses over many IPs doesn't help either
+	lockout := []string{"login::ip::" + RemoteIP(req)}
+	if username := strings.ToLower(strings.TrimSpace(NewStringFromInterface(ctx.Body["username"]))); username != "" {
+		lockout = append(lockout, "login::"+NewStringFromInterface(ctx.Body["type"])+"::"+username)
+	}
+	if wait := AuthLockout.Wait(lockout...); wait > 0 {
+		SendTooManyRequests(res, wait)
+		return
+	}
+	fail := func(err error) {
+		AuthLockout.Fail(lockout...)
+		SendErrorResult(res, err)
+	}
+
 	ctx.Body["timestamp"] = time.Now().String()
-	session := model.MapStringInterfaceToMapStringString(ctx.Body)
+	session := sessionFromBody(ctx.Body)
 	session["path"] = EnforceDirectory(session["path"])
 
 	backend, err := model.NewBackend(&ctx, session)
 	if err != nil {
-		SendErrorResult(res, err)
+		fail(err)
 		return
 	}
 
-	if obj, ok := backend.(interface {
+	if obj, ok := UnwrapBackend(backend).(interface {
 		OAuthToken(*map[string]interface{}) error
 	}); ok {
 		err := obj.OAuthToken(&ctx.Body)
 		if err != nil {
-			SendErrorResult(res, NewError("Can't authenticate (OAuth error)", 401))
+			fail(NewError("Can't authenticate (OAuth error)", 401))
 			return
 		}
-		session = model.MapStringInterfaceToMapStringString(ctx.Body)
+		session = sessionFromBody(ctx.Body)
 		backend, err = model.NewBackend(&ctx, session)
 		if err != nil {
-			SendErrorResult(res, NewError("Can't authenticate", 401))
+			fail(NewError("Can't authenticate", 401))
 			return
 		}
 	}
 
-	home, err := model.GetHome(backend, session["path"])
-	if err != nil {
-		SendErrorResult(res, ErrAuthenticationFailed)
-		return
+	if obj, ok := UnwrapBackend(backend).(interface {
+		Authenticate(map[string]string) (map[string]string, error)
+	}); ok {
+		// authentication plugins give us the session of the connection the user is mapped onto
+		if session, err = obj.Authenticate(session); err != nil {
+			fail(err)
+			return
+		}
+		session["path"] = EnforceDirectory(session["path"])
+		if backend, err = model.NewBackend(&ctx, session); err != nil {
+			fail(NewError("Can't authenticate", 401))
+			return
+		}
 	}
 
-	s, err := json.Marshal(session)
+	home, err := model.GetHome(backend, session["path"])
 	if err != nil {
-		SendErrorResult(res, NewError(err.Error(), 500))
+		fail(ErrAuthenticationFailed)
 		return
 	}
-	obfuscate, err := EncryptString(SecretKeyDerivateForUser, string(s))
-	if err != nil {
-		SendErrorResult(res, NewError(err.Error(), 500))
-		return
+	// a successful login only clears the account: the IP counter would otherwise be reset by logging
+	// into an account of one's own in between guesses
+	AuthLockout.Reset(lockout[1:]...)
+
+	var obfuscate string
+	var maxAge = 60 * 60 * 24 * 30
+	if model.SessionServerSide() {
+		if obfuscate, err = model.SessionCreate(session, req); err != nil {
+			SendErrorResult(res, NewError(err.Error(), 500))
+			return
+		}
+		maxAge = int(model.SessionMaxAge().Seconds())
+	} else {
+		s, err := json.Marshal(session)
+		if err != nil {
+			SendErrorResult(res, NewError(err.Error(), 500))
+			return
+		}
+		if obfuscate, err = EncryptString(SecretKeyDerivateForUser, string(s)); err != nil {
+			SendErrorResult(res, NewError(err.Error(), 500))
+			return
+		}
 	}
 	http.SetCookie(res, &http.Cookie{
 		Name:     CookieNameAuth,
 		Value:    obfuscate,
-		MaxAge:   60 * 60 * 24 * 30,
+		MaxAge:   maxAge,
 		Path:     CookiePath,
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
@@ -93,12 +136,23 @@ func SessionAuthenticate(ctx App, res http.ResponseWriter, req *http.Request) {
 	SendSuccessResult(res, nil)
 }
 
+// sessionFromBody gives the session a user asks for. The identity is vouched for by the server: only
+// authentication plugins can set it, whoever logs in can't pick theirs
+func sessionFromBody(body map[string]interface{}) map[string]string {
+	session := model.MapStringInterfaceToMapStringString(body)
+	delete(session, "identity")
+	return session
+}
+
 func SessionLogout(ctx App, res http.ResponseWriter, req *http.Request) {
 	if ctx.Backend != nil {
-		if obj, ok := ctx.Backend.(interface{ Close() error }); ok {
+		if obj, ok := UnwrapBackend(ctx.Backend).(interface{ Close() error }); ok {
 			go obj.Close()
 		}
 	}
+	if c, err := req.Cookie(CookieNameAuth); err == nil && model.SessionServerSide() {
+		model.SessionRevoke(c.Value)
+	}
 	http.SetCookie(res, &http.Cookie{
 		Name:   CookieNameAuth,
 		Value:  "",
@@ -130,7 +184,7 @@ func SessionOAuthBackend(ctx App, res http.ResponseWriter, req *http.Request) {
 		SendErrorResult(res, err)
 		return
 	}
-	obj, ok := b.(interface{ OAuthURL() string })
+	obj, ok := UnwrapBackend(b).(interface{ OAuthURL() string })
 	if !ok {
 		SendErrorResult(res, NewError(fmt.Sprintf("This backend doesn't support oauth: '%s'", a["type"]), 500))
 		return
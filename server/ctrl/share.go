@@ -6,7 +6,9 @@ import (
 	. "github.com/bingoohuang/filestash/server/common"
 	"github.com/bingoohuang/filestash/server/model"
 	"github.com/gorilla/mux"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -40,12 +42,21 @@ func ShareUpsert(ctx App, res http.ResponseWriter, req *http.Request) {
 	s := Share{
 		Id: share_id,
 		Auth: func() string {
+			if ctx.Token.Id != "" {
+				return ctx.Token.Auth
+			}
 			if ctx.Share.Id == "" {
-				a, err := req.Cookie(CookieNameAuth)
+				// the cookie might only be a reference to a server side session that won't outlive
+				// the link, hence we keep a copy of the session itself
+				j, err := json.Marshal(ctx.Session)
+				if err != nil {
+					return ""
+				}
+				a, err := EncryptString(SecretKeyDerivateForUser, string(j))
 				if err != nil {
 					return ""
 				}
-				return a.Value
+				return a
 			}
 			return ctx.Share.Auth
 		}(),
@@ -69,6 +80,7 @@ func ShareUpsert(ctx App, res http.ResponseWriter, req *http.Request) {
 		}(),
 		Password:     NewStringpFromInterface(ctx.Body["password"]),
 		Users:        NewStringpFromInterface(ctx.Body["users"]),
+		Totp:         NewStringpFromInterface(ctx.Body["totp"]),
 		Expire:       NewInt64pFromInterface(ctx.Body["expire"]),
 		Url:          NewStringpFromInterface(ctx.Body["url"]),
 		CanManageOwn: NewBoolFromInterface(ctx.Body["can_manage_own"]),
@@ -76,11 +88,60 @@ func ShareUpsert(ctx App, res http.ResponseWriter, req *http.Request) {
 		CanRead:      NewBoolFromInterface(ctx.Body["can_read"]),
 		CanWrite:     NewBoolFromInterface(ctx.Body["can_write"]),
 		CanUpload:    NewBoolFromInterface(ctx.Body["can_upload"]),
+		MaxDownloads: NewInt64pFromInterface(ctx.Body["max_downloads"]),
+		MaxVisits:    NewInt64pFromInterface(ctx.Body["max_visits"]),
+		OneShot:      NewBoolFromInterface(ctx.Body["one_shot"]),
+
+		Notify:           NewShareNotifyFromInterface(ctx.Body["notify"]),
+		MaxUploads:       NewInt64pFromInterface(ctx.Body["max_uploads"]),
+		MaxUploadSize:    NewInt64pFromInterface(ctx.Body["max_upload_size"]),
+		UploadExtensions: NewStringpFromInterface(ctx.Body["upload_extensions"]),
+
+		ViewOnly:  NewBoolFromInterface(ctx.Body["view_only"]),
+		Watermark: NewStringpFromInterface(ctx.Body["watermark"]),
+
+		Proofs: NewShareProofsFromInterface(ctx.Body["proofs"]),
+	}
+	// a collection is made of many paths, each of which has to be shareable. Editing a collection
+	// without giving its paths keeps the ones it's made of, it only stops being one given an empty list
+	for _, p := range NewStringsFromInterface(ctx.Body["paths"]) {
+		path, err := PathBuilder(ctx, p)
+		if err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+		s.Paths = append(s.Paths, path)
+	}
+	if _, ok := ctx.Body["paths"]; !ok {
+		if existing, err := model.ShareGet(s.Id); err == nil && existing.Collection && existing.Backend == s.Backend {
+			s.Paths = existing.Paths
+		}
+	}
+	for _, path := range s.Paths {
+		if !model.CanShare(&ctx, path) {
+			SendErrorResult(res, ErrPermissionDenied)
+			return
+		}
+	}
+	if len(s.Paths) == 0 && !model.CanShare(&ctx, s.Path) {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	// the owner needs a way to distribute the secret to the people they share the link with
+	var totpURI *string
+	if s.Totp != nil && *s.Totp != PasswordDummy {
+		totpURI = NewString(TotpProvisioningURI(*s.Totp, s.Id))
 	}
 	if err := model.ShareUpsert(&s); err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if totpURI != nil {
+		SendSuccessResult(res, struct {
+			TotpURI string `json:"totp_uri"`
+		}{*totpURI})
+		return
+	}
 	SendSuccessResult(res, nil)
 }
 
@@ -93,6 +154,38 @@ func ShareDelete(ctx App, res http.ResponseWriter, req *http.Request) {
 	SendSuccessResult(res, nil)
 }
 
+// ShareActivity lets the owner of a link know how it's been used: an overview along with the timeline
+// of every access made through it
+func ShareActivity(ctx App, res http.ResponseWriter, req *http.Request) {
+	s, err := model.ShareGet(mux.Vars(req)["share"])
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	q := req.URL.Query()
+	from, _ := strconv.ParseInt(q.Get("from"), 10, 64)
+	to, _ := strconv.ParseInt(q.Get("to"), 10, 64)
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	stats, err := model.ShareActivityStats(s.Id)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	timeline, err := model.ShareActivityTimeline(s.Id, from, to, limit, offset)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, struct {
+		Stats    model.ShareStats    `json:"stats"`
+		Timeline []model.ShareAccess `json:"timeline"`
+	}{stats, timeline})
+}
+
 func ShareVerifyProof(ctx App, res http.ResponseWriter, req *http.Request) {
 	var submittedProof model.Proof
 	var verifiedProof []model.Proof
@@ -103,12 +196,18 @@ func ShareVerifyProof(ctx App, res http.ResponseWriter, req *http.Request) {
 
 	// 1) initialise the current context
 	share_id := mux.Vars(req)["share"]
+	lockout := "proof::" + share_id + "::" + RemoteIP(req)
+	if wait := AuthLockout.Wait(lockout); wait > 0 {
+		SendTooManyRequests(res, wait)
+		return
+	}
 	s, err = model.ShareGet(share_id)
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
 	submittedProof = model.Proof{
+		Id:    NewStringFromInterface(ctx.Body["id"]),
 		Key:   fmt.Sprint(ctx.Body["type"]),
 		Value: fmt.Sprint(ctx.Body["value"]),
 	}
@@ -126,41 +225,72 @@ func ShareVerifyProof(ctx App, res http.ResponseWriter, req *http.Request) {
 		SendErrorResult(res, ErrNotValid)
 		return
 	}
-	if err := s.IsValid(); err != nil {
+	if err := model.ShareIsValid(s, verifiedProof); err != nil {
 		SendErrorResult(res, err)
 		return
 	}
 
 	// 3) process the proof sent by the user
-	submittedProof, err = model.ShareProofVerifier(s, submittedProof)
+	access := model.ShareAccess{
+		Share:     s.Id,
+		Operation: "share.proof",
+		Ip:        RemoteIP(req),
+		Status:    http.StatusOK,
+	}
+	if model.ShareProofs.Get(submittedProof.Key) != nil {
+		access.Operation += "." + submittedProof.Key
+	}
+	submittedProof, err = model.ShareProofVerifier(s, submittedProof, req)
 	if err != nil {
+		access.Status = http.StatusInternalServerError
+		if obj, ok := err.(interface{ Status() int }); ok {
+			access.Status = obj.Status()
+		}
+		model.ShareActivityRecord(access)
+		Log.Subsystem("share").Request(ctx.RequestId).Info("share %s: %s proof rejected from %s", share_id, submittedProof.Key, RemoteIP(req))
+		AuthLockout.Fail(lockout)
 		submittedProof.Error = NewString(err.Error())
 		SendSuccessResult(res, submittedProof)
 		return
 	}
-	if submittedProof.Key == "code" {
+	if submittedProof.Key == "email" {
+		access.Identity = submittedProof.Value
+	}
+	model.ShareActivityRecord(access)
+	if submittedProof.Message != nil {
+		// the proof has another step to go through before being remembered
 		submittedProof.Value = ""
-		submittedProof.Message = NewString("We've sent you a message with a verification code")
 		SendSuccessResult(res, submittedProof)
 		return
 	}
 
-	if submittedProof.Key != "" {
+	if model.ShareProofs.Get(submittedProof.Key) != nil {
 		submittedProof.Id = Hash(submittedProof.Key+"::"+submittedProof.Value, 20)
 		verifiedProof = append(verifiedProof, submittedProof)
 	}
 
 	// 4) Find remaining proofs: requiredProof - verifiedProof
-	remainingProof = model.ShareProofCalculateRemainings(requiredProof, verifiedProof)
+	remainingProof = model.ShareProofGetRemaining(s, req, verifiedProof)
+	for _, p := range remainingProof {
+		if _, ok := model.ShareProofs.Get(p.Key).(model.ShareProofPassive); ok {
+			// nothing the user could submit would get them through
+			SendErrorResult(res, ErrNotAuthorized)
+			return
+		}
+	}
+	if len(remainingProof) == 1 && remainingProof[0].Key == "visit" {
+		if err := model.ShareVisit(s); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+		verifiedProof = append(verifiedProof, model.Proof{Key: "visit", Id: Hash("visit::"+s.Id, 20)})
+		remainingProof = nil
+	}
 
 	// 5) persist proofs in client cookie
 	cookie := http.Cookie{
-		Name: CookieNameProof,
-		Value: func(p []model.Proof) string {
-			j, _ := json.Marshal(p)
-			str, _ := EncryptString(SecretKeyDerivateForProof, string(j))
-			return str
-		}(verifiedProof),
+		Name:     CookieNameProof,
+		Value:    model.ShareProofCookie(verifiedProof),
 		Path:     CookiePath,
 		MaxAge:   60 * 60 * 24 * 30,
 		HttpOnly: true,
@@ -181,3 +311,46 @@ func ShareVerifyProof(ctx App, res http.ResponseWriter, req *http.Request) {
 		Path: s.Path,
 	})
 }
+
+func AdminShareList(ctx App, res http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	f := model.ShareFilter{
+		Query:       q.Get("q"),
+		Backend:     q.Get("backend"),
+		BackendType: q.Get("type"),
+		Creator:     q.Get("creator"),
+		Protection:  q.Get("protection"),
+		Status:      q.Get("status"),
+	}
+	f.Limit, _ = strconv.Atoi(q.Get("limit"))
+	f.Offset, _ = strconv.Atoi(q.Get("offset"))
+	if f.Limit <= 0 || f.Limit > 1000 {
+		f.Limit = 100
+	}
+	shares, err := model.ShareAdminList(f)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, shares)
+}
+
+func AdminShareRevoke(ctx App, res http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Ids []string `json:"ids"`
+	}
+	b, _ := ioutil.ReadAll(req.Body)
+	if err := json.Unmarshal(b, &body); err != nil || len(body.Ids) == 0 {
+		SendErrorResult(res, ErrNotValid)
+		return
+	}
+	n, err := model.ShareRevoke(body.Ids)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	Log.Subsystem("share").Request(ctx.RequestId).Info("admin revoked %d shared link(s)", n)
+	SendSuccessResult(res, struct {
+		Revoked int `json:"revoked"`
+	}{n})
+}
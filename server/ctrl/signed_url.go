@@ -0,0 +1,77 @@
+package ctrl
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+)
+
+func SignedUrlCreate(ctx App, res http.ResponseWriter, req *http.Request) {
+	// as with tokens, signing requires a real session
+	if ctx.Token.Id != "" || ctx.Share.Id != "" {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	path, err := PathBuilder(ctx, NewStringFromInterface(ctx.Body["path"]))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	} else if IsDirectory(path) {
+		SendErrorResult(res, NewError("Only files can be signed", 400))
+		return
+	}
+	if !model.CanRead(&ctx, path) {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	session, _ := json.Marshal(ctx.Session)
+	auth, err := EncryptString(SecretKeyDerivateForUser, string(session))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	u := model.SignedUrl{
+		Owner:       model.SignedUrlOwner(&ctx),
+		Backend:     GenerateID(&ctx),
+		Path:        path,
+		Ip:          strings.TrimSpace(NewStringFromInterface(ctx.Body["ip"])),
+		Disposition: NewStringFromInterface(ctx.Body["disposition"]),
+		Filename:    NewStringFromInterface(ctx.Body["filename"]),
+	}
+	if expire := NewInt64pFromInterface(ctx.Body["expire"]); expire != nil {
+		u.Expire = *expire
+	}
+	q, err := model.SignedUrlCreate(&u, auth)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	link := "/api/files/signed?" + q.Encode()
+	if host := Config.Get("general.host").String(); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "https://" + host
+		}
+		link = strings.TrimSuffix(host, "/") + link
+	}
+	SendSuccessResult(res, struct {
+		model.SignedUrl
+		Url string `json:"url"`
+	}{u, link})
+}
+
+// SignedUrlRevoke makes all the URLs signed by the current user on the backend they're connected to stop
+// working
+func SignedUrlRevoke(ctx App, res http.ResponseWriter, req *http.Request) {
+	if ctx.Token.Id != "" || ctx.Share.Id != "" {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	if err := model.SignedUrlRevoke(model.SignedUrlOwner(&ctx), GenerateID(&ctx)); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
@@ -0,0 +1,81 @@
+package ctrl
+
+import (
+	"encoding/json"
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func TokenList(ctx App, res http.ResponseWriter, req *http.Request) {
+	if ctx.Token.Id != "" || ctx.Share.Id != "" {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	tokens, err := model.TokenList(GenerateID(&ctx))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, tokens)
+}
+
+func TokenCreate(ctx App, res http.ResponseWriter, req *http.Request) {
+	// a token can't be used to mint other tokens, this requires a real session
+	if ctx.Token.Id != "" || ctx.Share.Id != "" {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	path := "/"
+	if p := NewStringFromInterface(ctx.Body["path"]); p != "" {
+		path = p
+	}
+	path, err := PathBuilder(ctx, EnforceDirectory(path))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	session, _ := json.Marshal(ctx.Session)
+	auth, err := EncryptString(SecretKeyDerivateForUser, string(session))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	t := Token{
+		Name:      NewStringFromInterface(ctx.Body["name"]),
+		Backend:   GenerateID(&ctx),
+		Auth:      auth,
+		Path:      path,
+		Expire:    NewInt64pFromInterface(ctx.Body["expire"]),
+		CanRead:   NewBoolFromInterface(ctx.Body["can_read"]),
+		CanWrite:  NewBoolFromInterface(ctx.Body["can_write"]),
+		CanUpload: NewBoolFromInterface(ctx.Body["can_upload"]),
+		CanShare:  NewBoolFromInterface(ctx.Body["can_share"]),
+	}
+	// nobody can give to a token more than what they have themselves
+	if (t.CanRead && !model.CanRead(&ctx, path)) ||
+		(t.CanWrite && !model.CanEdit(&ctx, path)) ||
+		(t.CanUpload && !model.CanUpload(&ctx, path)) ||
+		(t.CanShare && !model.CanShare(&ctx, path)) {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	if err = model.TokenCreate(&t); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, t)
+}
+
+func TokenDelete(ctx App, res http.ResponseWriter, req *http.Request) {
+	if ctx.Token.Id != "" || ctx.Share.Id != "" {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	if err := model.TokenDelete(GenerateID(&ctx), mux.Vars(req)["token"]); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
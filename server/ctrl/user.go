@@ -0,0 +1,129 @@
+package ctrl
+
+import (
+	"encoding/json"
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+func AdminUserList(ctx App, res http.ResponseWriter, req *http.Request) {
+	users, err := model.UserList()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, users)
+}
+
+func AdminUserUpsert(ctx App, res http.ResponseWriter, req *http.Request) {
+	var u model.User
+	b, _ := ioutil.ReadAll(req.Body)
+	if err := json.Unmarshal(b, &u); err != nil {
+		SendErrorResult(res, ErrNotValid)
+		return
+	}
+	u.Username = mux.Vars(req)["username"]
+	u.Source = ""
+	if err := model.UserUpsert(&u); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
+
+func AdminUserDelete(ctx App, res http.ResponseWriter, req *http.Request) {
+	if err := model.UserDelete(mux.Vars(req)["username"]); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
+
+func AdminGroupList(ctx App, res http.ResponseWriter, req *http.Request) {
+	groups, err := model.GroupList()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, groups)
+}
+
+func AdminGroupUpsert(ctx App, res http.ResponseWriter, req *http.Request) {
+	var g model.Group
+	b, _ := ioutil.ReadAll(req.Body)
+	if err := json.Unmarshal(b, &g); err != nil {
+		SendErrorResult(res, ErrNotValid)
+		return
+	}
+	g.Name = mux.Vars(req)["group"]
+	if err := model.GroupUpsert(&g); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
+
+func AdminGroupDelete(ctx App, res http.ResponseWriter, req *http.Request) {
+	if err := model.GroupDelete(mux.Vars(req)["group"]); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
+
+func AdminAccessRuleList(ctx App, res http.ResponseWriter, req *http.Request) {
+	rules, err := model.AccessRuleList()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, rules)
+}
+
+func AdminAccessRuleCreate(ctx App, res http.ResponseWriter, req *http.Request) {
+	var r model.AccessRule
+	b, _ := ioutil.ReadAll(req.Body)
+	if err := json.Unmarshal(b, &r); err != nil {
+		SendErrorResult(res, ErrNotValid)
+		return
+	}
+	if err := model.AccessRuleCreate(&r); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, r)
+}
+
+func AdminAccessRuleDelete(ctx App, res http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		SendErrorResult(res, ErrNotValid)
+		return
+	}
+	if err := model.AccessRuleDelete(id); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
+
+func AdminUserSessionList(ctx App, res http.ResponseWriter, req *http.Request) {
+	sessions, err := model.SessionList()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, sessions)
+}
+
+func AdminUserSessionDelete(ctx App, res http.ResponseWriter, req *http.Request) {
+	if err := model.SessionDelete(mux.Vars(req)["id"]); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
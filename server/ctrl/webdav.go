@@ -14,11 +14,17 @@ func WebdavHandler(ctx App, res http.ResponseWriter, req *http.Request) {
 		http.NotFound(res, req)
 		return
 	}
+	// the names of the items of a collection only exist in the virtual directory of the web client
+	if ctx.Share.Collection {
+		SendErrorResult(res, ErrNotImplemented)
+		return
+	}
 
 	// https://github.com/golang/net/blob/master/webdav/webdav.go#L49-L68
-	canRead := model.CanRead(&ctx)
-	canWrite := model.CanRead(&ctx)
-	canUpload := model.CanUpload(&ctx)
+	path := webdavPath(ctx, req)
+	canRead := model.CanRead(&ctx, path)
+	canWrite := model.CanEdit(&ctx, path)
+	canUpload := model.CanUpload(&ctx, path)
 	switch req.Method {
 	case "OPTIONS", "GET", "HEAD", "POST", "PROPFIND":
 		if !canRead {
@@ -35,19 +41,70 @@ func WebdavHandler(ctx App, res http.ResponseWriter, req *http.Request) {
 			SendErrorResult(res, ErrPermissionDenied)
 			return
 		}
+		// people who can only upload mustn't be able to overwrite what's already there
+		if req.Method == "PUT" && !canWrite && fileExists(ctx, path) {
+			SendErrorResult(res, ErrPermissionDenied)
+			return
+		}
 	default:
 		SendErrorResult(res, ErrNotImplemented)
 		return
 	}
 
+	// uploads made through a shared link go against the limits of the link
+	if req.Method == "PUT" {
+		upload, err := model.ShareUploadTake(ctx.Share, path, req.ContentLength, model.ShareProofGetIdentity(req, ctx.Share))
+		if err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+		if upload != 0 {
+			// the status and the size of what got uploaded are tracked by the middlewares
+			defer func() {
+				if obj, ok := res.(interface{ Status() int }); ok && obj.Status() >= 300 {
+					model.ShareUploadRelease(upload)
+					return
+				}
+				size := req.ContentLength
+				if obj, ok := req.Body.(interface{ Count() int64 }); ok {
+					size = obj.Count()
+				}
+				if err := model.ShareUploadDone(ctx.Share, upload, size); err != nil {
+					Log.Subsystem("share").Request(ctx.RequestId).Error("share %s: can't record upload %s", ctx.Share.Id, err.Error())
+				}
+			}()
+		}
+	}
+
 	h := &webdav.Handler{
 		Prefix:     "/s/" + ctx.Share.Id,
 		FileSystem: model.NewWebdavFs(ctx.Backend, ctx.Share.Backend, ctx.Share.Path, req),
 		LockSystem: model.NewWebdavLock(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				Log.Subsystem("webdav").Request(ctx.RequestId).Warning("%s %s: %s", r.Method, r.URL.Path, err.Error())
+				return
+			}
+			Log.Subsystem("webdav").Request(ctx.RequestId).Debug("%s %s", r.Method, r.URL.Path)
+		},
 	}
 	h.ServeHTTP(res, req)
 }
 
+func webdavPath(ctx App, req *http.Request) string {
+	p := strings.TrimPrefix(req.URL.Path, "/s/"+ctx.Share.Id)
+	if p == "" {
+		return ctx.Share.Path
+	}
+	if IsDirectory(ctx.Share.Path) {
+		if IsDirectory(p) {
+			return EnforceDirectory(JoinPath(ctx.Share.Path, p))
+		}
+		return JoinPath(ctx.Share.Path, p)
+	}
+	return ctx.Share.Path
+}
+
 /*
  * OSX ask for a lot of crap while mounting as a network drive. To avoid wasting resources with such
  * an imbecile and considering we can't even see the source code they are running, the best approach we
@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+// Audit records what happened in the audit log once the handler is done, along with the activity of
+// shared links. It needs to be placed after SessionStart in the chain to know who the actor is
+func Audit(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
+	return func(ctx App, res http.ResponseWriter, req *http.Request) {
+		fn(ctx, res, req)
+		operation, path := auditOperation(ctx, req)
+		if operation == "" {
+			return
+		}
+		status := http.StatusOK
+		var size int64
+		if obj, ok := res.(*ResponseWriter); ok {
+			if obj.status != 0 {
+				status = obj.status
+			}
+			size = obj.size
+		}
+		if ctx.Share.Id != "" && isShareActivity(operation) {
+			model.ShareActivityRecord(model.ShareAccess{
+				Share:     ctx.Share.Id,
+				Operation: operation,
+				Path:      path,
+				Identity:  model.ShareProofGetIdentity(req, ctx.Share),
+				Ip:        RemoteIP(req),
+				Bytes:     size,
+				Status:    status,
+			})
+		}
+		if !Config.Get("log.audit").Bool() {
+			return
+		}
+		share := ctx.Share.Id
+		if share == "" && mux.Vars(req)["share"] != "private" {
+			share = mux.Vars(req)["share"]
+		}
+		e := model.AuditEvent{
+			Actor:     auditActor(ctx, req),
+			Share:     share,
+			Operation: operation,
+			Path:      path,
+			Status:    status,
+			Ip:        RemoteIP(req),
+			UserAgent: req.UserAgent(),
+		}
+		if len(ctx.Session) > 0 {
+			e.Backend = GenerateID(&ctx)
+		}
+		model.AuditRecord(e)
+	}
+}
+
+// isShareActivity tells which operations made through a shared link its owner gets to see. Proofs are
+// recorded by the handler itself as it's the only one to know who got verified
+func isShareActivity(operation string) bool {
+	switch operation {
+	case "file.list", "file.read", "file.download", "file.export":
+		return true
+	}
+	return strings.HasPrefix(operation, "webdav.")
+}
+
+func auditActor(ctx App, req *http.Request) string {
+	if strings.HasPrefix(req.URL.Path, "/admin/") {
+		return "admin"
+	}
+	if id := ctx.Session["identity"]; id != "" {
+		return id
+	}
+	if ctx.Token.Id != "" {
+		return "token::" + ctx.Token.Id
+	}
+	if ctx.Share.Id != "" {
+		return "share::" + ctx.Share.Id
+	}
+	for _, key := range []string{"username", "user"} {
+		if u := ctx.Session[key]; u != "" {
+			return u
+		}
+		if u := NewStringFromInterface(ctx.Body[key]); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+// auditOperation gives a name to what the request is about along with the absolute path it targets.
+// Requests that are of no interest for the audit log yield an empty operation.
+func auditOperation(ctx App, req *http.Request) (string, string) {
+	abs := func(p string) string {
+		if p == "" {
+			return ""
+		}
+		if ctx.Share.Collection {
+			if path, err := model.ShareCollectionPath(ctx.Share, p); err == nil {
+				return path
+			}
+		}
+		return JoinPath(EnforceDirectory(ctx.Session["path"]), p)
+	}
+	query := req.URL.Query()
+	if strings.HasPrefix(req.URL.Path, "/s/") {
+		return "webdav." + strings.ToLower(req.Method), abs(strings.TrimPrefix(req.URL.Path, "/s/"+mux.Vars(req)["share"]))
+	}
+	if strings.HasPrefix(req.URL.Path, "/api/export/") {
+		return "file.export", abs(query.Get("path"))
+	}
+
+	tmpl := req.URL.Path
+	if route := mux.CurrentRoute(req); route != nil {
+		if t, err := route.GetPathTemplate(); err == nil {
+			tmpl = t
+		}
+	}
+	switch req.Method + " " + tmpl {
+	case "POST /api/session":
+		return "session.login", ""
+	case "DELETE /api/session":
+		return "session.logout", ""
+	case "GET /api/files/cat", "HEAD /api/files/cat":
+		return "file.read", abs(query.Get("path"))
+	case "GET /api/files/signed", "HEAD /api/files/signed":
+		return "signed_url.read", abs(query.Get("path"))
+	case "POST /api/files/sign":
+		return "signed_url.create", abs(NewStringFromInterface(ctx.Body["path"]))
+	case "POST /api/files/sign/revoke":
+		return "signed_url.revoke", ""
+	case "POST /api/files/cat":
+		return "file.save", abs(query.Get("path"))
+	case "GET /api/files/zip":
+		return "file.download", strings.Join(func() []string {
+			paths := query["path"]
+			for i := range paths {
+				paths[i] = abs(paths[i])
+			}
+			return paths
+		}(), ",")
+	case "GET /api/files/ls":
+		return "file.list", abs(query.Get("path"))
+	case "GET /api/files/mv":
+		return "file.move", abs(query.Get("from")) + " -> " + abs(query.Get("to"))
+	case "GET /api/files/rm":
+		return "file.delete", abs(query.Get("path"))
+	case "GET /api/files/mkdir":
+		return "file.mkdir", abs(query.Get("path"))
+	case "GET /api/files/touch":
+		return "file.create", abs(query.Get("path"))
+	case "GET /api/files/search":
+		return "file.search", abs(query.Get("path"))
+	case "POST /api/share/{share}":
+		return "share.upsert", abs(NewStringFromInterface(ctx.Body["path"]))
+	case "DELETE /api/share/{share}":
+		return "share.delete", ""
+	case "POST /api/share/{share}/proof":
+		return "share.proof", ""
+	case "POST /api/tokens":
+		return "token.create", abs(NewStringFromInterface(ctx.Body["path"]))
+	case "DELETE /api/tokens/{token}":
+		return "token.delete", ""
+	case "POST /admin/api/session":
+		return "admin.login", ""
+	case "POST /admin/api/config":
+		return "config.update", ""
+	case "POST /admin/api/config/history/{id}/rollback":
+		return "config.rollback", mux.Vars(req)["id"]
+	}
+	if strings.HasPrefix(tmpl, "/admin/api/") && req.Method != "GET" {
+		return "admin." + strings.ToLower(req.Method), strings.TrimPrefix(req.URL.Path, "/admin/api")
+	}
+	return "", ""
+}
@@ -6,8 +6,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+var rateLimiter = NewRateLimiter()
+
 func ApiHeaders(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
 	return func(ctx App, res http.ResponseWriter, req *http.Request) {
 		header := res.Header()
@@ -19,7 +22,9 @@ func ApiHeaders(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App,
 
 func SecureAjax(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
 	return func(ctx App, res http.ResponseWriter, req *http.Request) {
-		if req.Header.Get("X-Requested-With") != "XmlHttpRequest" {
+		// browsers never attach a bearer token on their own, which makes those requests as safe
+		// against CSRF as the ones carrying our custom header
+		if req.Header.Get("X-Requested-With") != "XmlHttpRequest" && _extractBearer(req) == "" {
 			Log.Warning("Intrusion detection: %s - %s", req.RemoteAddr, req.URL.String())
 			SendErrorResult(res, ErrNotAllowed)
 			return
@@ -28,6 +33,36 @@ func SecureAjax(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App,
 	}
 }
 
+// RateLimit throttles the requests coming from the same IP, the same session or targeting the same
+// shared link so that a single client can't hammer the server nor guess its way in
+func RateLimit(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
+	return func(ctx App, res http.ResponseWriter, req *http.Request) {
+		limit := RateLimitPerMinute()
+		if limit <= 0 {
+			fn(ctx, res, req)
+			return
+		}
+		keys := []string{"ip::" + RemoteIP(req)}
+		if c, err := req.Cookie(CookieNameAuth); err == nil && c.Value != "" {
+			keys = append(keys, "session::"+QuickHash(c.Value, 20))
+		}
+		if bearer := _extractBearer(req); bearer != "" {
+			keys = append(keys, "token::"+strings.SplitN(bearer, ".", 2)[0])
+		}
+		if share := _extractShareId(req); share != "" {
+			keys = append(keys, "share::"+share)
+		}
+		for _, key := range keys {
+			if ok, wait := rateLimiter.Allow(key, limit); !ok {
+				Log.Debug("rate limit reached for '%s'", key)
+				SendTooManyRequests(res, wait)
+				return
+			}
+		}
+		fn(ctx, res, req)
+	}
+}
+
 func StaticHeaders(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
 	return func(ctx App, res http.ResponseWriter, req *http.Request) {
 		header := res.Header()
@@ -4,7 +4,18 @@ import (
 	"bytes"
 	"encoding/json"
 	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"io"
 	"net/http"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,27 +23,102 @@ import (
 type Middleware func(func(App, http.ResponseWriter, *http.Request)) func(App, http.ResponseWriter, *http.Request)
 
 func Chain(fn func(App, http.ResponseWriter, *http.Request), m []Middleware, app App) http.HandlerFunc {
+	handler := traceHandler(fn)
 	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := app
+		ctx.RequestId = requestId(req)
+		res.Header().Set("X-Request-Id", ctx.RequestId)
+		route := routeName(req)
+		spanCtx, span := StartSpan(
+			otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header)),
+			req.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("http.route", route),
+				attribute.String("filestash.request_id", ctx.RequestId),
+			),
+		)
+		ctx.Context = spanCtx
+		req = req.WithContext(spanCtx)
 		resw := NewResponseWriter(res)
-		f := fn
+		body := &bodyCounter{}
+		if req.Body != nil {
+			body.ReadCloser = req.Body
+			req.Body = body
+		}
+		f := handler
 
 		for i := len(m) - 1; i >= 0; i-- {
 			f = m[i](f)
 		}
-		f(app, &resw, req)
+		f(ctx, &resw, req)
 		if req.Body != nil {
 			req.Body.Close()
 		}
+		metrics(&resw, req, route, body.n)
+		status := resw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+
+		if ctx.LogEnabled {
+			go Logger(ctx, &resw, req)
+		}
+	}
+}
+
+// traceHandler wraps the handler at the end of the chain in a span of its own, so the time spent in
+// the middlewares can be told apart from the time spent in the controller
+func traceHandler(fn func(App, http.ResponseWriter, *http.Request)) func(App, http.ResponseWriter, *http.Request) {
+	name := "handler"
+	if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil {
+		name = f.Name()[strings.LastIndex(f.Name(), "/")+1:]
+	}
+	return func(ctx App, res http.ResponseWriter, req *http.Request) {
+		spanCtx, span := StartSpan(ctx.Context, name)
+		ctx.Context = spanCtx
+		fn(ctx, res, req.WithContext(spanCtx))
+		span.End()
+	}
+}
+
+func routeName(req *http.Request) string {
+	if r := mux.CurrentRoute(req); r != nil {
+		if t, err := r.GetPathTemplate(); err == nil {
+			return t
+		}
+	}
+	return "unknown"
+}
 
-		if app.LogEnabled {
-			go Logger(app, &resw, req)
+// requestId gives the correlation ID of a request. An ID set by a reverse proxy upstream is kept
+// as long as it looks sane so the same request can be followed across the whole stack
+func requestId(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" && len(id) <= 64 {
+		valid := true
+		for _, c := range id {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return id
 		}
 	}
+	return QuickString(16)
 }
 
 type ResponseWriter struct {
 	http.ResponseWriter
 	status int
+	size   int64
 	start  time.Time
 }
 
@@ -52,7 +138,44 @@ func (w *ResponseWriter) Write(b []byte) (int, error) {
 	if w.status == 0 {
 		w.status = 200
 	}
-	return w.ResponseWriter.Write(b)
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Status gives the status code sent so far, what's sent by default when nothing has been written yet
+func (w *ResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+type bodyCounter struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *bodyCounter) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// Count gives how many bytes of the request body have been read
+func (b *bodyCounter) Count() int64 {
+	return b.n
+}
+
+func metrics(res *ResponseWriter, req *http.Request, route string, bytesIn int64) {
+	status := res.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	MetricHttpRequests.WithLabelValues(route, req.Method, strconv.Itoa(status)).Inc()
+	MetricHttpDuration.WithLabelValues(route, req.Method).Observe(time.Since(res.start).Seconds())
+	MetricHttpBytesIn.WithLabelValues(route).Add(float64(bytesIn))
+	MetricHttpBytesOut.WithLabelValues(route).Add(float64(res.size))
 }
 
 type LogEntry struct {
@@ -90,7 +213,7 @@ func Logger(ctx App, res http.ResponseWriter, req *http.Request) {
 			telemetry.Record(point)
 		}
 		if Config.Get("log.enable").Bool() {
-			Log.Info("HTTP %3d %3s %6.1fms %s", point.Status, point.Method, point.Duration, point.RequestURI)
+			Log.Request(ctx.RequestId).Info("HTTP %3d %3s %6.1fms %s", point.Status, point.Method, point.Duration, point.RequestURI)
 		}
 	}
 }
@@ -1,14 +1,15 @@
 package middleware
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	. "github.com/bingoohuang/filestash/server/common"
 	"github.com/bingoohuang/filestash/server/model"
 	"github.com/gorilla/mux"
+	"mime"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -54,22 +55,76 @@ func AdminOnly(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, r
 func SessionStart(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
 	return func(ctx App, res http.ResponseWriter, req *http.Request) {
 		var err error
-		if ctx.Share, err = _extractShare(req); err != nil {
+		if bearer := _extractBearer(req); bearer != "" {
+			// a personal token only ever gives access to what it was scoped on, cookies and shared
+			// links are purposely ignored
+			if ctx.Token, err = model.TokenVerify(bearer); err != nil {
+				SendErrorResult(res, err)
+				return
+			}
+			if ctx.Session, err = _extractTokenSession(&ctx); err != nil {
+				SendErrorResult(res, err)
+				return
+			}
+		} else {
+			if ctx.Share, err = _extractShare(req); err != nil {
+				SendErrorResult(res, err)
+				return
+			}
+			if ctx.Session, err = _extractSession(req, &ctx); err != nil {
+				SendErrorResult(res, err)
+				return
+			}
+		}
+		if ctx.Backend, err = _extractBackend(req, &ctx); err != nil {
+			if len(ctx.Session) == 0 {
+				SendErrorResult(res, ErrNotAuthorized)
+				return
+			}
 			SendErrorResult(res, err)
 			return
 		}
-		if ctx.Session, err = _extractSession(req, &ctx); err != nil {
+		fn(ctx, res, req)
+	}
+}
+
+// SignedUrlStart is what SessionStart is to signed URLs: the session comes from the owner of the URL
+// rather than from a cookie, and the request is narrowed down to the file that got signed
+func SignedUrlStart(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
+	return func(ctx App, res http.ResponseWriter, req *http.Request) {
+		u, auth, err := model.SignedUrlVerify(req.URL.Query(), RemoteIP(req))
+		if err != nil {
 			SendErrorResult(res, err)
 			return
 		}
+		str, err := DecryptString(SecretKeyDerivateForUser, auth)
+		if err != nil {
+			SendErrorResult(res, ErrNotAuthorized)
+			return
+		}
+		session := make(map[string]string)
+		if err = json.Unmarshal([]byte(str), &session); err != nil {
+			SendErrorResult(res, ErrNotAuthorized)
+			return
+		}
+		ctx.Session = session
+		chroot := EnforceDirectory(session["path"])
+		if model.SignedUrlOwner(&ctx) != u.Owner || GenerateID(&ctx) != u.Backend || !strings.HasPrefix(u.Path, chroot) {
+			SendErrorResult(res, ErrPermissionDenied)
+			return
+		}
 		if ctx.Backend, err = _extractBackend(req, &ctx); err != nil {
-			if len(ctx.Session) == 0 {
-				SendErrorResult(res, ErrNotAuthorized)
-				return
-			}
 			SendErrorResult(res, err)
 			return
 		}
+		req.URL.RawQuery = url.Values{"path": []string{"/" + strings.TrimPrefix(u.Path, chroot)}}.Encode()
+		if u.Disposition != "" {
+			filename := u.Filename
+			if filename == "" {
+				filename = filepath.Base(u.Path)
+			}
+			res.Header().Set("Content-Disposition", mime.FormatMediaType(u.Disposition, map[string]string{"filename": filename}))
+		}
 		fn(ctx, res, req)
 	}
 }
@@ -157,6 +212,72 @@ func CanManageShare(fn func(App, http.ResponseWriter, *http.Request)) func(ctx A
 	}
 }
 
+// ShareDownloadLimit counts the files read through a shared link, be it in the viewer or as a download.
+// A read takes one of the slots the link allows before anything is sent and gives it back when it doesn't
+// go through. One shot links self destruct once their file has been read in full. View only links only
+// let files be read one at a time, in full, so that the watermark is applied onto the whole of it
+func ShareDownloadLimit(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
+	return func(ctx App, res http.ResponseWriter, req *http.Request) {
+		operation := shareFileOperation(ctx, req)
+		if ctx.Share.Id == "" || operation == "" {
+			fn(ctx, res, req)
+			return
+		}
+		if ctx.Share.ViewOnly {
+			if operation != "file.read" {
+				SendErrorResult(res, NewError("This link is view only", 403))
+				return
+			}
+			// the watermark differs from one person to the next, pieces of a file can't be
+			// served from a cache shared by everyone using the link
+			req.Header.Del("Range")
+		}
+		// every read counts, whatever the client says it is for: the viewer and a download
+		// fetch the same content
+		if err := model.ShareDownloadTake(ctx.Share); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+		if ctx.Share.MaxDownloads != nil {
+			// a limited link can't be fetched piece by piece, each request would otherwise
+			// only count as a partial download
+			req.Header.Del("Range")
+		}
+		fn(ctx, res, req)
+
+		complete := req.Context().Err() == nil
+		if obj, ok := res.(*ResponseWriter); ok && obj.status != http.StatusOK {
+			complete = false
+		}
+		if !complete {
+			if err := model.ShareDownloadRelease(ctx.Share); err != nil {
+				Log.Subsystem("share").Request(ctx.RequestId).Error("share %s: can't release download %s", ctx.Share.Id, err.Error())
+			}
+			return
+		}
+		if ctx.Share.OneShot {
+			if err := model.ShareSelfDestruct(ctx.Share); err != nil {
+				Log.Subsystem("share").Request(ctx.RequestId).Error("share %s: can't destroy one shot link %s", ctx.Share.Id, err.Error())
+				return
+			}
+			Log.Subsystem("share").Request(ctx.RequestId).Info("share %s: one shot link destroyed after its download", ctx.Share.Id)
+		}
+	}
+}
+
+// shareFileOperation gives the operation of a request fetching the content of a file, nothing when the
+// request is about something else
+func shareFileOperation(ctx App, req *http.Request) string {
+	if req.Method != http.MethodGet || req.URL.Query().Get("thumbnail") == "true" {
+		return ""
+	}
+	switch operation, _ := auditOperation(ctx, req); operation {
+	case "file.read", "file.download", "file.export", "webdav.get":
+		return operation
+	}
+	return ""
+}
+
 func _extractShareId(req *http.Request) string {
 	share := req.URL.Query().Get("share")
 	if share != "" {
@@ -176,7 +297,7 @@ func _extractShare(req *http.Request) (Share, error) {
 		return Share{}, nil
 	}
 	if !Config.Get("features.share.enable").Bool() {
-		Log.Debug("Share feature isn't enable, contact your administrator")
+		Log.Subsystem("share").Debug("Share feature isn't enable, contact your administrator")
 		return Share{}, NewError("Feature isn't enable, contact your administrator", 405)
 	}
 
@@ -184,32 +305,12 @@ func _extractShare(req *http.Request) (Share, error) {
 	if err != nil {
 		return Share{}, nil
 	}
-	if err = s.IsValid(); err != nil {
+	var verifiedProof = model.ShareProofGetAlreadyVerified(req)
+	if err = model.ShareIsValid(s, verifiedProof); err != nil {
 		return Share{}, err
 	}
 
-	var verifiedProof = model.ShareProofGetAlreadyVerified(req)
-	username, password := func(authHeader string) (string, string) {
-		decoded, err := base64.StdEncoding.DecodeString(
-			strings.TrimPrefix(authHeader, "Basic "),
-		)
-		if err != nil {
-			return "", ""
-		}
-		s := bytes.Split(decoded, []byte(":"))
-		if len(s) < 2 {
-			return "", ""
-		}
-		p := string(bytes.Join(s[1:], []byte(":")))
-		usr := regexp.MustCompile(`^(.*)\[([0-9a-zA-Z]+)\]$`).FindStringSubmatch(string(s[0]))
-		if len(usr) != 3 {
-			return "", p
-		}
-		if Hash(usr[1]+SecretKeyDerivateForHash, 10) != usr[2] {
-			return "", p
-		}
-		return usr[1], p
-	}(req.Header.Get("Authorization"))
+	username, password := model.ShareProofGetBasicAuth(req)
 
 	if s.Users != nil && username != "" {
 		if v, ok := model.ShareProofVerifierEmail(*s.Users, username); ok {
@@ -221,8 +322,7 @@ func _extractShare(req *http.Request) (Share, error) {
 			verifiedProof = append(verifiedProof, model.Proof{Key: "password", Value: v})
 		}
 	}
-	var requiredProof = model.ShareProofGetRequired(s)
-	var remainingProof = model.ShareProofCalculateRemainings(requiredProof, verifiedProof)
+	var remainingProof = model.ShareProofGetRemaining(s, req, verifiedProof)
 	if len(remainingProof) != 0 {
 		return Share{}, NewError("Unauthorized Shared space", 400)
 	}
@@ -302,6 +402,12 @@ func _extractSession(req *http.Request, ctx *App) (map[string]string, error) {
 	if err != nil {
 		return session, nil
 	}
+	if model.SessionServerSide() {
+		if session, err = model.SessionGet(cookie.Value); err != nil && err != ErrNotFound {
+			return session, err
+		}
+		return session, nil
+	}
 	str = cookie.Value
 	str, err = DecryptString(SecretKeyDerivateForUser, str)
 	if err != nil {
@@ -312,6 +418,28 @@ func _extractSession(req *http.Request, ctx *App) (map[string]string, error) {
 	return session, err
 }
 
+func _extractBearer(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
+func _extractTokenSession(ctx *App) (map[string]string, error) {
+	var session = make(map[string]string)
+	str, err := DecryptString(SecretKeyDerivateForUser, ctx.Token.Auth)
+	if err != nil {
+		// This typically happen when changing the secret key
+		return session, ErrNotAuthorized
+	}
+	if err = json.Unmarshal([]byte(str), &session); err != nil {
+		return session, ErrNotAuthorized
+	}
+	session["path"] = ctx.Token.Path
+	return session, nil
+}
+
 func _extractBackend(req *http.Request, ctx *App) (IBackend, error) {
 	return model.NewBackend(ctx, ctx.Session)
 }
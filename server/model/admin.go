@@ -0,0 +1,114 @@
+package model
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const AdminTotpRecoveryCodes = 10
+
+var adminTotpLock sync.Mutex
+
+func init() {
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS AdminTotp(id INTEGER PRIMARY KEY CHECK (id = 1), secret TEXT NOT NULL, recovery TEXT NOT NULL, last_step INTEGER NOT NULL DEFAULT 0, created INTEGER NOT NULL)"); err == nil {
+		stmt.Exec()
+	}
+}
+
+func AdminTotpEnabled() bool {
+	var n int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM AdminTotp").Scan(&n); err != nil {
+		Log.Error("model::admin totp %s", err.Error())
+		// better to lock the admin out than letting anyone in
+		return true
+	}
+	return n > 0
+}
+
+// AdminTotpEnable registers the second factor of the admin and gives back the recovery codes. Those
+// are only stored as a hash and can't be shown again.
+func AdminTotpEnable(secret string) ([]string, error) {
+	if !TotpIsValidSecret(secret) {
+		return nil, ErrNotValid
+	}
+	encrypted, err := EncryptString(SecretKeyDerivateForAdmin, secret)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, AdminTotpRecoveryCodes)
+	hashes := make([]string, AdminTotpRecoveryCodes)
+	for i := range codes {
+		codes[i] = strings.ToLower(RandomString(10))
+		h, err := bcrypt.GenerateFromPassword([]byte(codes[i]), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = string(h)
+	}
+	adminTotpLock.Lock()
+	defer adminTotpLock.Unlock()
+	_, err = DB.Exec(
+		"INSERT INTO AdminTotp(id, secret, recovery, created) VALUES(1, ?, ?, ?) ON CONFLICT(id) DO UPDATE SET secret = excluded.secret, recovery = excluded.recovery, last_step = 0, created = excluded.created",
+		encrypted, strings.Join(hashes, ","), time.Now().Unix(),
+	)
+	return codes, err
+}
+
+func AdminTotpDisable() error {
+	adminTotpLock.Lock()
+	defer adminTotpLock.Unlock()
+	_, err := DB.Exec("DELETE FROM AdminTotp")
+	return err
+}
+
+// AdminTotpVerify accepts either a code from the authenticator app or one of the recovery codes. A
+// code can only be used once.
+func AdminTotpVerify(code string) bool {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), " ", "", -1))
+	if code == "" {
+		return false
+	}
+	adminTotpLock.Lock()
+	defer adminTotpLock.Unlock()
+
+	var encrypted, recovery string
+	var lastStep int64
+	if err := DB.QueryRow("SELECT secret, recovery, last_step FROM AdminTotp WHERE id = 1").Scan(&encrypted, &recovery, &lastStep); err != nil {
+		if err != sql.ErrNoRows {
+			Log.Error("model::admin totp %s", err.Error())
+		}
+		return false
+	}
+
+	if secret, err := DecryptString(SecretKeyDerivateForAdmin, encrypted); err == nil {
+		if step, ok := TotpVerify(secret, code); ok {
+			if step <= lastStep {
+				return false
+			}
+			DB.Exec("UPDATE AdminTotp SET last_step = ? WHERE id = 1", step)
+			return true
+		}
+	} else {
+		// This typically happen when changing the secret key, only the recovery codes can help
+		Log.Warning("model::admin totp can't decrypt the secret")
+	}
+
+	hashes := strings.Split(recovery, ",")
+	for i := range hashes {
+		if hashes[i] == "" {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hashes[i]), []byte(code)) == nil {
+			hashes = append(hashes[:i], hashes[i+1:]...)
+			DB.Exec("UPDATE AdminTotp SET recovery = ? WHERE id = 1", strings.Join(hashes, ","))
+			Log.Warning("model::admin totp recovery code used, %d remaining", len(hashes))
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,287 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+// AuditEvent is a single entry of the audit log. Entries are chained together: the hash of an entry
+// is a HMAC covering its content and the hash of the previous entry, which makes any alteration of the
+// history detectable with AuditVerify. Without the key, nobody can rewrite the chain from the point
+// they altered onwards
+type AuditEvent struct {
+	Id        int64  `json:"id"`
+	Time      int64  `json:"time"`
+	Actor     string `json:"actor"`
+	Backend   string `json:"backend"`
+	Share     string `json:"share,omitempty"`
+	Operation string `json:"operation"`
+	Path      string `json:"path"`
+	Status    int    `json:"status"`
+	Outcome   string `json:"outcome"`
+	Ip        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Hash      string `json:"hash"`
+}
+
+type AuditFilter struct {
+	Actor     string
+	Backend   string
+	Share     string
+	Operation string
+	Path      string
+	Outcome   string
+	From      int64
+	To        int64
+	Limit     int
+	Offset    int
+}
+
+type AuditVerification struct {
+	Valid    bool   `json:"valid"`
+	Count    int64  `json:"count"`
+	BrokenAt *int64 `json:"broken_at,omitempty"`
+}
+
+var (
+	auditQueue   chan AuditEvent
+	auditKeyLock sync.Mutex
+	auditKeyMem  []byte
+)
+
+func init() {
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS AuditLog(id INTEGER PRIMARY KEY AUTOINCREMENT, time INTEGER NOT NULL, actor VARCHAR(128), backend VARCHAR(16), share VARCHAR(64), operation VARCHAR(32) NOT NULL, path VARCHAR(1024), status INTEGER, outcome VARCHAR(8), ip VARCHAR(64), user_agent VARCHAR(256), prev_hash VARCHAR(64) NOT NULL, hash VARCHAR(64) NOT NULL)"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_auditlog_time ON AuditLog(time)"); err == nil {
+			stmt.Exec()
+		}
+	}
+	// the log is append only, nothing can be changed once written. Old entries can be let go of by the
+	// maintenance but only from the start of the chain
+	if stmt, err := DB.Prepare("CREATE TRIGGER IF NOT EXISTS auditlog_no_update BEFORE UPDATE ON AuditLog BEGIN SELECT RAISE(ABORT, 'audit log is append only'); END"); err == nil {
+		stmt.Exec()
+	}
+	if stmt, err := DB.Prepare("DROP TRIGGER IF EXISTS auditlog_no_delete"); err == nil {
+		stmt.Exec()
+	}
+	if stmt, err := DB.Prepare("CREATE TRIGGER IF NOT EXISTS auditlog_head_delete BEFORE DELETE ON AuditLog WHEN EXISTS (SELECT 1 FROM AuditLog WHERE id < OLD.id) BEGIN SELECT RAISE(ABORT, 'audit log can only be pruned from the start'); END"); err == nil {
+		stmt.Exec()
+	}
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS AuditKey(id INTEGER PRIMARY KEY CHECK (id = 1), key TEXT NOT NULL)"); err == nil {
+		stmt.Exec()
+	}
+
+	auditQueue = make(chan AuditEvent, 1024)
+	go auditWriter()
+}
+
+// AuditRecord appends an event to the audit log. Writes are done in the background, in order, so that
+// the chain stays consistent. Requests never wait onto the audit log: when the queue is full, the event
+// is dropped and the drop logged
+func AuditRecord(e AuditEvent) {
+	if e.Time == 0 {
+		e.Time = time.Now().UnixNano() / 1000000
+	}
+	if e.Outcome == "" {
+		e.Outcome = "ok"
+		if e.Status >= 400 {
+			e.Outcome = "error"
+		}
+	}
+	if len(e.UserAgent) > 256 {
+		e.UserAgent = e.UserAgent[:256]
+	}
+	select {
+	case auditQueue <- e:
+	default:
+		MetricEventsDropped.WithLabelValues("audit").Inc()
+		Log.Error("model::audit queue is full, dropping %s on '%s' by '%s'", e.Operation, e.Path, e.Actor)
+	}
+}
+
+func auditWriter() {
+	var prev string
+	if err := DB.QueryRow("SELECT hash FROM AuditLog ORDER BY id DESC LIMIT 1").Scan(&prev); err != nil && err != sql.ErrNoRows {
+		Log.Error("model::audit can't initialise the chain %s", err.Error())
+	}
+	for e := range auditQueue {
+		key, err := auditKey()
+		if err != nil {
+			Log.Error("model::audit can't record event %s", err.Error())
+			continue
+		}
+		e.Hash = auditHash(key, prev, e)
+		if _, err := DB.Exec(
+			"INSERT INTO AuditLog(time, actor, backend, share, operation, path, status, outcome, ip, user_agent, prev_hash, hash) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			e.Time, e.Actor, e.Backend, e.Share, e.Operation, e.Path, e.Status, e.Outcome, e.Ip, e.UserAgent, prev, e.Hash,
+		); err != nil {
+			Log.Error("model::audit can't record event %s", err.Error())
+			continue
+		}
+		prev = e.Hash
+	}
+}
+
+func AuditQuery(f AuditFilter) ([]AuditEvent, error) {
+	where, args := auditWhere(f)
+	query := "SELECT " + auditColumns + " FROM AuditLog" + where + " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, f.Limit, f.Offset)
+	}
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []AuditEvent{}
+	for rows.Next() {
+		e, _, err := auditScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// AuditVerify walks through the whole chain and reports the first entry that doesn't match its hash.
+// The chain starts from the oldest entry the retention has kept
+func AuditVerify() (AuditVerification, error) {
+	v := AuditVerification{Valid: true}
+	key, err := auditKey()
+	if err != nil {
+		return v, err
+	}
+	rows, err := DB.Query("SELECT " + auditColumns + " FROM AuditLog ORDER BY id ASC")
+	if err != nil {
+		return v, err
+	}
+	defer rows.Close()
+	var prev *string
+	for rows.Next() {
+		e, prevHash, err := auditScan(rows)
+		if err != nil {
+			return v, err
+		}
+		v.Count += 1
+		if prev == nil {
+			prev = &prevHash
+		}
+		if prevHash != *prev || auditHash(key, *prev, e) != e.Hash {
+			v.Valid = false
+			v.BrokenAt = &e.Id
+			return v, nil
+		}
+		prev = &e.Hash
+	}
+	return v, nil
+}
+
+const auditColumns = "id, time, actor, backend, share, operation, path, status, outcome, ip, user_agent, prev_hash, hash"
+
+func auditScan(rows *sql.Rows) (AuditEvent, string, error) {
+	var (
+		e                                         AuditEvent
+		actor, backend, share, path, ip, ua, outc sql.NullString
+		status                                    sql.NullInt64
+		prevHash                                  string
+	)
+	if err := rows.Scan(&e.Id, &e.Time, &actor, &backend, &share, &e.Operation, &path, &status, &outc, &ip, &ua, &prevHash, &e.Hash); err != nil {
+		return e, "", err
+	}
+	e.Actor = actor.String
+	e.Backend = backend.String
+	e.Share = share.String
+	e.Path = path.String
+	e.Status = int(status.Int64)
+	e.Outcome = outc.String
+	e.Ip = ip.String
+	e.UserAgent = ua.String
+	return e, prevHash, nil
+}
+
+func auditWhere(f AuditFilter) (string, []interface{}) {
+	var cond []string
+	var args []interface{}
+	add := func(c string, v interface{}) {
+		cond = append(cond, c)
+		args = append(args, v)
+	}
+	if f.Actor != "" {
+		add("actor = ?", f.Actor)
+	}
+	if f.Backend != "" {
+		add("backend = ?", f.Backend)
+	}
+	if f.Share != "" {
+		add("share = ?", f.Share)
+	}
+	if f.Operation != "" {
+		add("operation LIKE ? || '%'", f.Operation)
+	}
+	if f.Path != "" {
+		add("path LIKE ? || '%'", f.Path)
+	}
+	if f.Outcome != "" {
+		add("outcome = ?", f.Outcome)
+	}
+	if f.From > 0 {
+		add("time >= ?", f.From)
+	}
+	if f.To > 0 {
+		add("time <= ?", f.To)
+	}
+	if len(cond) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(cond, " AND "), args
+}
+
+func auditHash(key []byte, prev string, e AuditEvent) string {
+	h := hmac.New(sha256.New, key)
+	fmt.Fprintf(
+		h, "%q|%d|%q|%q|%q|%q|%q|%d|%q|%q|%q",
+		prev, e.Time, e.Actor, e.Backend, e.Share, e.Operation, e.Path, e.Status, e.Outcome, e.Ip, e.UserAgent,
+	)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// auditKey gives the key of the HMAC chaining the entries together. It's made up on first use and
+// stored encrypted with the secret key, which keeps it the same when the secret key gets rotated
+func auditKey() ([]byte, error) {
+	auditKeyLock.Lock()
+	defer auditKeyLock.Unlock()
+	if auditKeyMem != nil {
+		return auditKeyMem, nil
+	}
+	var encrypted string
+	err := DB.QueryRow("SELECT key FROM AuditKey WHERE id = 1").Scan(&encrypted)
+	if err == sql.ErrNoRows {
+		key := RandomString(32)
+		if encrypted, err = EncryptString(SecretKeyDerivateForAudit, key); err != nil {
+			return nil, err
+		}
+		if _, err = DB.Exec("INSERT INTO AuditKey(id, key) VALUES(1, ?)", encrypted); err != nil {
+			return nil, err
+		}
+		auditKeyMem = []byte(key)
+		return auditKeyMem, nil
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := DecryptString(SecretKeyDerivateForAudit, encrypted)
+	if err != nil {
+		return nil, NewError("Can't decrypt the key of the audit log", 500)
+	}
+	auditKeyMem = []byte(key)
+	return auditKeyMem, nil
+}
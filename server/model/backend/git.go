@@ -29,6 +29,7 @@ func init() {
 	Backend.Register("git", Git{})
 
 	GitCache = NewAppCache()
+	GitCache.Name = "git"
 	cachePath := filepath.Join(GetCurrentDir(), GitCachePath)
 	os.RemoveAll(cachePath)
 	os.MkdirAll(cachePath, os.ModePerm)
@@ -92,8 +93,8 @@ func (git Git) Init(params map[string]string, app *App) (IBackend, error) {
 	if p.committerEmail == "" {
 		p.committerEmail = "https://filestash.app"
 	}
-	if len(params["password"]) > 2700 {
-		return nil, NewError("Your password doesn't fit in a cookie :/", 500)
+	if len(params["password"]) > 2700 && !Config.Get("auth.session.server_side").Bool() {
+		return nil, NewError("Your password doesn't fit in a cookie :/ (the admin can enable server side sessions)", 500)
 	}
 
 	hash := GenerateID(app)
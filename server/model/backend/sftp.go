@@ -40,6 +40,7 @@ func init() {
 	Backend.Register("sftp", Sftp{})
 
 	SftpCache = NewAppCache()
+	SftpCache.Name = "sftp"
 	SftpCache.OnEvict(func(key string, value interface{}) {
 		c := value.(*Sftp)
 		c.Close()
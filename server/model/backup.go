@@ -0,0 +1,176 @@
+package model
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+const backupConfigName = "filestash_config.json"
+
+// StateBackup writes a gzipped tarball of the config file and of the state directory. Databases are
+// copied with VACUUM INTO so the backup is consistent even when the server is running
+func StateBackup(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := backupFile(tw, ConfigJSONPath, backupConfigName); err != nil {
+		return err
+	}
+	root := GetCurrentDir()
+	err := filepath.Walk(filepath.Join(root, StatePath), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if info.IsDir() {
+			return tw.WriteHeader(&tar.Header{Name: name + "/", Mode: 0755, ModTime: info.ModTime(), Typeflag: tar.TypeDir})
+		} else if !info.Mode().IsRegular() {
+			return nil
+		}
+		for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+			if strings.HasSuffix(name, ".sql"+suffix) {
+				// part of the database copy made by VACUUM INTO
+				return nil
+			}
+		}
+		if strings.HasSuffix(name, ".sql") {
+			return backupDatabase(tw, path, name)
+		}
+		return backupFile(tw, path, name)
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// StateRestore replaces the config file and the state directory with the content of a backup made by
+// StateBackup. What was there before is kept aside with a ".bak" suffix. The server must not be
+// running while this happens
+func StateRestore(r io.Reader) error {
+	root := GetCurrentDir()
+	now := time.Now().Unix()
+	suffix := fmt.Sprintf(".%d.bak", now)
+	staging := filepath.Join(root, "data", fmt.Sprintf("restore.%d", now))
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return NewError("Not a backup: "+err.Error(), 400)
+	}
+	tr := tar.NewReader(gz)
+	hasConfig, hasState := false, false
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return NewError("Not a backup: "+err.Error(), 400)
+		}
+		name := filepath.ToSlash(filepath.Clean(h.Name))
+		if name == backupConfigName {
+			hasConfig = true
+		} else if strings.HasPrefix(name+"/", StatePath) {
+			hasState = true
+		} else {
+			return NewError("Unexpected file in backup: "+h.Name, 400)
+		}
+		target := filepath.Join(staging, filepath.FromSlash(name))
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(h.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !hasConfig || !hasState {
+		return NewError("Incomplete backup", 400)
+	}
+	b, err := os.ReadFile(filepath.Join(staging, backupConfigName))
+	if err != nil {
+		return err
+	}
+	if err := Config.Validate(b); err != nil {
+		return err
+	}
+
+	state := filepath.Join(root, StatePath)
+	if err := os.Rename(state, strings.TrimSuffix(state, "/")+suffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(filepath.Join(staging, StatePath), state); err != nil {
+		return err
+	}
+	if err := os.Rename(ConfigJSONPath, ConfigJSONPath+suffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(filepath.Join(staging, backupConfigName), ConfigJSONPath)
+}
+
+func backupFile(tw *tar.Writer, path string, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	h, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func backupDatabase(tw *tar.Writer, path string, name string) error {
+	tmp := filepath.Join(GetCurrentDir(), TmpPath, "backup_"+QuickString(10)+".sql")
+	defer os.Remove(tmp)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("VACUUM INTO ?", tmp)
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err.Error())
+	}
+	return backupFile(tw, tmp, name)
+}
@@ -0,0 +1,198 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+// ConfigVersion is a snapshot of the config file taken every time it changes
+type ConfigVersion struct {
+	Id      int64  `json:"id"`
+	Time    int64  `json:"time"`
+	Author  string `json:"author"`
+	Hash    string `json:"hash"`
+	Content string `json:"content,omitempty"`
+}
+
+type ConfigChange struct {
+	Key  string      `json:"key"`
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+var (
+	ConfigHistorySize func() int
+
+	// configMu makes sure a change made through the API is recorded under its author before the
+	// config listener gets a chance to see it
+	configMu sync.Mutex
+)
+
+func init() {
+	ConfigHistorySize = func() int {
+		return Config.Get("general.config_history").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "config_history"
+			f.Type = "number"
+			f.Default = 50
+			f.Description = "Number of versions of the config kept around to see what changed and roll back"
+			f.Placeholder = fmt.Sprintf("Default: %d", f.Default)
+			return f
+		}).Int()
+	}
+	ConfigHistorySize()
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ConfigHistory(id INTEGER PRIMARY KEY AUTOINCREMENT, time INTEGER NOT NULL, author VARCHAR(128), hash VARCHAR(32) NOT NULL, content TEXT NOT NULL)"); err == nil {
+		stmt.Exec()
+	}
+
+	// changes made outside of the admin console, by editing the file by hand, are recorded as well
+	configRecordFile("filesystem")
+	go func() {
+		onChange := Config.ListenForChange()
+		for range onChange.Listener {
+			configRecordFile("filesystem")
+		}
+	}()
+}
+
+// ConfigUpdate validates and applies a new config. Values coming from the environment are kept out
+// of the file which gets recorded as a new version in the history
+func ConfigUpdate(b []byte, author string) error {
+	if err := Config.Validate(b); err != nil {
+		return err
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	file, err := os.Create(ConfigJSONPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(PrettyPrint(Config.Seal(b))); err != nil {
+		return err
+	}
+	file.Close()
+	Config.Load()
+	Config.Save()
+	content, err := os.ReadFile(ConfigJSONPath)
+	if err != nil {
+		return err
+	}
+	return configHistoryRecord(content, author)
+}
+
+func ConfigHistoryList() ([]ConfigVersion, error) {
+	rows, err := DB.Query("SELECT id, time, author, hash FROM ConfigHistory ORDER BY id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := []ConfigVersion{}
+	for rows.Next() {
+		var v ConfigVersion
+		var author sql.NullString
+		if err := rows.Scan(&v.Id, &v.Time, &author, &v.Hash); err != nil {
+			return nil, err
+		}
+		v.Author = author.String
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+func ConfigHistoryGet(id int64) (ConfigVersion, error) {
+	var v ConfigVersion
+	var author sql.NullString
+	err := DB.QueryRow("SELECT id, time, author, hash, content FROM ConfigHistory WHERE id = ?", id).Scan(&v.Id, &v.Time, &author, &v.Hash, &v.Content)
+	if err == sql.ErrNoRows {
+		return v, ErrNotFound
+	}
+	v.Author = author.String
+	return v, err
+}
+
+// ConfigDiff lists the keys which differ between 2 versions of the config. Connections are compared
+// as a whole. Secrets are compared as they are but only show up redacted
+func ConfigDiff(from []byte, to []byte) []ConfigChange {
+	flatten := func(b []byte) map[string]interface{} {
+		m := make(map[string]interface{})
+		for _, v := range JsonIterator(string(b)) {
+			m[v.Path] = v.Value
+		}
+		var d struct {
+			Connections interface{} `json:"connections"`
+		}
+		json.Unmarshal(b, &d)
+		m["connections"] = d.Connections
+		return m
+	}
+	a, b := flatten(from), flatten(to)
+	redactedA, redactedB := flatten(Config.Redact(from)), flatten(Config.Redact(to))
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	changes := []ConfigChange{}
+	for k := range keys {
+		x, _ := json.Marshal(a[k])
+		y, _ := json.Marshal(b[k])
+		if string(x) != string(y) {
+			changes = append(changes, ConfigChange{Key: k, From: redactedA[k], To: redactedB[k]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+func configRecordFile(author string) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	configRecordLocked(author)
+}
+
+// configRecordLocked is configRecordFile for callers already holding configMu
+func configRecordLocked(author string) {
+	content, err := os.ReadFile(ConfigJSONPath)
+	if err != nil {
+		return
+	}
+	if err := configHistoryRecord(content, author); err != nil {
+		Log.Warning("model::config history record error %s", err.Error())
+	}
+}
+
+// configHistoryRecord adds a version to the history unless the content is the same as the last one
+func configHistoryRecord(content []byte, author string) error {
+	hash := Hash(string(content), 32)
+	var last string
+	if err := DB.QueryRow("SELECT hash FROM ConfigHistory ORDER BY id DESC LIMIT 1").Scan(&last); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if last == hash {
+		return nil
+	}
+	if _, err := DB.Exec(
+		"INSERT INTO ConfigHistory(time, author, hash, content) VALUES(?, ?, ?, ?)",
+		time.Now().Unix(), author, hash, string(content),
+	); err != nil {
+		return err
+	}
+	if n := ConfigHistorySize(); n > 0 {
+		_, err := DB.Exec("DELETE FROM ConfigHistory WHERE id NOT IN (SELECT id FROM ConfigHistory ORDER BY id DESC LIMIT ?)", n)
+		return err
+	}
+	return nil
+}
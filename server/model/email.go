@@ -0,0 +1,291 @@
+package model
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	htmlTemplate "html/template"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	textTemplate "text/template"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+	"gopkg.in/gomail.v2"
+)
+
+// Email is a message waiting in the outbound queue. Messages which don't make sense after some time,
+// like a verification code, come with an expiry after which they're dropped
+type Email struct {
+	To      []string
+	Subject string
+	Html    string
+	Text    string
+	Expire  *time.Time
+}
+
+// EmailTemplate is the default content of an email, the admin can override every part of it from the
+// email.template section of the config
+type EmailTemplate struct {
+	Subject string
+	Html    string
+	Text    string
+	Funcs   map[string]interface{}
+}
+
+const (
+	emailMaxAttempts = 10
+	emailTimeout     = 30 * time.Second
+)
+
+var (
+	emailLog       = Log.Subsystem("email")
+	emailWakeup    = make(chan struct{}, 1)
+	emailTemplates = map[string]func() EmailTemplate{}
+)
+
+func init() {
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS EmailQueue(id INTEGER PRIMARY KEY AUTOINCREMENT, recipients TEXT NOT NULL, subject TEXT, html TEXT, text TEXT, attempts INTEGER NOT NULL DEFAULT 0, next_attempt INTEGER NOT NULL, expire INTEGER, error TEXT)"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_emailqueue_next ON EmailQueue(next_attempt)"); err == nil {
+			stmt.Exec()
+		}
+	}
+
+	go func() {
+		for {
+			emailQueueProcess()
+			select {
+			case <-emailWakeup:
+			case <-time.After(time.Minute):
+			}
+		}
+	}()
+}
+
+// EmailRegisterTemplate makes a template available to EmailRender under the given name
+func EmailRegisterTemplate(name string, fn func() EmailTemplate) {
+	emailTemplates[name] = fn
+}
+
+// EmailRender fills a template with the given data. Each part comes from the config when the admin has
+// set one, from the default template otherwise. The plain text version is optional
+func EmailRender(name string, data interface{}) (Email, error) {
+	e := Email{}
+	fn, ok := emailTemplates[name]
+	if !ok {
+		return e, fmt.Errorf("unknown email template '%s'", name)
+	}
+	tmpl := fn()
+	part := func(key string, fallback string) string {
+		if v := Config.Get("email.template." + name + "_" + key).String(); strings.TrimSpace(v) != "" {
+			return v
+		}
+		return fallback
+	}
+
+	var b bytes.Buffer
+	if t, err := textTemplate.New(name).Funcs(tmpl.Funcs).Parse(part("subject", tmpl.Subject)); err != nil {
+		return e, err
+	} else if err = t.Execute(&b, data); err != nil {
+		return e, err
+	}
+	e.Subject = strings.TrimSpace(b.String())
+	b.Reset()
+	if t, err := htmlTemplate.New(name).Funcs(tmpl.Funcs).Parse(part("html", tmpl.Html)); err != nil {
+		return e, err
+	} else if err = t.Execute(&b, data); err != nil {
+		return e, err
+	}
+	e.Html = b.String()
+	b.Reset()
+	if text := part("text", tmpl.Text); text != "" {
+		if t, err := textTemplate.New(name).Funcs(tmpl.Funcs).Parse(text); err != nil {
+			return e, err
+		} else if err = t.Execute(&b, data); err != nil {
+			return e, err
+		}
+		e.Text = b.String()
+	}
+	return e, nil
+}
+
+// EmailQueue hands a message over to the outbound queue. Delivery happens in the background and is
+// retried with an increasing delay when the SMTP server can't be reached or rejects the message
+func EmailQueue(e Email) error {
+	if len(e.To) == 0 {
+		return NewError("No recipient", 400)
+	} else if Config.Get("email.server").String() == "" {
+		return NewError("Email isn't configured, contact your administrator", 500)
+	}
+	var expire interface{}
+	if e.Expire != nil {
+		expire = e.Expire.UnixNano() / 1000000
+	}
+	if _, err := DB.Exec(
+		"INSERT INTO EmailQueue(recipients, subject, html, text, next_attempt, expire) VALUES(?, ?, ?, ?, ?, ?)",
+		strings.Join(e.To, ","), e.Subject, e.Html, e.Text, time.Now().UnixNano()/1000000, expire,
+	); err != nil {
+		return err
+	}
+	select {
+	case emailWakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func emailQueueProcess() {
+	now := time.Now().UnixNano() / 1000000
+	if r, err := DB.Exec("DELETE FROM EmailQueue WHERE expire IS NOT NULL AND expire < ?", now); err == nil {
+		if n, _ := r.RowsAffected(); n > 0 {
+			emailLog.Warning("%d email(s) expired before they could be delivered", n)
+		}
+	}
+	rows, err := DB.Query("SELECT id, recipients, subject, html, text, attempts FROM EmailQueue WHERE next_attempt <= ? ORDER BY id", now)
+	if err != nil {
+		emailLog.Error("can't read the queue %s", err.Error())
+		return
+	}
+	type queued struct {
+		Email
+		id       int64
+		attempts int
+	}
+	emails := []queued{}
+	for rows.Next() {
+		var q queued
+		var to string
+		if err := rows.Scan(&q.id, &to, &q.Subject, &q.Html, &q.Text, &q.attempts); err != nil {
+			continue
+		}
+		q.To = strings.Split(to, ",")
+		emails = append(emails, q)
+	}
+	rows.Close()
+
+	for _, q := range emails {
+		err := emailSend(q.Email)
+		if err == nil {
+			emailLog.Debug("email '%s' sent to %s", q.Subject, strings.Join(q.To, ","))
+			DB.Exec("DELETE FROM EmailQueue WHERE id = ?", q.id)
+			continue
+		}
+		q.attempts += 1
+		if q.attempts >= emailMaxAttempts {
+			emailLog.Error("giving up on email '%s' to %s after %d attempts: %s", q.Subject, strings.Join(q.To, ","), q.attempts, err.Error())
+			DB.Exec("DELETE FROM EmailQueue WHERE id = ?", q.id)
+			continue
+		}
+		// 1mn, 2mn, 4mn, ... up to an hour between 2 attempts
+		delay := time.Minute << uint(q.attempts-1)
+		if delay > time.Hour {
+			delay = time.Hour
+		}
+		emailLog.Warning("can't send email '%s' to %s, retrying in %s: %s", q.Subject, strings.Join(q.To, ","), delay, err.Error())
+		DB.Exec(
+			"UPDATE EmailQueue SET attempts = ?, next_attempt = ?, error = ? WHERE id = ?",
+			q.attempts, time.Now().Add(delay).UnixNano()/1000000, err.Error(), q.id,
+		)
+	}
+}
+
+// emailSend delivers a message through the SMTP server of the config. Unlike gomail's dialer, the
+// certificate of the server gets verified and STARTTLS can be required
+func emailSend(e Email) error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", Config.Get("email.from").String())
+	m.SetHeader("To", e.To...)
+	m.SetHeader("Subject", e.Subject)
+	if e.Text != "" {
+		m.SetBody("text/plain", e.Text)
+		m.AddAlternative("text/html", e.Html)
+	} else {
+		m.SetBody("text/html", e.Html)
+	}
+
+	c, err := emailDial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = c.Mail(Config.Get("email.from").String()); err != nil {
+		return err
+	}
+	for _, to := range e.To {
+		if err = c.Rcpt(strings.TrimSpace(to)); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = m.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func emailDial() (*smtp.Client, error) {
+	host := Config.Get("email.server").String()
+	port := Config.Get("email.port").Int()
+	security := Config.Get("email.security").String()
+	if security == "auto" && port == 465 {
+		security = "tls"
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: Config.Get("email.skip_verify").Bool(),
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: emailTimeout}
+
+	var conn net.Conn
+	var err error
+	if security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if security != "tls" && security != "none" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(tlsConfig); err != nil {
+				c.Close()
+				return nil, err
+			}
+		} else if security == "starttls" {
+			c.Close()
+			return nil, fmt.Errorf("the SMTP server doesn't support STARTTLS")
+		}
+	}
+	if username := Config.Get("email.username").String(); username != "" {
+		// a server that doesn't offer to authenticate, or a STARTTLS stripped by someone in between,
+		// would otherwise have the emails go out without the credentials that were configured
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("the SMTP server doesn't support authentication")
+		}
+		// PlainAuth refuses to send the password over a connection that isn't encrypted
+		if err = c.Auth(smtp.PlainAuth("", username, Config.Get("email.password").String(), host)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -15,6 +15,13 @@ func isAllowed(conn map[string]string) bool {
 		if d["type"] != conn["type"] {
 			continue
 		}
+		if IsConnectionTemplate(d) {
+			// templated connections are filled up by authentication plugins, see `ConnectionTemplateApply`
+			if isAllowedTemplate(d, conn) {
+				possibilities = append(possibilities, d)
+			}
+			continue
+		}
 		if val, ok := d["hostname"]; ok {
 			if val != conn["hostname"] {
 				continue
@@ -40,16 +47,35 @@ func isAllowed(conn map[string]string) bool {
 	return len(possibilities) > 0
 }
 
+func isAllowedTemplate(tmpl map[string]interface{}, conn map[string]string) bool {
+	if conn["identity"] == "" {
+		return false
+	}
+	for _, key := range []string{"hostname", "url"} {
+		if val, ok := tmpl[key].(string); ok && !ConnectionTemplateMatch(val, conn[key]) {
+			return false
+		}
+	}
+	if val, ok := tmpl["path"].(string); ok {
+		return ConnectionTemplateMatch(EnforceDirectory(val), EnforceDirectory(conn["path"]))
+	}
+	return true
+}
+
 func NewBackend(ctx *App, conn map[string]string) (IBackend, error) {
 	if !isAllowed(conn) {
 		return Backend.Get(BackendNil), ErrNotAllowed
 	}
-	return Backend.Get(conn["type"]).Init(conn, ctx)
+	b, err := Backend.Get(conn["type"]).Init(conn, ctx)
+	if err != nil || b == nil {
+		return b, err
+	}
+	return instrumentedBackend{b, conn["type"], ctx.RequestId, ctx.Context}, nil
 }
 
 func GetHome(b IBackend, base string) (string, error) {
 	home := "/"
-	if obj, ok := b.(interface{ Home() (string, error) }); ok {
+	if obj, ok := UnwrapBackend(b).(interface{ Home() (string, error) }); ok {
 		tmp, err := obj.Home()
 		if err != nil {
 			return base, err
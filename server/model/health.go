@@ -0,0 +1,255 @@
+package model
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+var (
+	HealthMinFreeDisk func() int
+	HealthTimeout     func() time.Duration
+
+	healthConnCache = NewQuickCache(30, 60)
+	healthReady     struct {
+		sync.Mutex
+		time   time.Time
+		ready  bool
+		status []HealthStatus
+	}
+)
+
+// healthReadyCache is how long the outcome of the checks is reused for. Probes can hit the endpoint
+// as often as they like without the checks running more than that
+const healthReadyCache = 10 * time.Second
+
+func init() {
+	HealthMinFreeDisk = func() int {
+		return Config.Get("features.health.min_free_disk").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "min_free_disk"
+			f.Type = "number"
+			f.Default = 500
+			f.Description = "Free disk space in MB under which the instance isn't considered ready anymore"
+			f.Placeholder = fmt.Sprintf("Default: %dMB", f.Default)
+			return f
+		}).Int()
+	}
+	HealthMinFreeDisk()
+	HealthTimeout = func() time.Duration {
+		return time.Duration(Config.Get("features.health.timeout").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "timeout"
+			f.Type = "number"
+			f.Default = 3
+			f.Description = "Time in seconds given to the storage of a connection to answer the readiness probe"
+			f.Placeholder = fmt.Sprintf("Default: %ds", f.Default)
+			return f
+		}).Int()) * time.Second
+	}
+	HealthTimeout()
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS HealthCheck(id INTEGER PRIMARY KEY, time INTEGER NOT NULL)"); err == nil {
+		stmt.Exec()
+	}
+}
+
+// HealthReady gives the outcome of all the health checks. The instance is ready as long as none of the
+// critical checks fails
+func HealthReady() (bool, []HealthStatus) {
+	healthReady.Lock()
+	defer healthReady.Unlock()
+	if time.Since(healthReady.time) < healthReadyCache {
+		return healthReady.ready, healthReady.status
+	}
+	healthReady.ready, healthReady.status = healthRun()
+	healthReady.time = time.Now()
+	return healthReady.ready, healthReady.status
+}
+
+func healthRun() (bool, []HealthStatus) {
+	checks := []HealthCheck{
+		{Name: "database", Critical: true, Check: healthDatabase},
+		{Name: "state", Critical: true, Check: healthState},
+		{Name: "search", Critical: false, Check: healthSearch},
+	}
+	for i := range Config.Conn {
+		conn := Config.Conn[i]
+		label := NewStringFromInterface(conn["label"])
+		if label == "" {
+			label = NewStringFromInterface(conn["type"])
+		}
+		checks = append(checks, HealthCheck{
+			Name:     "connection::" + label,
+			Critical: false,
+			Check:    func() error { return healthConnection(conn) },
+		})
+	}
+	checks = append(checks, Hooks.Get.HealthCheck()...)
+
+	ready := true
+	status := make([]HealthStatus, len(checks))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := time.Now()
+			err := checks[i].Check()
+			status[i] = HealthStatus{
+				Name:     checks[i].Name,
+				Status:   "pass",
+				Duration: float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if err == nil {
+				return
+			} else if err == ErrHealthSkipped {
+				status[i].Status = "skip"
+				return
+			}
+			status[i].Message = err.Error()
+			status[i].Status = "warn"
+			if checks[i].Critical {
+				status[i].Status = "fail"
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := range status {
+		if status[i].Status == "fail" {
+			ready = false
+		}
+	}
+	return ready, status
+}
+
+func healthDatabase() error {
+	_, err := DB.Exec("INSERT OR REPLACE INTO HealthCheck(id, time) VALUES(1, ?)", time.Now().Unix())
+	return err
+}
+
+func healthState() error {
+	for _, p := range []string{LogPath, ConfigPath, DbPath, FtsPath, TmpPath} {
+		s, err := os.Stat(filepath.Join(GetCurrentDir(), p))
+		if err != nil {
+			return err
+		} else if !s.IsDir() {
+			return fmt.Errorf("%s isn't a directory", p)
+		}
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(filepath.Join(GetCurrentDir(), DbPath), &fs); err != nil {
+		return err
+	}
+	free := fs.Bavail * uint64(fs.Bsize) / (1024 * 1024)
+	if min := HealthMinFreeDisk(); min > 0 && free < uint64(min) {
+		return fmt.Errorf("only %dMB of free disk space left", free)
+	}
+	return nil
+}
+
+func healthSearch() error {
+	d := 10 * time.Duration(CycleTime()) * time.Second
+	if d < 5*time.Minute {
+		d = 5 * time.Minute
+	}
+	if stuck := SearchIndexerStuck(d); len(stuck) > 0 {
+		return fmt.Errorf("indexer stuck for more than %s: %s", d, strings.Join(stuck, ", "))
+	}
+	return nil
+}
+
+// healthConnection checks the server behind a connection can be reached. Results are cached so that
+// probes running every few seconds don't hammer the storage servers
+func healthConnection(conn map[string]interface{}) error {
+	addr := healthConnectionAddress(conn)
+	if addr == "" {
+		return ErrHealthSkipped
+	}
+	key := map[string]string{"addr": addr}
+	if c := healthConnCache.Get(key); c != nil {
+		if msg := c.(string); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return nil
+	}
+	msg := ""
+	c, err := net.DialTimeout("tcp", addr, HealthTimeout())
+	if err != nil {
+		msg = err.Error()
+	} else {
+		c.Close()
+	}
+	healthConnCache.Set(key, msg)
+	if msg != "" {
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// healthConnectionAddress finds out the host:port a connection talks to. Connections where the
+// server is picked by the user on the login page can't be checked and give an empty string
+func healthConnectionAddress(conn map[string]interface{}) string {
+	fromURL := func(s string) string {
+		u, err := url.Parse(s)
+		if err != nil || u.Hostname() == "" {
+			return ""
+		}
+		if u.Port() != "" {
+			return u.Host
+		}
+		switch u.Scheme {
+		case "http":
+			return net.JoinHostPort(u.Hostname(), "80")
+		case "https":
+			return net.JoinHostPort(u.Hostname(), "443")
+		case "ssh":
+			return net.JoinHostPort(u.Hostname(), "22")
+		}
+		return ""
+	}
+	switch NewStringFromInterface(conn["type"]) {
+	case "sftp":
+		host := NewStringFromInterface(conn["hostname"])
+		if host == "" {
+			return ""
+		}
+		port := "22"
+		if conn["port"] != nil && fmt.Sprint(conn["port"]) != "" {
+			port = fmt.Sprint(conn["port"])
+		}
+		return net.JoinHostPort(host, port)
+	case "webdav", "dav":
+		return fromURL(NewStringFromInterface(conn["url"]))
+	case "git":
+		repo := NewStringFromInterface(conn["repo"])
+		if strings.Contains(repo, "://") {
+			return fromURL(repo)
+		}
+		// scp like syntax: user@host:path
+		if i := strings.Index(repo, ":"); i > 0 {
+			host := repo[:i]
+			if j := strings.LastIndex(host, "@"); j >= 0 {
+				host = host[j+1:]
+			}
+			return net.JoinHostPort(host, "22")
+		}
+	case "gdrive":
+		return "www.googleapis.com:443"
+	case "backblaze":
+		return "api.backblazeb2.com:443"
+	}
+	return ""
+}
@@ -6,18 +6,22 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"os"
 	"path/filepath"
-	"time"
 )
 
-var DB *sql.DB
-
-func init() {
+// DB is opened before any of the init functions of the package get to run, whatever the file they
+// are declared in
+var DB *sql.DB = func() *sql.DB {
 	cachePath := filepath.Join(GetCurrentDir(), DbPath)
 	os.MkdirAll(cachePath, os.ModePerm)
-	var err error
-	if DB, err = sql.Open("sqlite3", cachePath+"/share.sql?_fk=true"); err != nil {
-		return
+	db, err := sql.Open("sqlite3", cachePath+"/share.sql?_fk=true")
+	if err != nil {
+		Log.Error("model::index can't open the database %s", err.Error())
+		return nil
 	}
+	return db
+}()
+
+func init() {
 
 	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS Location(backend VARCHAR(16), path VARCHAR(512), CONSTRAINT pk_location PRIMARY KEY(backend, path))"); err == nil {
 		stmt.Exec()
@@ -27,21 +31,31 @@ func init() {
 		stmt.Exec()
 	}
 
-	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS Verification(key VARCHAR(512), code VARCHAR(4), expire DATETIME DEFAULT (datetime('now', '+10 minutes')))"); err == nil {
+	// the items of the collections, they're bound to a location like the links themselves
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ShareLocation(share VARCHAR(64) NOT NULL, backend VARCHAR(16) NOT NULL, path VARCHAR(512) NOT NULL, PRIMARY KEY(share, path), FOREIGN KEY (share) REFERENCES Share(id) ON UPDATE CASCADE ON DELETE CASCADE, FOREIGN KEY (backend, path) REFERENCES Location(backend, path) ON UPDATE CASCADE ON DELETE CASCADE)"); err == nil {
 		stmt.Exec()
-		if stmt, err = DB.Prepare("CREATE INDEX idx_verification ON Verification(code, expire)"); err == nil {
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_sharelocation ON ShareLocation(backend, path)"); err == nil {
 			stmt.Exec()
 		}
 	}
 
-	go func() {
-		autovacuum()
-	}()
-}
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ShareCounter(share VARCHAR(64) PRIMARY KEY, visits INTEGER NOT NULL DEFAULT 0, downloads INTEGER NOT NULL DEFAULT 0, FOREIGN KEY (share) REFERENCES Share(id) ON UPDATE CASCADE ON DELETE CASCADE)"); err == nil {
+		stmt.Exec()
+	}
 
-func autovacuum() {
-	if stmt, err := DB.Prepare("DELETE FROM Verification WHERE expire < datetime('now')"); err == nil {
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ShareTotp(share VARCHAR(64) PRIMARY KEY, last_step INTEGER NOT NULL, FOREIGN KEY (share) REFERENCES Share(id) ON UPDATE CASCADE ON DELETE CASCADE)"); err == nil {
+		stmt.Exec()
+	}
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ShareVerification(id VARCHAR(32) PRIMARY KEY, share VARCHAR(64) NOT NULL, email VARCHAR(512) NOT NULL, code VARCHAR(16) NOT NULL, attempts INTEGER NOT NULL DEFAULT 0, expire INTEGER NOT NULL, FOREIGN KEY (share) REFERENCES Share(id) ON UPDATE CASCADE ON DELETE CASCADE)"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_shareverification ON ShareVerification(share, email)"); err == nil {
+			stmt.Exec()
+		}
+	}
+	// the codes of the Verification table weren't bound to a link and only lasted 10 minutes, the
+	// ShareVerification table took over
+	if stmt, err := DB.Prepare("DROP TABLE IF EXISTS Verification"); err == nil {
 		stmt.Exec()
 	}
-	time.Sleep(6 * time.Hour)
 }
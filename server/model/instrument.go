@@ -0,0 +1,104 @@
+package model
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var backendLog = Log.Subsystem("backend")
+
+// instrumentedBackend decorates the backends created through NewBackend to keep track of how long
+// they take and how often they fail. Every call is logged, traced and measured against the request
+// which created the backend
+type instrumentedBackend struct {
+	IBackend
+	kind    string
+	request string
+	ctx     context.Context
+}
+
+func (b instrumentedBackend) Unwrap() IBackend {
+	return b.IBackend
+}
+
+// backendWithContext attaches the operations made onto a backend to another trace. It is used by
+// the processes outliving the request that created the backend, like the search indexers
+func backendWithContext(b IBackend, ctx context.Context) IBackend {
+	if ib, ok := b.(instrumentedBackend); ok {
+		ib.ctx = ctx
+		return ib
+	}
+	return b
+}
+
+func (b instrumentedBackend) observe(operation string, path string) func(error) {
+	start := time.Now()
+	_, span := StartSpan(
+		b.ctx, "backend."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("filestash.backend", b.kind),
+			attribute.String("filestash.path", path),
+		),
+	)
+	return func(err error) {
+		duration := time.Since(start)
+		MetricBackendDuration.WithLabelValues(b.kind, operation).Observe(duration.Seconds())
+		SpanError(span, err)
+		span.End()
+		if err != nil {
+			MetricBackendErrors.WithLabelValues(b.kind, operation).Inc()
+			backendLog.Request(b.request).Debug("%s %s %s %.1fms err=%s", b.kind, operation, path, float64(duration)/float64(time.Millisecond), err.Error())
+			return
+		}
+		backendLog.Request(b.request).Debug("%s %s %s %.1fms", b.kind, operation, path, float64(duration)/float64(time.Millisecond))
+	}
+}
+
+func (b instrumentedBackend) Ls(path string) (files []os.FileInfo, err error) {
+	done := b.observe("ls", path)
+	defer func() { done(err) }()
+	return b.IBackend.Ls(path)
+}
+
+func (b instrumentedBackend) Cat(path string) (r io.ReadCloser, err error) {
+	done := b.observe("cat", path)
+	defer func() { done(err) }()
+	return b.IBackend.Cat(path)
+}
+
+func (b instrumentedBackend) Mkdir(path string) (err error) {
+	done := b.observe("mkdir", path)
+	defer func() { done(err) }()
+	return b.IBackend.Mkdir(path)
+}
+
+func (b instrumentedBackend) Rm(path string) (err error) {
+	done := b.observe("rm", path)
+	defer func() { done(err) }()
+	return b.IBackend.Rm(path)
+}
+
+func (b instrumentedBackend) Mv(from string, to string) (err error) {
+	done := b.observe("mv", from+" -> "+to)
+	defer func() { done(err) }()
+	return b.IBackend.Mv(from, to)
+}
+
+func (b instrumentedBackend) Save(path string, file io.Reader) (err error) {
+	done := b.observe("save", path)
+	defer func() { done(err) }()
+	return b.IBackend.Save(path, file)
+}
+
+func (b instrumentedBackend) Touch(path string) (err error) {
+	done := b.observe("touch", path)
+	defer func() { done(err) }()
+	return b.IBackend.Touch(path)
+}
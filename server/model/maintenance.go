@@ -0,0 +1,136 @@
+package model
+
+import (
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+const (
+	MaintenanceInterval = 6 * time.Hour
+	// uploads are reserved before the file gets transferred, a reservation older than that is left
+	// over from an upload that never completed and would hold onto the limits of the link
+	maintenanceUploadTimeout = 24 * time.Hour
+)
+
+// maintenanceTask cleans up a part of the database, it gives the number of rows it removed
+type maintenanceTask struct {
+	Name string
+	Run  func() (int64, error)
+}
+
+var (
+	maintenanceLog   = Log.Subsystem("maintenance")
+	maintenanceTasks = []maintenanceTask{
+		{"verification", maintenanceVerification},
+		{"share", maintenanceShare},
+		{"activity", maintenanceActivity},
+		{"upload", maintenanceUpload},
+		{"location", maintenanceLocation},
+		{"audit", maintenanceAudit},
+		{"vacuum", maintenanceVacuum},
+	}
+)
+
+func init() {
+	go func() {
+		// the first run waits for the rest of the application to be up
+		time.Sleep(time.Minute)
+		for {
+			maintenance()
+			time.Sleep(MaintenanceInterval)
+		}
+	}()
+}
+
+// maintenance runs every task one after the other. The order matters: removing the shares first lets
+// the locations they were pointing at be pruned in the same run and the vacuum reclaim all that space
+func maintenance() {
+	start := time.Now()
+	var total int64
+	for _, task := range maintenanceTasks {
+		t := time.Now()
+		n, err := task.Run()
+		if err != nil {
+			MetricMaintenanceRuns.WithLabelValues(task.Name, "error").Inc()
+			maintenanceLog.Error("task %s failed %s", task.Name, err.Error())
+			continue
+		}
+		MetricMaintenanceRuns.WithLabelValues(task.Name, "ok").Inc()
+		MetricMaintenanceRemoved.WithLabelValues(task.Name).Add(float64(n))
+		MetricMaintenanceLastRun.WithLabelValues(task.Name).SetToCurrentTime()
+		maintenanceLog.Debug("task %s removed %d rows in %s", task.Name, n, time.Since(t))
+		total += n
+	}
+	maintenanceLog.Info("database cleaned up, %d rows removed in %s", total, time.Since(start).Round(time.Millisecond))
+}
+
+func maintenanceVerification() (int64, error) {
+	return maintenanceExec("DELETE FROM ShareVerification WHERE expire < ?", time.Now().UnixNano()/1000000)
+}
+
+// maintenanceShare removes the links which have expired or self destructed longer than the grace period
+// ago. Until then, people who open them are told the link is no longer available rather than not found
+func maintenanceShare() (int64, error) {
+	days := Config.Get("features.share.purge_after").Int()
+	if days <= 0 {
+		return 0, nil
+	}
+	before := time.Now().Add(-time.Duration(days)*24*time.Hour).UnixNano() / 1000000
+	return maintenanceExec(
+		"DELETE FROM Share WHERE "+
+			"(json_extract(params, '$.expire') IS NOT NULL AND json_extract(params, '$.expire') < ?1) OR "+
+			"(auth = '' AND COALESCE((SELECT MAX(time) FROM ShareActivity WHERE share = Share.id), 0) < ?1)",
+		before,
+	)
+}
+
+func maintenanceActivity() (int64, error) {
+	days := Config.Get("features.share.activity_retention").Int()
+	if days <= 0 {
+		return 0, nil
+	}
+	before := time.Now().Add(-time.Duration(days)*24*time.Hour).UnixNano() / 1000000
+	return maintenanceExec("DELETE FROM ShareActivity WHERE time < ?", before)
+}
+
+func maintenanceUpload() (int64, error) {
+	before := time.Now().Add(-maintenanceUploadTimeout).UnixNano() / 1000000
+	return maintenanceExec("DELETE FROM ShareUpload WHERE done = 0 AND time < ?", before)
+}
+
+// maintenanceLocation prunes the locations no shared link nor collection refers to anymore
+func maintenanceLocation() (int64, error) {
+	return maintenanceExec(
+		"DELETE FROM Location WHERE " +
+			"NOT EXISTS (SELECT 1 FROM Share WHERE Share.related_backend = Location.backend AND Share.related_path = Location.path) AND " +
+			"NOT EXISTS (SELECT 1 FROM ShareLocation WHERE ShareLocation.backend = Location.backend AND ShareLocation.path = Location.path)",
+	)
+}
+
+// maintenanceAudit lets go of the oldest entries of the audit log. Entries can only be removed from the
+// start of the chain, the rest of it remains verifiable
+func maintenanceAudit() (int64, error) {
+	days := Config.Get("log.audit_retention").Int()
+	if days <= 0 {
+		return 0, nil
+	}
+	before := time.Now().Add(-time.Duration(days)*24*time.Hour).UnixNano() / 1000000
+	return maintenanceExec("DELETE FROM AuditLog WHERE id <= (SELECT MAX(id) FROM AuditLog WHERE time < ?)", before)
+}
+
+func maintenanceVacuum() (int64, error) {
+	if _, err := DB.Exec("VACUUM"); err != nil {
+		return 0, err
+	}
+	_, err := DB.Exec("ANALYZE")
+	return 0, err
+}
+
+func maintenanceExec(query string, args ...interface{}) (int64, error) {
+	r, err := DB.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
@@ -0,0 +1,47 @@
+package model
+
+import (
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	MetricsRegistry.MustRegister(searchCollector{})
+}
+
+// searchCollector reports the state of the search indexers at the time of the scrape
+type searchCollector struct{}
+
+var (
+	searchQueueDesc = prometheus.NewDesc(
+		"filestash_search_indexer_queue",
+		"Number of folders waiting to be explored by a search indexer",
+		[]string{"indexer"}, nil,
+	)
+	searchPhaseDesc = prometheus.NewDesc(
+		"filestash_search_indexer_phase",
+		"Phase a search indexer is currently in, the active phase has a value of 1",
+		[]string{"indexer", "phase"}, nil,
+	)
+)
+
+func (c searchCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- searchQueueDesc
+	ch <- searchPhaseDesc
+}
+
+func (c searchCollector) Collect(ch chan<- prometheus.Metric) {
+	SProc.mu.RLock()
+	defer SProc.mu.RUnlock()
+	for i := range SProc.idx {
+		s := &SProc.idx[i]
+		ch <- prometheus.MustNewConstMetric(searchQueueDesc, prometheus.GaugeValue, float64(s.FoldersUnknown.Len()), s.Id)
+		for _, phase := range []string{PhaseExplore, PhaseIndexing, PhaseMaintain, PhasePause} {
+			v := 0.0
+			if s.CurrentPhase == phase {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(searchPhaseDesc, prometheus.GaugeValue, v, s.Id, phase)
+		}
+	}
+}
@@ -4,30 +4,45 @@ import (
 	. "github.com/bingoohuang/filestash/server/common"
 )
 
-func CanRead(ctx *App) bool {
-	if ctx.Share.Id != "" {
-		return ctx.Share.CanRead
+func CanRead(ctx *App, path string) bool {
+	if ctx.Share.Id != "" && !ctx.Share.CanRead {
+		return false
 	}
-	return true
+	if ctx.Share.Collection && !shareCollectionContains(ctx.Share, path) {
+		return false
+	}
+	if ctx.Token.Id != "" && !ctx.Token.CanRead {
+		return false
+	}
+	return userCan(ctx, path, PermRead)
 }
 
-func CanEdit(ctx *App) bool {
-	if ctx.Share.Id != "" {
-		return ctx.Share.CanWrite
+func CanEdit(ctx *App, path string) bool {
+	if ctx.Share.Id != "" && !ctx.Share.CanWrite {
+		return false
+	}
+	if ctx.Token.Id != "" && !ctx.Token.CanWrite {
+		return false
 	}
-	return true
+	return userCan(ctx, path, PermEdit)
 }
 
-func CanUpload(ctx *App) bool {
-	if ctx.Share.Id != "" {
-		return ctx.Share.CanUpload
+func CanUpload(ctx *App, path string) bool {
+	if ctx.Share.Id != "" && !ctx.Share.CanUpload {
+		return false
 	}
-	return true
+	if ctx.Token.Id != "" && !ctx.Token.CanUpload {
+		return false
+	}
+	return userCan(ctx, path, PermUpload)
 }
 
-func CanShare(ctx *App) bool {
-	if ctx.Share.Id != "" {
-		return ctx.Share.CanShare
+func CanShare(ctx *App, path string) bool {
+	if ctx.Share.Id != "" && (!ctx.Share.CanShare || !Config.Get("features.share.allow_reshare").Bool()) {
+		return false
+	}
+	if ctx.Token.Id != "" && !ctx.Token.CanShare {
+		return false
 	}
-	return true
+	return userCan(ctx, path, PermShare)
 }
@@ -2,12 +2,15 @@ package model
 
 import (
 	"container/heap"
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"fmt"
 	. "github.com/bingoohuang/filestash/server/common"
 	"github.com/bingoohuang/filestash/server/model/formater"
 	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"hash/fnv"
 	"io/ioutil"
 	"os"
@@ -16,6 +19,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,6 +43,8 @@ var (
 	IndexingExclusion = []string{"/node_modules/", "/bower_components/", "/.cache/", "/.npm/", "/.git/"}
 )
 
+var searchLog = Log.Subsystem("search")
+
 var SProc = SearchProcess{
 	idx: make([]SearchIndexer, 0),
 	n:   -1,
@@ -223,7 +229,7 @@ func SearchStateful(app *App, path string, keyword string) []File {
 		f := File{}
 		var t string
 		if err = rows.Scan(&f.FType, &f.FPath, &f.FSize, &t); err != nil {
-			Log.Warning("search::find search_error (%v)", err)
+			searchLog.Warning("search::find search_error (%v)", err)
 			return files
 		}
 		if tm, err := time.Parse(time.RFC3339, t); err == nil {
@@ -352,6 +358,7 @@ type SearchIndexer struct {
 	DB             *sql.DB
 	mu             sync.Mutex
 	lastHash       string
+	busySince      int64
 }
 
 func NewSearchIndexer(id string, b IBackend) SearchIndexer {
@@ -365,20 +372,20 @@ func NewSearchIndexer(id string, b IBackend) SearchIndexer {
 
 	db, err := sql.Open("sqlite3", s.DBPath+"?_journal_mode=wal")
 	if err != nil {
-		Log.Warning("search::init can't open database (%v)", err)
+		searchLog.Warning("search::init can't open database (%v)", err)
 		return s
 	}
 	s.DB = db
 	queryDB := func(sqlQuery string) error {
 		stmt, err := db.Prepare(sqlQuery)
 		if err != nil {
-			Log.Warning("search::initschema prepare schema error(%v)", err)
+			searchLog.Warning("search::initschema prepare schema error(%v)", err)
 			return err
 		}
 		defer stmt.Close()
 		_, err = stmt.Exec()
 		if err != nil {
-			Log.Warning("search::initschema execute error(%v)", err)
+			searchLog.Warning("search::initschema execute error(%v)", err)
 			return err
 		}
 		return err
@@ -407,22 +414,82 @@ func NewSearchIndexer(id string, b IBackend) SearchIndexer {
 	return s
 }
 
+// SearchIndexerStuck gives the indexers which have been busy on the same cycle for longer than the
+// given duration
+func SearchIndexerStuck(d time.Duration) []string {
+	stuck := []string{}
+	SProc.mu.RLock()
+	defer SProc.mu.RUnlock()
+	for i := range SProc.idx {
+		since := atomic.LoadInt64(&SProc.idx[i].busySince)
+		if since != 0 && time.Since(time.Unix(0, since)) > d {
+			stuck = append(stuck, SProc.idx[i].Id)
+		}
+	}
+	return stuck
+}
+
+// SearchIndexReset makes the indexers go through the content of every file again, all of them or only
+// the one of the given backend. With full, the index is emptied and gets built from scratch as users
+// browse around. It gives back the ID of the indexes that were reset
+func SearchIndexReset(id string, full bool) ([]string, error) {
+	pattern := "fts_*.sql"
+	if id != "" {
+		pattern = "fts_" + id + ".sql"
+	}
+	files, err := filepath.Glob(filepath.Join(GetCurrentDir(), FtsPath, pattern))
+	if err != nil {
+		return nil, err
+	}
+	query := "UPDATE file SET indexTime = NULL"
+	if full {
+		query = "DELETE FROM file"
+	}
+	reset := []string{}
+	for _, file := range files {
+		db, err := sql.Open("sqlite3", file+"?_journal_mode=wal")
+		if err != nil {
+			return reset, err
+		}
+		_, err = db.Exec(query)
+		db.Close()
+		if err != nil {
+			return reset, err
+		}
+		reset = append(reset, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "fts_"), ".sql"))
+	}
+	if id != "" && len(reset) == 0 {
+		return reset, ErrNotFound
+	}
+	return reset, nil
+}
+
 func (s *SearchIndexer) Execute() {
+	atomic.StoreInt64(&s.busySince, time.Now().UnixNano())
+	defer atomic.StoreInt64(&s.busySince, 0)
 	if s.CurrentPhase == "" {
 		time.Sleep(1 * time.Second)
 		s.CurrentPhase = PhaseExplore
 	}
-	Log.Debug("Search::indexing Execute %s", s.CurrentPhase)
+	searchLog.Debug("Search::indexing Execute %s", s.CurrentPhase)
+
+	cycleExecute := func(fn func(IBackend, *sql.Tx) bool) {
+		ctx, span := StartSpan(
+			context.Background(), "search."+strings.ToLower(strings.TrimPrefix(s.CurrentPhase, "PHASE_")),
+			trace.WithAttributes(attribute.String("filestash.indexer", s.Id)),
+		)
+		defer span.End()
+		// the indexer is shared with the search requests, the traced backend only lives for this cycle
+		backend := backendWithContext(s.Backend, ctx)
 
-	cycleExecute := func(fn func(*sql.Tx) bool) {
 		stopTime := time.Now().Add(time.Duration(CycleTime()) * time.Second)
 		tx, err := s.DB.Begin()
 		if err != nil {
-			Log.Warning("search::index cycle_begin (%+v)", err)
+			searchLog.Warning("search::index cycle_begin (%+v)", err)
 			time.Sleep(5 * time.Second)
 		}
 		for {
-			if !fn(tx) {
+			if !fn(backend, tx) {
 				break
 			}
 			if !stopTime.After(time.Now()) {
@@ -430,7 +497,7 @@ func (s *SearchIndexer) Execute() {
 			}
 		}
 		if err = tx.Commit(); err != nil {
-			Log.Warning("search::index cycle_commit (%+v)", err)
+			searchLog.Warning("search::index cycle_commit (%+v)", err)
 		}
 	}
 	if s.CurrentPhase == PhaseExplore {
@@ -449,7 +516,7 @@ func (s *SearchIndexer) Execute() {
 	return
 }
 
-func (s *SearchIndexer) Discover(tx *sql.Tx) bool {
+func (s *SearchIndexer) Discover(backend IBackend, tx *sql.Tx) bool {
 	if s.FoldersUnknown.Len() == 0 {
 		s.CurrentPhase = PhaseIndexing
 		return false
@@ -460,7 +527,7 @@ func (s *SearchIndexer) Discover(tx *sql.Tx) bool {
 		s.CurrentPhase = PhaseIndexing
 		return false
 	}
-	files, err := s.Backend.Ls(doc.Path)
+	files, err := backend.Ls(doc.Path)
 	if err != nil {
 		s.CurrentPhase = ""
 		return true
@@ -509,25 +576,25 @@ func (s *SearchIndexer) Discover(tx *sql.Tx) bool {
 					var t string
 					var err error
 					if err := tx.QueryRow("SELECT indexTime FROM file WHERE path = ?", p).Scan(&t); err != nil {
-						Log.Warning("search::discovery unknown_path (%v)", err)
+						searchLog.Warning("search::discovery unknown_path (%v)", err)
 						return false
 					}
 					tm, err := time.Parse(time.RFC3339, t)
 					if err != nil {
-						Log.Warning("search::discovery invalid_time (%v)", err)
+						searchLog.Warning("search::discovery invalid_time (%v)", err)
 						return false
 					}
 					if time.Now().Add(time.Duration(-SearchReindex()) * time.Hour).Before(tm) {
 						return false
 					}
 					if _, err = tx.Exec("UPDATE file SET indexTime = ? WHERE path = ?", time.Now(), p); err != nil {
-						Log.Warning("search::discovery insertion_failed (%v)", err)
+						searchLog.Warning("search::discovery insertion_failed (%v)", err)
 						return false
 					}
 					return true
 				}(p)
 			} else {
-				Log.Error("search::indexing insert_index (%v)", err)
+				searchLog.Error("search::indexing insert_index (%v)", err)
 			}
 			if performPush {
 				heap.Push(&s.FoldersUnknown, &Document{
@@ -544,7 +611,7 @@ func (s *SearchIndexer) Discover(tx *sql.Tx) bool {
 				if e, ok := err.(sqlite3.Error); ok && e.Code == sqlite3.ErrConstraint {
 					return false
 				}
-				Log.Warning("search::insert index_error (%v)", err)
+				searchLog.Warning("search::insert index_error (%v)", err)
 				return false
 			}
 		}
@@ -552,7 +619,7 @@ func (s *SearchIndexer) Discover(tx *sql.Tx) bool {
 	return true
 }
 
-func (s *SearchIndexer) Indexing(tx *sql.Tx) bool {
+func (s *SearchIndexer) Indexing(backend IBackend, tx *sql.Tx) bool {
 	ext := strings.Split(IndexingExt(), ",")
 	for i := 0; i < len(ext); i++ {
 		ext[i] = "'" + strings.TrimSpace(ext[i]) + "'"
@@ -565,7 +632,7 @@ func (s *SearchIndexer) Indexing(tx *sql.Tx) bool {
 		MaxIndexingFsize(),
 	)
 	if err != nil {
-		Log.Warning("search::insert index_query (%v)", err)
+		searchLog.Warning("search::insert index_query (%v)", err)
 		return false
 	}
 	defer rows.Close()
@@ -574,11 +641,11 @@ func (s *SearchIndexer) Indexing(tx *sql.Tx) bool {
 		i += 1
 		var path string
 		if err = rows.Scan(&path); err != nil {
-			Log.Warning("search::indexing index_scan (%v)", err)
+			searchLog.Warning("search::indexing index_scan (%v)", err)
 			return false
 		}
-		if err = s.updateFile(path, tx); err != nil {
-			Log.Warning("search::indexing index_update (%v)", err)
+		if err = s.updateFile(backend, path, tx); err != nil {
+			searchLog.Warning("search::indexing index_update (%v)", err)
 			return false
 		}
 	}
@@ -590,7 +657,7 @@ func (s *SearchIndexer) Indexing(tx *sql.Tx) bool {
 	return true
 }
 
-func (s *SearchIndexer) updateFile(path string, tx *sql.Tx) error {
+func (s *SearchIndexer) updateFile(backend IBackend, path string, tx *sql.Tx) error {
 	if _, err := tx.Exec("UPDATE file SET indexTime = ? WHERE path = ?", time.Now(), path); err != nil {
 		return err
 	}
@@ -601,7 +668,7 @@ func (s *SearchIndexer) updateFile(path string, tx *sql.Tx) error {
 		}
 	}
 
-	reader, err := s.Backend.Cat(path)
+	reader, err := backend.Cat(path)
 	if err != nil {
 		if _, a := tx.Exec("DELETE FROM file WHERE path = ?", path); a != nil {
 			return a
@@ -638,17 +705,17 @@ func (s *SearchIndexer) updateFile(path string, tx *sql.Tx) error {
 	}
 	var content []byte
 	if content, err = ioutil.ReadAll(reader); err != nil {
-		Log.Warning("search::index content_read (%v)", err)
+		searchLog.Warning("search::index content_read (%v)", err)
 		return nil
 	}
 	if _, err = tx.Exec("UPDATE file_index SET content = ? WHERE path = ?", content, path); err != nil {
-		Log.Warning("search::index index_update (%v)", err)
+		searchLog.Warning("search::index index_update (%v)", err)
 		return err
 	}
 	return nil
 }
 
-func (s *SearchIndexer) updateFolder(path string, tx *sql.Tx) error {
+func (s *SearchIndexer) updateFolder(backend IBackend, path string, tx *sql.Tx) error {
 	if _, err := tx.Exec("UPDATE file SET indexTime = ? WHERE path = ?", time.Now(), path); err != nil {
 		return err
 	}
@@ -660,7 +727,7 @@ func (s *SearchIndexer) updateFolder(path string, tx *sql.Tx) error {
 	}
 
 	// Fetch list of folders as in the remote filesystem
-	currFiles, err := s.Backend.Ls(path)
+	currFiles, err := backend.Ls(path)
 	if err != nil {
 		tx.Exec("DELETE FROM file WHERE path >= ? AND path < ?", path, path+"~")
 		return err
@@ -718,7 +785,7 @@ func (s *SearchIndexer) updateFolder(path string, tx *sql.Tx) error {
 	return nil
 }
 
-func (s *SearchIndexer) Consolidate(tx *sql.Tx) bool {
+func (s *SearchIndexer) Consolidate(backend IBackend, tx *sql.Tx) bool {
 	rows, err := tx.Query(
 		"SELECT path, type FROM file WHERE indexTime < ? ORDER BY indexTime DESC LIMIT 5",
 		time.Now().Add(-time.Duration(SearchReindex())*time.Hour),
@@ -738,13 +805,13 @@ func (s *SearchIndexer) Consolidate(tx *sql.Tx) bool {
 		var path string
 		var cType string
 		if err = rows.Scan(&path, &cType); err != nil {
-			Log.Warning("search::index db_stale (%v)", err)
+			searchLog.Warning("search::index db_stale (%v)", err)
 			return false
 		}
 		if cType == "directory" {
-			s.updateFolder(path, tx)
+			s.updateFolder(backend, path, tx)
 		} else {
-			s.updateFile(path, tx)
+			s.updateFile(backend, path, tx)
 		}
 	}
 	if i == 0 {
@@ -0,0 +1,301 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/tidwall/sjson"
+)
+
+// SecretRotation sums up what was carried over to the new keys and what had to go
+type SecretRotation struct {
+	Shares          int `json:"shares"`
+	Tokens          int `json:"tokens"`
+	Sessions        int `json:"sessions"`
+	ConfigVersions  int `json:"config_versions"`
+	RevokedTokens   int `json:"revoked_tokens"`
+	RevokedSessions int `json:"revoked_sessions"`
+}
+
+// SecretKeyRotate replaces the secret key the derivatives from InitSecretDerivate come from. What
+// was encrypted with the old derivatives gets re-encrypted and backends are given the ID they have
+// under the new key so that shared links and API tokens keep working. Only the tokens and server side
+// sessions that couldn't be decrypted in the first place are revoked
+func SecretKeyRotate(author string) (SecretRotation, error) {
+	var r SecretRotation
+	if os.Getenv(ConfigEnvName("general.secret_key")) != "" {
+		return r, NewError("The secret key is set from the environment", 400)
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	type share struct {
+		id      string
+		backend string
+		session string
+		params  string
+		totp    string
+	}
+	oldUser, oldProof, oldAdmin := SecretKeyDerivateForUser, SecretKeyDerivateForProof, SecretKeyDerivateForAdmin
+	shares := []share{}
+	rows, err := DB.Query("SELECT id, related_backend, params, auth FROM Share")
+	if err != nil {
+		return r, err
+	}
+	for rows.Next() {
+		var s share
+		var params sql.NullString
+		var auth string
+		if err := rows.Scan(&s.id, &s.backend, &params, &auth); err != nil {
+			rows.Close()
+			return r, err
+		}
+		if auth == "" {
+			// one shot links that have self destructed, there's nothing left to encrypt
+			continue
+		}
+		if s.session, err = DecryptString(oldUser, auth); err != nil {
+			// those were already broken, nothing we can do to save them
+			Log.Warning("model::secret share '%s' can't be decrypted", s.id)
+			continue
+		}
+		s.params = params.String
+		var p map[string]interface{}
+		json.Unmarshal([]byte(s.params), &p)
+		if totp := NewStringFromInterface(p["totp"]); totp != "" {
+			if s.totp, err = DecryptString(oldProof, totp); err != nil {
+				Log.Warning("model::secret totp of share '%s' can't be decrypted", s.id)
+			}
+		}
+		shares = append(shares, s)
+	}
+	rows.Close()
+	tokens, revokedTokens, err := secretDecryptAll("SELECT id, auth FROM ApiToken", oldUser)
+	if err != nil {
+		return r, err
+	}
+	sessions, revokedSessions, err := secretDecryptAll("SELECT id, auth FROM UserSession", oldUser)
+	if err != nil {
+		return r, err
+	}
+	var adminTotp string
+	if err := DB.QueryRow("SELECT secret FROM AdminTotp WHERE id = 1").Scan(&adminTotp); err == nil {
+		if adminTotp, err = DecryptString(oldAdmin, adminTotp); err != nil {
+			adminTotp = ""
+		}
+	} else if err != sql.ErrNoRows {
+		return r, err
+	}
+	history, err := configHistoryOpen()
+	if err != nil {
+		return r, err
+	}
+	// the audit log stays verifiable as long as its key is carried over
+	audit, err := auditKey()
+	if err != nil {
+		return r, err
+	}
+
+	oldSecret, newSecret := SecretKey, RandomString(16)
+	InitSecretDerivate(newSecret)
+	rollback := func(tx *sql.Tx, err error) (SecretRotation, error) {
+		tx.Rollback()
+		InitSecretDerivate(oldSecret)
+		return SecretRotation{}, err
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		InitSecretDerivate(oldSecret)
+		return r, err
+	}
+	backends := make(map[string]string)
+	for _, s := range shares {
+		auth, err := EncryptString(SecretKeyDerivateForUser, s.session)
+		if err != nil {
+			return rollback(tx, err)
+		}
+		if s.totp != "" {
+			var p map[string]interface{}
+			json.Unmarshal([]byte(s.params), &p)
+			if p["totp"], err = EncryptString(SecretKeyDerivateForProof, s.totp); err != nil {
+				return rollback(tx, err)
+			}
+			b, _ := json.Marshal(p)
+			s.params = string(b)
+		}
+		if _, err := tx.Exec("UPDATE Share SET params = ?, auth = ? WHERE id = ?", s.params, auth, s.id); err != nil {
+			return rollback(tx, err)
+		}
+		var session map[string]string
+		json.Unmarshal([]byte(s.session), &session)
+		backends[s.backend] = GenerateID(&App{Session: session})
+		r.Shares += 1
+	}
+	// shares follow their location through the foreign key
+	for from, to := range backends {
+		if _, err := tx.Exec("UPDATE Location SET backend = ? WHERE backend = ?", to, from); err != nil {
+			return rollback(tx, err)
+		}
+	}
+	for id, session := range tokens {
+		auth, err := EncryptString(SecretKeyDerivateForUser, session)
+		if err != nil {
+			return rollback(tx, err)
+		}
+		var params map[string]string
+		json.Unmarshal([]byte(session), &params)
+		if _, err := tx.Exec("UPDATE ApiToken SET auth = ?, related_backend = ? WHERE id = ?", auth, GenerateID(&App{Session: params}), id); err != nil {
+			return rollback(tx, err)
+		}
+		r.Tokens += 1
+	}
+	for id, session := range sessions {
+		auth, err := EncryptString(SecretKeyDerivateForUser, session)
+		if err != nil {
+			return rollback(tx, err)
+		}
+		if _, err := tx.Exec("UPDATE UserSession SET auth = ? WHERE id = ?", auth, id); err != nil {
+			return rollback(tx, err)
+		}
+		r.Sessions += 1
+	}
+	for _, id := range revokedTokens {
+		if _, err := tx.Exec("DELETE FROM ApiToken WHERE id = ?", id); err != nil {
+			return rollback(tx, err)
+		}
+		r.RevokedTokens += 1
+	}
+	for _, id := range revokedSessions {
+		if _, err := tx.Exec("DELETE FROM UserSession WHERE id = ?", id); err != nil {
+			return rollback(tx, err)
+		}
+		r.RevokedSessions += 1
+	}
+	if adminTotp != "" {
+		encrypted, err := EncryptString(SecretKeyDerivateForAdmin, adminTotp)
+		if err != nil {
+			return rollback(tx, err)
+		}
+		if _, err := tx.Exec("UPDATE AdminTotp SET secret = ? WHERE id = 1", encrypted); err != nil {
+			return rollback(tx, err)
+		}
+	}
+	encrypted, err := EncryptString(SecretKeyDerivateForAudit, string(audit))
+	if err != nil {
+		return rollback(tx, err)
+	}
+	if _, err := tx.Exec("UPDATE AuditKey SET key = ? WHERE id = 1", encrypted); err != nil {
+		return rollback(tx, err)
+	}
+	// signed URLs stop working with the old key anyway and the sessions they hold can't be read anymore
+	if _, err = tx.Exec("DELETE FROM SignedUrlKey"); err != nil {
+		return rollback(tx, err)
+	}
+	// rolling back the config to an old version shouldn't bring back the old key
+	for id, content := range history {
+		content, _ = sjson.SetBytes(content, "general.secret_key", newSecret)
+		if err := configHistoryUpdate(tx, id, content); err != nil {
+			return rollback(tx, err)
+		}
+		r.ConfigVersions += 1
+	}
+	if err := tx.Commit(); err != nil {
+		InitSecretDerivate(oldSecret)
+		return SecretRotation{}, err
+	}
+	Config.Get("general.secret_key").Set(newSecret)
+	configRecordLocked(author)
+	return r, nil
+}
+
+// secretDecryptAll decrypts the auth column of a table, giving back what could be decrypted by id and
+// the ids of the rows that couldn't
+func secretDecryptAll(query string, key string) (map[string]string, []string, error) {
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	plain := make(map[string]string)
+	broken := []string{}
+	for rows.Next() {
+		var id, auth string
+		if err := rows.Scan(&id, &auth); err != nil {
+			return nil, nil, err
+		}
+		str, err := DecryptString(key, auth)
+		if err != nil {
+			broken = append(broken, id)
+			continue
+		}
+		plain[id] = str
+	}
+	return plain, broken, nil
+}
+
+// MasterKeyRotate encrypts the config and all its versions with a new master key
+func MasterKeyRotate(key string, author string) (SecretRotation, error) {
+	var r SecretRotation
+	configMu.Lock()
+	defer configMu.Unlock()
+	history, err := configHistoryOpen()
+	if err != nil {
+		return r, err
+	}
+	previous := ConfigMasterKeySet(key)
+	tx, err := DB.Begin()
+	if err != nil {
+		ConfigMasterKeySet(previous)
+		return r, err
+	}
+	for id, content := range history {
+		if err := configHistoryUpdate(tx, id, content); err != nil {
+			tx.Rollback()
+			ConfigMasterKeySet(previous)
+			return SecretRotation{}, err
+		}
+		r.ConfigVersions += 1
+	}
+	if err := tx.Commit(); err != nil {
+		ConfigMasterKeySet(previous)
+		return SecretRotation{}, err
+	}
+	Config.Save()
+	configRecordLocked(author)
+	return r, nil
+}
+
+// configHistoryOpen gives all the versions of the config in plain text
+func configHistoryOpen() (map[int64][]byte, error) {
+	rows, err := DB.Query("SELECT id, content FROM ConfigHistory")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := make(map[int64][]byte)
+	for rows.Next() {
+		var id int64
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			return nil, err
+		}
+		b, err := ConfigOpen([]byte(content))
+		if err != nil {
+			return nil, NewError(fmt.Sprintf("Config version %d: %s", id, err.Error()), 500)
+		}
+		history[id] = b
+	}
+	return history, rows.Err()
+}
+
+func configHistoryUpdate(tx *sql.Tx, id int64, content []byte) error {
+	content = Config.Seal(content)
+	_, err := tx.Exec(
+		"UPDATE ConfigHistory SET content = ?, hash = ? WHERE id = ?",
+		string(content), Hash(string(content), 32), id,
+	)
+	return err
+}
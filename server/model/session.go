@@ -0,0 +1,201 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+var (
+	SessionServerSide  func() bool
+	SessionIdleTimeout func() time.Duration
+	SessionMaxAge      func() time.Duration
+)
+
+// UserSession is what the admin gets to see about a session kept on the server side. The id is a
+// hash of what's stored in the cookie so that it can't be used to impersonate anyone.
+type UserSession struct {
+	Id        string `json:"id"`
+	Identity  string `json:"identity,omitempty"`
+	Type      string `json:"type"`
+	Ip        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Created   int64  `json:"created"`
+	LastSeen  int64  `json:"last_seen"`
+}
+
+func init() {
+	SessionServerSide = func() bool {
+		return Config.Get("auth.session.server_side").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "server_side"
+			f.Type = "enable"
+			f.Target = []string{"session_idle_timeout", "session_max_age"}
+			f.Description = `Keep the sessions on the server instead of inside the cookie. The cookie then only holds
+ an opaque identifier, sessions can be revoked from the admin console and credentials don't travel anymore`
+			f.Default = false
+			return f
+		}).Bool()
+	}
+	SessionServerSide()
+	SessionIdleTimeout = func() time.Duration {
+		return time.Duration(Config.Get("auth.session.idle_timeout").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "session_idle_timeout"
+			f.Name = "idle_timeout"
+			f.Type = "number"
+			f.Default = 120
+			f.Description = "Inactivity after which a session expires, in minutes"
+			f.Placeholder = "Default: 120"
+			return f
+		}).Int()) * time.Minute
+	}
+	SessionIdleTimeout()
+	SessionMaxAge = func() time.Duration {
+		return time.Duration(Config.Get("auth.session.max_age").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "session_max_age"
+			f.Name = "max_age"
+			f.Type = "number"
+			f.Default = 720
+			f.Description = "Time after which a session expires no matter what, in hours"
+			f.Placeholder = "Default: 720"
+			return f
+		}).Int()) * time.Hour
+	}
+	SessionMaxAge()
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS UserSession(id VARCHAR(64) PRIMARY KEY, identity VARCHAR(64), type VARCHAR(16), auth TEXT NOT NULL, ip VARCHAR(64), user_agent VARCHAR(256), created INTEGER NOT NULL, last_seen INTEGER NOT NULL)"); err == nil {
+		stmt.Exec()
+	}
+}
+
+// SessionCreate stores the session and gives back the opaque identifier to put in the cookie
+func SessionCreate(session map[string]string, req *http.Request) (string, error) {
+	sessionPurge()
+	j, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	auth, err := EncryptString(SecretKeyDerivateForUser, string(j))
+	if err != nil {
+		return "", err
+	}
+	id := RandomString(48)
+	now := time.Now().UnixNano() / 1000000
+	userAgent := req.UserAgent()
+	if len(userAgent) > 256 {
+		userAgent = userAgent[:256]
+	}
+	if _, err = DB.Exec(
+		"INSERT INTO UserSession(id, identity, type, auth, ip, user_agent, created, last_seen) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+		sessionHash(id), session["identity"], session["type"], auth, RemoteIP(req), userAgent, now, now,
+	); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// SessionGet gives back the session attached to a cookie, or ErrNotFound when the session either
+// doesn't exist, was revoked or has expired
+func SessionGet(id string) (map[string]string, error) {
+	var (
+		session  = make(map[string]string)
+		auth     string
+		created  int64
+		lastSeen int64
+	)
+	hash := sessionHash(id)
+	err := DB.QueryRow("SELECT auth, created, last_seen FROM UserSession WHERE id = ?", hash).Scan(&auth, &created, &lastSeen)
+	if err == sql.ErrNoRows {
+		return session, ErrNotFound
+	} else if err != nil {
+		return session, err
+	}
+	now := time.Now().UnixNano() / 1000000
+	if now-lastSeen > SessionIdleTimeout().Milliseconds() || now-created > SessionMaxAge().Milliseconds() {
+		DB.Exec("DELETE FROM UserSession WHERE id = ?", hash)
+		return session, ErrNotFound
+	}
+	str, err := DecryptString(SecretKeyDerivateForUser, auth)
+	if err != nil {
+		// This typically happen when changing the secret key
+		return session, ErrNotFound
+	}
+	if err = json.Unmarshal([]byte(str), &session); err != nil {
+		return session, err
+	}
+	if now-lastSeen > 60*1000 {
+		DB.Exec("UPDATE UserSession SET last_seen = ? WHERE id = ?", now, hash)
+	}
+	return session, nil
+}
+
+// SessionRevoke is what happen on logout, the caller gives the value of the cookie
+func SessionRevoke(id string) error {
+	_, err := DB.Exec("DELETE FROM UserSession WHERE id = ?", sessionHash(id))
+	return err
+}
+
+func SessionList() ([]UserSession, error) {
+	sessionPurge()
+	rows, err := DB.Query("SELECT id, identity, type, ip, user_agent, created, last_seen FROM UserSession ORDER BY last_seen DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []UserSession{}
+	for rows.Next() {
+		var (
+			s         UserSession
+			identity  sql.NullString
+			t         sql.NullString
+			ip        sql.NullString
+			userAgent sql.NullString
+		)
+		if err = rows.Scan(&s.Id, &identity, &t, &ip, &userAgent, &s.Created, &s.LastSeen); err != nil {
+			return nil, err
+		}
+		s.Identity = identity.String
+		s.Type = t.String
+		s.Ip = ip.String
+		s.UserAgent = userAgent.String
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// SessionDelete kills a session from the admin console, the id is the one given by SessionList
+func SessionDelete(id string) error {
+	r, err := DB.Exec("DELETE FROM UserSession WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func sessionPurge() {
+	now := time.Now().UnixNano() / 1000000
+	DB.Exec(
+		"DELETE FROM UserSession WHERE last_seen < ? OR created < ?",
+		now-SessionIdleTimeout().Milliseconds(), now-SessionMaxAge().Milliseconds(),
+	)
+}
+
+// sessionHash keeps the value of the cookie out of the database. It's random enough for a plain sha256
+// to do, no key involved, so people stay logged in when the secret key gets rotated
+func sessionHash(id string) string {
+	return Hash(id, 64)
+}
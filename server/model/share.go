@@ -2,17 +2,17 @@ package model
 
 import (
 	"bytes"
-	"crypto/tls"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	. "github.com/bingoohuang/filestash/server/common"
 	"github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
-	"gopkg.in/gomail.v2"
-	"html/template"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
-	"time"
 )
 
 type Proof struct {
@@ -24,7 +24,7 @@ type Proof struct {
 }
 
 func ShareList(backend string, path string) ([]Share, error) {
-	stmt, err := DB.Prepare("SELECT id, related_path, params FROM Share WHERE related_backend = ? AND related_path LIKE ? || '%' ")
+	stmt, err := DB.Prepare("SELECT s.id, s.related_path, s.params, " + shareCounterColumns + " FROM Share s LEFT JOIN ShareCounter c ON c.share = s.id WHERE s.related_backend = ? AND s.related_path LIKE ? || '%' ")
 	if err != nil {
 		return nil, err
 	}
@@ -36,34 +36,92 @@ func ShareList(backend string, path string) ([]Share, error) {
 	for rows.Next() {
 		var a Share
 		var params []byte
-		rows.Scan(&a.Id, &a.Path, &params)
+		rows.Scan(&a.Id, &a.Path, &params, &a.Visits, &a.Downloads)
 		json.Unmarshal(params, &a)
 		sharedFiles = append(sharedFiles, a)
 	}
 	rows.Close()
-	return sharedFiles, nil
+	return sharedFiles, shareCollectionLoad(sharedFiles)
+}
+
+// ShareListAll gives every shared link regardless of the backend it belongs to
+func ShareListAll() ([]Share, error) {
+	rows, err := DB.Query("SELECT s.id, s.related_backend, s.related_path, s.params, " + shareCounterColumns + " FROM Share s LEFT JOIN ShareCounter c ON c.share = s.id ORDER BY s.related_backend, s.related_path")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sharedFiles := []Share{}
+	for rows.Next() {
+		var a Share
+		var params []byte
+		if err := rows.Scan(&a.Id, &a.Backend, &a.Path, &params, &a.Visits, &a.Downloads); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(params, &a)
+		sharedFiles = append(sharedFiles, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return sharedFiles, shareCollectionLoad(sharedFiles)
 }
 
 func ShareGet(id string) (Share, error) {
 	var p Share
-	stmt, err := DB.Prepare("SELECT id, related_backend, related_path, auth, params FROM share WHERE id = ?")
+	stmt, err := DB.Prepare("SELECT s.id, s.related_backend, s.related_path, s.auth, s.params, " + shareCounterColumns + " FROM Share s LEFT JOIN ShareCounter c ON c.share = s.id WHERE s.id = ?")
 	if err != nil {
 		return p, err
 	}
 	defer stmt.Close()
 	row := stmt.QueryRow(id)
 	var str []byte
-	if err = row.Scan(&p.Id, &p.Backend, &p.Path, &p.Auth, &str); err != nil {
+	if err = row.Scan(&p.Id, &p.Backend, &p.Path, &p.Auth, &str, &p.Visits, &p.Downloads); err != nil {
 		if err == sql.ErrNoRows {
 			return p, ErrNotFound
 		}
 		return p, err
 	}
 	json.Unmarshal(str, &p)
-	return p, nil
+	shares := []Share{p}
+	if err = shareCollectionLoad(shares); err != nil {
+		return p, err
+	}
+	return shares[0], nil
 }
 
 func ShareUpsert(p *Share) error {
+	if p.OneShot {
+		p.MaxDownloads = NewInt64(1)
+	}
+	if err := shareCollectionConfigure(p); err != nil {
+		return err
+	}
+	if v := SharePolicyViolations(*p); len(v) > 0 {
+		return NewError(v[0], 400)
+	}
+	for _, max := range []*int64{p.MaxDownloads, p.MaxVisits, p.MaxUploads, p.MaxUploadSize} {
+		if max != nil && *max < 1 {
+			return NewError("Limits must be at least 1", 400)
+		}
+	}
+	if p.Notify != nil && p.Notify.Webhook != "" {
+		if !ShareUploadWebhook() {
+			return NewError("Webhooks aren't enabled, contact your administrator", 400)
+		}
+		if u, err := url.Parse(p.Notify.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return NewError("Invalid webhook", 400)
+		} else if ip := net.ParseIP(u.Hostname()); (ip != nil && !ShareUploadWebhookAllowed(ip)) || u.Hostname() == "localhost" {
+			return NewError("Invalid webhook", 400)
+		}
+	}
+	if err := shareProofConfigure(p); err != nil {
+		return err
+	}
+	if err := shareWatermarkConfigure(p); err != nil {
+		return err
+	}
 	if p.Password != nil {
 		if *p.Password == PasswordDummy {
 			if s, err := ShareGet(p.Id); err != nil {
@@ -74,49 +132,102 @@ func ShareUpsert(p *Share) error {
 			p.Password = NewString(string(hashedPassword))
 		}
 	}
+	if p.Totp != nil {
+		if *p.Totp == PasswordDummy {
+			if s, err := ShareGet(p.Id); err == nil {
+				p.Totp = s.Totp
+			}
+		} else if !TotpIsValidSecret(*p.Totp) {
+			return NewError("Invalid TOTP secret", 400)
+		} else {
+			encrypted, err := EncryptString(SecretKeyDerivateForProof, *p.Totp)
+			if err != nil {
+				return err
+			}
+			p.Totp = NewString(encrypted)
+		}
+	}
 
-	stmt, err := DB.Prepare("INSERT INTO Location(backend, path) VALUES($1, $2)")
+	// the link and the items of a collection are saved together, a link can't end up without its items
+	tx, err := DB.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(p.Backend, p.Path)
+	_, err = tx.Exec("INSERT INTO Location(backend, path) VALUES($1, $2)", p.Backend, p.Path)
 	if err != nil {
 		throw := true
 		if ferr, ok := err.(sqlite3.Error); ok && ferr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
 			throw = false
 		}
 		if throw {
+			tx.Rollback()
 			return err
 		}
 	}
 
-	stmt, err = DB.Prepare("INSERT INTO Share(id, related_backend, related_path, params, auth) VALUES($1, $2, $3, $4, $5) ON CONFLICT(id) DO UPDATE SET related_backend = $2, related_path = $3, params = $4")
-	if err != nil {
-		return err
-	}
 	j, _ := json.Marshal(&struct {
 		Password     *string `json:"password,omitempty"`
 		Users        *string `json:"users,omitempty"`
+		Totp         *string `json:"totp,omitempty"`
 		Expire       *int64  `json:"expire,omitempty"`
 		Url          *string `json:"url,omitempty"`
+		Collection   bool    `json:"collection,omitempty"`
 		CanShare     bool    `json:"can_share"`
 		CanManageOwn bool    `json:"can_manage_own"`
 		CanRead      bool    `json:"can_read"`
 		CanWrite     bool    `json:"can_write"`
 		CanUpload    bool    `json:"can_upload"`
+		MaxDownloads *int64  `json:"max_downloads,omitempty"`
+		MaxVisits    *int64  `json:"max_visits,omitempty"`
+		OneShot      bool    `json:"one_shot,omitempty"`
+
+		Notify           *ShareNotify `json:"notify,omitempty"`
+		MaxUploads       *int64       `json:"max_uploads,omitempty"`
+		MaxUploadSize    *int64       `json:"max_upload_size,omitempty"`
+		UploadExtensions *string      `json:"upload_extensions,omitempty"`
+
+		ViewOnly  bool    `json:"view_only,omitempty"`
+		Watermark *string `json:"watermark,omitempty"`
+
+		Proofs map[string]string `json:"proofs,omitempty"`
 	}{
 		Password:     p.Password,
 		Users:        p.Users,
+		Totp:         p.Totp,
 		Expire:       p.Expire,
 		Url:          p.Url,
+		Collection:   p.Collection,
 		CanShare:     p.CanShare,
 		CanManageOwn: p.CanManageOwn,
 		CanRead:      p.CanRead,
 		CanWrite:     p.CanWrite,
 		CanUpload:    p.CanUpload,
+		MaxDownloads: p.MaxDownloads,
+		MaxVisits:    p.MaxVisits,
+		OneShot:      p.OneShot,
+
+		Notify:           p.Notify,
+		MaxUploads:       p.MaxUploads,
+		MaxUploadSize:    p.MaxUploadSize,
+		UploadExtensions: p.UploadExtensions,
+
+		ViewOnly:  p.ViewOnly,
+		Watermark: p.Watermark,
+
+		Proofs: p.Proofs,
 	})
-	_, err = stmt.Exec(p.Id, p.Backend, p.Path, j, p.Auth)
-	return err
+	if _, err = tx.Exec(
+		"INSERT INTO Share(id, related_backend, related_path, params, auth) VALUES($1, $2, $3, $4, $5) ON CONFLICT(id) DO UPDATE SET related_backend = $2, related_path = $3, params = $4",
+		p.Id, p.Backend, p.Path, j, p.Auth,
+	); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = shareCollectionSave(tx, *p); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 func ShareDelete(id string) error {
@@ -128,117 +239,79 @@ func ShareDelete(id string) error {
 	return err
 }
 
-func ShareProofVerifier(s Share, proof Proof) (Proof, error) {
-	p := proof
-
-	if proof.Key == "password" {
-		if s.Password == nil {
-			return p, NewError("No password required", 400)
-		}
-
-		v, ok := ShareProofVerifierPassword(*s.Password, proof.Value)
-		if !ok {
-			time.Sleep(1000 * time.Millisecond)
-			return p, ErrInvalidPassword
+// ShareIsValid checks the link can still be used by the request. Once all its visits are used up, a
+// link stays open to the people whose visit was counted, they'd be locked out by their own visit otherwise
+func ShareIsValid(s Share, verified []Proof) error {
+	for _, p := range verified {
+		if p.Key == "visit" && p.Id == Hash("visit::"+s.Id, 20) {
+			s.MaxVisits = nil
+			break
 		}
-		p.Value = v
 	}
+	return s.IsValid()
+}
 
-	if proof.Key == "email" {
-		// find out if user is authorized
-		if s.Users == nil {
-			return p, NewError("Authentication not required", 400)
-		}
-		v, ok := ShareProofVerifierEmail(*s.Users, proof.Value)
-		if !ok {
-			time.Sleep(1000 * time.Millisecond)
-			return p, ErrNotAuthorized
-		}
-		user := v
+const shareCounterColumns = "COALESCE(c.visits, 0), COALESCE(c.downloads, 0)"
 
-		// prepare the verification code
-		stmt, err := DB.Prepare("INSERT INTO Verification(key, code) VALUES(?, ?)")
-		if err != nil {
-			return p, err
-		}
-		code := RandomString(4)
-		if _, err := stmt.Exec("email::"+user, code); err != nil {
-			return p, err
-		}
+// ShareVisit counts a new visit of the link and fails once all the visits it allows are used up
+func ShareVisit(s Share) error {
+	return shareCounterTake(s.Id, "visits", s.MaxVisits)
+}
 
-		// Prepare message
-		var b bytes.Buffer
-		t := template.New("email")
-		t.Parse(TmplEmailVerification())
-		t.Execute(&b, struct {
-			Code     string
-			Username string
-		}{code, networkDriveUsernameEnc(user)})
-
-		p.Key = "code"
-		p.Value = ""
-		p.Message = NewString("We've sent you a message with a verification code")
-
-		// Send email
-		email := struct {
-			Hostname string `json:"server"`
-			Port     int    `json:"port"`
-			Username string `json:"username"`
-			Password string `json:"password"`
-			From     string `json:"from"`
-		}{
-			Hostname: Config.Get("email.server").String(),
-			Port:     Config.Get("email.port").Int(),
-			Username: Config.Get("email.username").String(),
-			Password: Config.Get("email.password").String(),
-			From:     Config.Get("email.from").String(),
-		}
+// ShareDownloadTake reserves one of the downloads a link allows. The reservation is to be given back
+// with ShareDownloadRelease when the download doesn't go through
+func ShareDownloadTake(s Share) error {
+	return shareCounterTake(s.Id, "downloads", s.MaxDownloads)
+}
 
-		m := gomail.NewMessage()
-		m.SetHeader("From", email.From)
-		m.SetHeader("To", proof.Value)
-		m.SetHeader("Subject", "Your verification code")
-		m.SetBody("text/html", b.String())
-		d := gomail.NewDialer(email.Hostname, email.Port, email.Username, email.Password)
-		d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-		if err := d.DialAndSend(m); err != nil {
-			Log.Error("Sendmail error: %v", err)
-			Log.Error("Verification code '%s'", code)
-			return p, NewError("Couldn't send email", 500)
-		}
-		return p, nil
-	}
+func ShareDownloadRelease(s Share) error {
+	_, err := DB.Exec("UPDATE ShareCounter SET downloads = downloads - 1 WHERE share = ? AND downloads > 0", s.Id)
+	return err
+}
 
-	if proof.Key == "code" {
-		// find key for given code
-		stmt, err := DB.Prepare("SELECT key FROM Verification WHERE code = ? AND expire > datetime('now')")
-		if err != nil {
-			return p, NewError("Not found", 404)
-		}
-		row := stmt.QueryRow(proof.Value)
-		var key string
-		if err = row.Scan(&key); err != nil {
-			if err == sql.ErrNoRows {
-				stmt.Close()
-				p.Key = "email"
-				p.Value = ""
-				return p, NewError("Not found", 404)
-			}
-			stmt.Close()
-			return p, err
-		}
-		stmt.Close()
+// ShareSelfDestruct is what happens to a one shot link once used: the credentials it holds are gone
+// but the link is kept around so that people who come after are told it's no longer available
+func ShareSelfDestruct(s Share) error {
+	_, err := DB.Exec("UPDATE Share SET auth = '' WHERE id = ?", s.Id)
+	return err
+}
 
-		// cleanup current attempt so that it isn't used for malicious purpose
-		if stmt, err = DB.Prepare("DELETE FROM Verification WHERE code = ?"); err == nil {
-			stmt.Exec(proof.Value)
-			stmt.Close()
-		}
-		p.Key = "email"
-		p.Value = strings.TrimPrefix(key, "email::")
+// shareCounterTake increments a counter unless it has reached its limit. The check and the increment
+// happen in a single statement so that concurrent requests can't go over the limit
+func shareCounterTake(id string, column string, max *int64) error {
+	limit := sql.NullInt64{}
+	if max != nil {
+		limit = sql.NullInt64{Int64: *max, Valid: true}
+	}
+	r, err := DB.Exec(
+		"INSERT INTO ShareCounter(share, "+column+") VALUES(?1, 1) ON CONFLICT(share) DO UPDATE SET "+column+" = "+column+" + 1 WHERE ?2 IS NULL OR "+column+" < ?2",
+		id, limit,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrShareExhausted
 	}
+	return nil
+}
 
-	return p, nil
+// ShareProofVerifier checks a proof submitted by the user against the provider registered for it, what
+// isn't a known proof is left as is. The passive proofs and the visits are taken care of by the server,
+// they're never given by the user
+func ShareProofVerifier(s Share, proof Proof, req *http.Request) (Proof, error) {
+	if proof.Key == "visit" {
+		return proof, ErrNotValid
+	}
+	provider := ShareProofs.Get(proof.Key)
+	if provider == nil {
+		return proof, nil
+	} else if _, ok := provider.(ShareProofPassive); ok {
+		return proof, ErrNotValid
+	}
+	return provider.Verify(s, proof, req)
 }
 
 func ShareProofVerifierPassword(hashed string, given string) (string, bool) {
@@ -269,6 +342,28 @@ func ShareProofVerifierEmail(users string, wanted string) (string, bool) {
 	return user, true
 }
 
+// shareProofCookie is how a proof is remembered in the cookie. Unlike what's sent to the frontend, the
+// email people proved to own is kept along so that they can be told apart, eg: in the watermark
+type shareProofCookie struct {
+	Id    string `json:"id"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// ShareProofCookie gives the value of the cookie remembering the proofs a person went through
+func ShareProofCookie(proofs []Proof) string {
+	c := make([]shareProofCookie, len(proofs))
+	for i, p := range proofs {
+		c[i] = shareProofCookie{Id: p.Id, Key: p.Key}
+		if p.Key == "email" {
+			c[i].Value = p.Value
+		}
+	}
+	j, _ := json.Marshal(c)
+	str, _ := EncryptString(SecretKeyDerivateForProof, string(j))
+	return str
+}
+
 func ShareProofGetAlreadyVerified(req *http.Request) []Proof {
 	var p []Proof
 	var cookieValue string
@@ -278,28 +373,92 @@ func ShareProofGetAlreadyVerified(req *http.Request) []Proof {
 		return p
 	}
 	cookieValue = c.Value
-	if len(cookieValue) > 500 {
+	// the cookie holds the email along with the proofs, which can make it longer than the proofs alone
+	if len(cookieValue) > 2048 {
 		return p
 	}
 	j, err := DecryptString(SecretKeyDerivateForProof, cookieValue)
 	if err != nil {
 		return p
 	}
-	_ = json.Unmarshal([]byte(j), &p)
+	var remembered []shareProofCookie
+	_ = json.Unmarshal([]byte(j), &remembered)
+	for _, proof := range remembered {
+		p = append(p, Proof{Id: proof.Id, Key: proof.Key, Value: proof.Value})
+	}
 	return p
 }
 
+// ShareProofGetBasicAuth reads the credentials webdav clients send along with their requests. The
+// username is only given when it carries a valid signature
+func ShareProofGetBasicAuth(req *http.Request) (string, string) {
+	decoded, err := base64.StdEncoding.DecodeString(
+		strings.TrimPrefix(req.Header.Get("Authorization"), "Basic "),
+	)
+	if err != nil {
+		return "", ""
+	}
+	s := bytes.Split(decoded, []byte(":"))
+	if len(s) < 2 {
+		return "", ""
+	}
+	p := string(bytes.Join(s[1:], []byte(":")))
+	usr := regexp.MustCompile(`^(.*)\[([0-9a-zA-Z]+)\]$`).FindStringSubmatch(string(s[0]))
+	if len(usr) != 3 {
+		return "", p
+	}
+	if Hash(usr[1]+SecretKeyDerivateForHash, 10) != usr[2] {
+		return "", p
+	}
+	return usr[1], p
+}
+
+// ShareProofGetIdentity gives the email of the person using a shared link, as verified by one of the
+// proofs they went through
+func ShareProofGetIdentity(req *http.Request, s Share) string {
+	for _, p := range ShareProofGetAlreadyVerified(req) {
+		if p.Key == "email" && p.Value != "" {
+			return p.Value
+		}
+	}
+	if s.Users == nil {
+		return ""
+	}
+	if username, _ := ShareProofGetBasicAuth(req); username != "" {
+		if _, ok := ShareProofVerifierEmail(*s.Users, username); ok {
+			return username
+		}
+	}
+	return ""
+}
+
 func ShareProofGetRequired(s Share) []Proof {
 	var p []Proof
-	if s.Password != nil {
-		p = append(p, Proof{Key: "password", Value: *s.Password})
+	for _, provider := range ShareProofs.Providers() {
+		if v, ok := provider.Required(s); ok {
+			p = append(p, Proof{Key: provider.Key(), Value: v})
+		}
 	}
-	if s.Users != nil {
-		p = append(p, Proof{Key: "email", Value: *s.Users})
+	// the visit comes last as it's only counted once every other proof has been given
+	if s.MaxVisits != nil {
+		p = append(p, Proof{Key: "visit", Value: s.Id})
 	}
 	return p
 }
 
+// ShareProofGetRemaining gives the proofs a request still has to go through to use a shared link:
+// the required ones which are neither remembered in the cookie nor passive proofs passing their check
+func ShareProofGetRemaining(s Share, req *http.Request, verified []Proof) []Proof {
+	var remaining []Proof
+	for _, p := range ShareProofCalculateRemainings(ShareProofGetRequired(s), verified) {
+		if passive, ok := ShareProofs.Get(p.Key).(ShareProofPassive); ok && passive.Check(s, req) {
+			continue
+		}
+		remaining = append(remaining, p)
+	}
+	return remaining
+}
+
 func ShareProofCalculateRemainings(ref []Proof, mem []Proof) []Proof {
 	var remainingProof []Proof
 
@@ -334,6 +493,14 @@ func shareProofAreEquivalent(ref Proof, p Proof) bool {
 	return false
 }
 
+func TmplEmailVerificationText() string {
+	return `Your verification code is: {{ .Code }}
+
+It's valid for 10 minutes and only for the shared link you asked it from.
+When mounted as a network drive, you can authenticate as: {{ .Username }}
+`
+}
+
 func TmplEmailVerification() string {
 	return `
 <!doctype html>
@@ -0,0 +1,156 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+// ShareAccess is what happened when someone used a shared link: the proof they gave, the files they
+// went through and how much data got transferred
+type ShareAccess struct {
+	Id        int64  `json:"id"`
+	Share     string `json:"share"`
+	Time      int64  `json:"time"`
+	Operation string `json:"operation"`
+	Path      string `json:"path"`
+	Identity  string `json:"identity,omitempty"`
+	Ip        string `json:"ip"`
+	Bytes     int64  `json:"bytes"`
+	Status    int    `json:"status"`
+}
+
+type ShareStats struct {
+	Accesses    int64            `json:"accesses"`
+	Bytes       int64            `json:"bytes"`
+	Visitors    int64            `json:"visitors"`
+	Identities  []string         `json:"identities"`
+	Operations  map[string]int64 `json:"operations"`
+	FirstAccess *int64           `json:"first_access,omitempty"`
+	LastAccess  *int64           `json:"last_access,omitempty"`
+}
+
+var shareActivityQueue chan ShareAccess
+
+func init() {
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ShareActivity(id INTEGER PRIMARY KEY AUTOINCREMENT, share VARCHAR(64) NOT NULL, time INTEGER NOT NULL, operation VARCHAR(32) NOT NULL, path VARCHAR(1024), identity VARCHAR(256), ip VARCHAR(64), bytes INTEGER NOT NULL DEFAULT 0, status INTEGER, FOREIGN KEY (share) REFERENCES Share(id) ON UPDATE CASCADE ON DELETE CASCADE)"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_shareactivity_share ON ShareActivity(share, time)"); err == nil {
+			stmt.Exec()
+		}
+	}
+
+	shareActivityQueue = make(chan ShareAccess, 1024)
+	go shareActivityWriter()
+}
+
+// ShareActivityRecord keeps track of an access made through a shared link. As with the audit log, the
+// write happens in the background so that it doesn't slow down the request
+func ShareActivityRecord(a ShareAccess) {
+	if a.Share == "" {
+		return
+	}
+	if a.Time == 0 {
+		a.Time = time.Now().UnixNano() / 1000000
+	}
+	select {
+	case shareActivityQueue <- a:
+	default:
+		MetricEventsDropped.WithLabelValues("share_activity").Inc()
+		Log.Warning("model::share_activity queue is full, dropping %s on '%s' from share '%s'", a.Operation, a.Path, a.Share)
+	}
+}
+
+func shareActivityWriter() {
+	for a := range shareActivityQueue {
+		if _, err := DB.Exec(
+			"INSERT INTO ShareActivity(share, time, operation, path, identity, ip, bytes, status) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+			a.Share, a.Time, a.Operation, a.Path, a.Identity, a.Ip, a.Bytes, a.Status,
+		); err != nil {
+			Log.Error("model::share_activity can't record access %s", err.Error())
+		}
+	}
+}
+
+// ShareActivityTimeline gives the accesses made through a shared link, the most recent first
+func ShareActivityTimeline(share string, from int64, to int64, limit int, offset int) ([]ShareAccess, error) {
+	query := "SELECT id, share, time, operation, path, identity, ip, bytes, status FROM ShareActivity WHERE share = ? AND time >= ?"
+	args := []interface{}{share, from}
+	if to > 0 {
+		query += " AND time <= ?"
+		args = append(args, to)
+	}
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	timeline := []ShareAccess{}
+	for rows.Next() {
+		var a ShareAccess
+		var path, identity, ip sql.NullString
+		var status sql.NullInt64
+		if err := rows.Scan(&a.Id, &a.Share, &a.Time, &a.Operation, &path, &identity, &ip, &a.Bytes, &status); err != nil {
+			return nil, err
+		}
+		a.Path = path.String
+		a.Identity = identity.String
+		a.Ip = ip.String
+		a.Status = int(status.Int64)
+		timeline = append(timeline, a)
+	}
+	return timeline, rows.Err()
+}
+
+func ShareActivityStats(share string) (ShareStats, error) {
+	stats := ShareStats{
+		Identities: []string{},
+		Operations: map[string]int64{},
+	}
+	var first, last sql.NullInt64
+	if err := DB.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(bytes), 0), COUNT(DISTINCT ip), MIN(time), MAX(time) FROM ShareActivity WHERE share = ?",
+		share,
+	).Scan(&stats.Accesses, &stats.Bytes, &stats.Visitors, &first, &last); err != nil {
+		return stats, err
+	}
+	if first.Valid {
+		stats.FirstAccess = NewInt64(first.Int64)
+		stats.LastAccess = NewInt64(last.Int64)
+	}
+
+	rows, err := DB.Query("SELECT operation, COUNT(*) FROM ShareActivity WHERE share = ? GROUP BY operation", share)
+	if err != nil {
+		return stats, err
+	}
+	for rows.Next() {
+		var op string
+		var n int64
+		if err := rows.Scan(&op, &n); err != nil {
+			rows.Close()
+			return stats, err
+		}
+		stats.Operations[op] = n
+	}
+	rows.Close()
+
+	rows, err = DB.Query("SELECT DISTINCT identity FROM ShareActivity WHERE share = ? AND identity IS NOT NULL AND identity != '' ORDER BY identity", share)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var identity string
+		if err := rows.Scan(&identity); err != nil {
+			return stats, err
+		}
+		stats.Identities = append(stats.Identities, identity)
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,213 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+// ShareEntry is a shared link as seen from the admin console: on top of its params, it tells who
+// made it, onto what kind of storage and whether it's in line with the policies of the instance
+type ShareEntry struct {
+	Id          string   `json:"id"`
+	Backend     string   `json:"backend"`
+	BackendType string   `json:"backend_type"`
+	Creator     string   `json:"creator"`
+	Path        string   `json:"path"`
+	Expire      *int64   `json:"expire,omitempty"`
+	Expired     bool     `json:"expired"`
+	Password    bool     `json:"password"`
+	Email       bool     `json:"email"`
+	Violations  []string `json:"violations"`
+	Params      Share    `json:"params"`
+}
+
+type ShareFilter struct {
+	Query       string
+	Backend     string
+	BackendType string
+	Creator     string
+	Protection  string // password, email, totp or none
+	Status      string // active, expired or violation
+	Limit       int
+	Offset      int
+}
+
+// ShareAdminList goes through every shared link of the instance, whoever created them
+func ShareAdminList(f ShareFilter) ([]ShareEntry, error) {
+	rows, err := DB.Query("SELECT s.id, s.related_backend, s.related_path, s.auth, s.params, " + shareCounterColumns + " FROM Share s LEFT JOIN ShareCounter c ON c.share = s.id ORDER BY s.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []ShareEntry{}
+	for rows.Next() {
+		var s Share
+		var params []byte
+		if err := rows.Scan(&s.Id, &s.Backend, &s.Path, &s.Auth, &params, &s.Visits, &s.Downloads); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(params, &s)
+		e := shareEntry(s)
+		if shareEntryMatch(e, f) {
+			entries = append(entries, e)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	for i := range entries {
+		shares := []Share{entries[i].Params}
+		if err := shareCollectionLoad(shares); err != nil {
+			return nil, err
+		}
+		entries[i].Params = shares[0]
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Creator < entries[j].Creator
+	})
+	if f.Offset > 0 {
+		if f.Offset >= len(entries) {
+			return []ShareEntry{}, nil
+		}
+		entries = entries[f.Offset:]
+	}
+	if f.Limit > 0 && f.Limit < len(entries) {
+		entries = entries[:f.Limit]
+	}
+	return entries, nil
+}
+
+// ShareRevoke removes many shared links at once, it gives how many were actually removed
+func ShareRevoke(ids []string) (int, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		r, err := tx.Exec("DELETE FROM Share WHERE id = ?", id)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if c, _ := r.RowsAffected(); c > 0 {
+			n += 1
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// SharePolicyViolations lists what a link does that the policies of the instance don't allow
+func SharePolicyViolations(s Share) []string {
+	violations := []string{}
+	if days := Config.Get("features.share.max_expiry").Int(); days > 0 {
+		max := time.Now().Add(time.Duration(days)*24*time.Hour).UnixNano() / 1000000
+		if s.Expire == nil || *s.Expire > max {
+			violations = append(violations, fmt.Sprintf("Links have to expire within %d days", days))
+		}
+	}
+	if Config.Get("features.share.require_password").Bool() && s.Password == nil {
+		violations = append(violations, "Links have to be protected by a password")
+	}
+	if !Config.Get("features.share.allow_reshare").Bool() && s.CanShare {
+		violations = append(violations, "Links can't be shared further")
+	}
+	return violations
+}
+
+func shareEntry(s Share) ShareEntry {
+	e := ShareEntry{
+		Id:         s.Id,
+		Backend:    s.Backend,
+		Path:       s.Path,
+		Expire:     s.Expire,
+		Expired:    s.IsValid() != nil,
+		Password:   s.Password != nil,
+		Email:      s.Users != nil,
+		Violations: SharePolicyViolations(s),
+		Params:     s,
+	}
+	if str, err := DecryptString(SecretKeyDerivateForUser, s.Auth); err == nil {
+		session := map[string]string{}
+		json.Unmarshal([]byte(str), &session)
+		e.BackendType = session["type"]
+		for _, key := range []string{"identity", "username", "user"} {
+			if session[key] != "" {
+				e.Creator = session[key]
+				break
+			}
+		}
+	}
+	e.Params.Auth = ""
+	return e
+}
+
+func shareEntryMatch(e ShareEntry, f ShareFilter) bool {
+	if f.Backend != "" && e.Backend != f.Backend {
+		return false
+	}
+	if f.BackendType != "" && e.BackendType != f.BackendType {
+		return false
+	}
+	if f.Creator != "" && e.Creator != f.Creator {
+		return false
+	}
+	switch f.Protection {
+	case "password":
+		if !e.Password {
+			return false
+		}
+	case "email":
+		if !e.Email {
+			return false
+		}
+	case "totp":
+		if e.Params.Totp == nil {
+			return false
+		}
+	case "none":
+		if e.Password || e.Email || e.Params.Totp != nil || len(e.Params.Proofs) > 0 {
+			return false
+		}
+	}
+	switch f.Status {
+	case "active":
+		if e.Expired {
+			return false
+		}
+	case "expired":
+		if !e.Expired {
+			return false
+		}
+	case "violation":
+		if len(e.Violations) == 0 {
+			return false
+		}
+	}
+	if q := strings.ToLower(f.Query); q != "" {
+		users := ""
+		if e.Params.Users != nil {
+			users = *e.Params.Users
+		}
+		found := false
+		for _, field := range []string{e.Id, e.Path, e.Creator, e.BackendType, users} {
+			if strings.Contains(strings.ToLower(field), q) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
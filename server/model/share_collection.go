@@ -0,0 +1,215 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+// ShareCollectionMaxItems is how many files and folders a single collection can be made of
+const ShareCollectionMaxItems = 100
+
+// ShareCollectionItem is one of the files or folders a collection is made of, along with the name it
+// goes by in the virtual directory people see when they open the link
+type ShareCollectionItem struct {
+	Name string
+	Path string
+}
+
+// ShareCollectionItems gives the items of a collection in the order they were added. Items that would
+// have the same name, eg: 2 "report.pdf" from different folders, are told apart by a number
+func ShareCollectionItems(s Share) []ShareCollectionItem {
+	items := make([]ShareCollectionItem, 0, len(s.Paths))
+	taken := map[string]bool{}
+	for _, path := range s.Paths {
+		base := filepath.Base(path)
+		ext := ""
+		if !IsDirectory(path) {
+			ext = filepath.Ext(base)
+		}
+		name := base
+		for i := 2; taken[name]; i++ {
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), i, ext)
+		}
+		taken[name] = true
+		items = append(items, ShareCollectionItem{name, path})
+	}
+	return items
+}
+
+// ShareCollectionPath translates a path as seen by the people using a collection into the path of the
+// file on the storage. The root of the collection is its common parent, which can only be listed
+func ShareCollectionPath(s Share, path string) (string, error) {
+	p := filepath.ToSlash(filepath.Join("/", path))
+	if p == "/" {
+		return s.Path, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	for _, item := range ShareCollectionItems(s) {
+		if item.Name != parts[0] {
+			continue
+		}
+		if len(parts) == 1 {
+			if strings.HasSuffix(path, "/") && !IsDirectory(item.Path) {
+				return "", ErrNotFound
+			}
+			return item.Path, nil
+		}
+		if !IsDirectory(item.Path) {
+			return "", ErrNotFound
+		}
+		p = item.Path + parts[1]
+		if strings.HasSuffix(path, "/") {
+			p += "/"
+		}
+		return p, nil
+	}
+	return "", NewError("There's nothing here", 403)
+}
+
+// ShareCollectionLs lists the root of a collection: the items it's made of as they are on the storage,
+// under their name in the collection. Items that are gone from the storage aren't listed
+func ShareCollectionLs(ctx *App) []os.FileInfo {
+	entries := map[string][]os.FileInfo{}
+	files := []os.FileInfo{}
+	for _, item := range ShareCollectionItems(ctx.Share) {
+		parent := filepath.Dir(strings.TrimSuffix(item.Path, "/")) + "/"
+		if parent == "//" {
+			parent = "/"
+		}
+		if _, ok := entries[parent]; !ok {
+			ls, err := ctx.Backend.Ls(parent)
+			if err != nil {
+				Log.Subsystem("share").Request(ctx.RequestId).Debug("share %s: can't list %s %s", ctx.Share.Id, parent, err.Error())
+			}
+			entries[parent] = ls
+		}
+		base := filepath.Base(item.Path)
+		for _, entry := range entries[parent] {
+			if entry.Name() != base || entry.IsDir() != IsDirectory(item.Path) {
+				continue
+			}
+			f := File{
+				FName: item.Name,
+				FType: "file",
+				FTime: entry.ModTime().Unix(),
+				FSize: entry.Size(),
+			}
+			if entry.IsDir() {
+				f.FType = "directory"
+			}
+			files = append(files, f)
+			break
+		}
+	}
+	return files
+}
+
+// shareCollectionContains checks the path is one of the items of a collection or what's in it. The root
+// is part of the collection as it's where the items are listed from
+func shareCollectionContains(s Share, path string) bool {
+	if path == s.Path {
+		return true
+	}
+	for _, p := range s.Paths {
+		if path == p || (IsDirectory(p) && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// shareCollectionConfigure validates the paths of a collection before it gets saved. The link itself
+// points at their common parent. Collections are read only as what's in them can't be moved around.
+// The link stops being a collection when it's saved with no path
+func shareCollectionConfigure(s *Share) error {
+	if len(s.Paths) == 0 {
+		s.Collection = false
+		s.Paths = nil
+		return nil
+	}
+	if len(s.Paths) > ShareCollectionMaxItems {
+		return NewError(fmt.Sprintf("A collection can't have more than %d items", ShareCollectionMaxItems), 400)
+	}
+	if s.CanWrite || s.CanUpload || s.CanShare {
+		return NewError("A collection can only be read", 400)
+	}
+	paths := make([]string, 0, len(s.Paths))
+	seen := map[string]bool{}
+	for _, path := range s.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return NewError("Invalid path", 400)
+		}
+		p := filepath.ToSlash(filepath.Clean(path))
+		if p == "/" {
+			return NewError("The root can't be part of a collection", 400)
+		}
+		if strings.HasSuffix(path, "/") {
+			p += "/"
+		}
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		paths = append(paths, p)
+	}
+
+	parent := filepath.Dir(strings.TrimSuffix(paths[0], "/"))
+	for _, p := range paths[1:] {
+		dir := filepath.Dir(strings.TrimSuffix(p, "/"))
+		for parent != "/" && dir != parent && !strings.HasPrefix(dir, parent+"/") {
+			parent = filepath.Dir(parent)
+		}
+	}
+	s.Path = EnforceDirectory(parent)
+	s.Paths = paths
+	s.Collection = true
+	return nil
+}
+
+// shareCollectionSave keeps track of the items of a collection in the ShareLocation table, as part of
+// the transaction saving the link. Like for the link itself, removing the location of an item removes
+// it from the collection
+func shareCollectionSave(tx *sql.Tx, s Share) error {
+	if _, err := tx.Exec("DELETE FROM ShareLocation WHERE share = ?", s.Id); err != nil {
+		return err
+	}
+	for _, path := range s.Paths {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO Location(backend, path) VALUES(?, ?)", s.Backend, path); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO ShareLocation(share, backend, path) VALUES(?, ?, ?)", s.Id, s.Backend, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shareCollectionLoad fills in the paths of the collections among the given links
+func shareCollectionLoad(shares []Share) error {
+	for i := range shares {
+		if !shares[i].Collection {
+			continue
+		}
+		rows, err := DB.Query("SELECT path FROM ShareLocation WHERE share = ? ORDER BY rowid", shares[i].Id)
+		if err != nil {
+			return err
+		}
+		paths := []string{}
+		for rows.Next() {
+			var path string
+			if err = rows.Scan(&path); err != nil {
+				rows.Close()
+				return err
+			}
+			paths = append(paths, path)
+		}
+		rows.Close()
+		shares[i].Paths = paths
+	}
+	return nil
+}
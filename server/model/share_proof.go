@@ -0,0 +1,308 @@
+package model
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+// ShareProofProvider is a kind of proof people have to give before they can use a shared link. The
+// ones that ship with Filestash are the password, the email and the TOTP code, plugins can register
+// new ones onto ShareProofs
+type ShareProofProvider interface {
+	// Key names the proof in the requests made by the frontend and in the proof cookie
+	Key() string
+	// Required gives what a link expects from this proof, ok is false for the links which don't use
+	// it. The proofs remembered in the cookie get matched against that value
+	Required(s Share) (value string, ok bool)
+	// Verify checks what the user submitted. The proof it gives back is remembered in the proof cookie
+	// under the hash of its key and value, unless it comes with a message in which case the user has
+	// another step to go through, eg: entering the code sent by email
+	Verify(s Share, p Proof, req *http.Request) (Proof, error)
+}
+
+// ShareProofConfigurable providers keep their settings in the proofs of a link, Configure validates
+// those settings before the link gets saved and gives what's to be stored
+type ShareProofConfigurable interface {
+	Configure(s Share, value string) (string, error)
+}
+
+// ShareProofPassive providers don't ask anything of the user, eg: an IP range. They're checked on every
+// request from what comes along with it and are never remembered in the proof cookie
+type ShareProofPassive interface {
+	Check(s Share, req *http.Request) bool
+}
+
+const (
+	shareProofCodeLength = 8
+	shareProofCodeExpiry = 10 * time.Minute
+)
+
+var ShareProofs = NewShareProofRegistry()
+
+func NewShareProofRegistry() ShareProofRegistry {
+	return ShareProofRegistry{make(map[string]ShareProofProvider), &[]string{}}
+}
+
+type ShareProofRegistry struct {
+	ps    map[string]ShareProofProvider
+	order *[]string
+}
+
+func (r ShareProofRegistry) Register(p ShareProofProvider) {
+	if p == nil {
+		panic("share proof: register invalid nil provider")
+	}
+	if r.ps[p.Key()] != nil || p.Key() == "visit" {
+		panic("share proof: register already exist")
+	}
+	r.ps[p.Key()] = p
+	*r.order = append(*r.order, p.Key())
+}
+
+func (r ShareProofRegistry) Get(key string) ShareProofProvider {
+	return r.ps[key]
+}
+
+// Providers gives the registered providers in the order they were registered, which is also the order
+// the proofs get asked for
+func (r ShareProofRegistry) Providers() []ShareProofProvider {
+	providers := make([]ShareProofProvider, 0, len(*r.order))
+	for _, key := range *r.order {
+		providers = append(providers, r.ps[key])
+	}
+	return providers
+}
+
+func init() {
+	ShareProofs.Register(shareProofPassword{})
+	ShareProofs.Register(shareProofEmail{})
+	ShareProofs.Register(shareProofCode{})
+	ShareProofs.Register(shareProofTotp{})
+
+	EmailRegisterTemplate("verification", func() EmailTemplate {
+		return EmailTemplate{
+			Subject: "Your verification code",
+			Html:    TmplEmailVerification(),
+			Text:    TmplEmailVerificationText(),
+		}
+	})
+}
+
+// shareProofConfigure validates the settings of the proofs brought by plugins. The proofs which ship
+// with Filestash have fields of their own on the link and can't be set from there
+func shareProofConfigure(s *Share) error {
+	for key, value := range s.Proofs {
+		c, ok := ShareProofs.Get(key).(ShareProofConfigurable)
+		if !ok {
+			return NewError(fmt.Sprintf("Unknown proof '%s'", key), 400)
+		}
+		if value == "" {
+			delete(s.Proofs, key)
+			continue
+		}
+		v, err := c.Configure(*s, value)
+		if err != nil {
+			return err
+		}
+		s.Proofs[key] = v
+	}
+	if len(s.Proofs) == 0 {
+		s.Proofs = nil
+	}
+	return nil
+}
+
+type shareProofPassword struct{}
+
+func (p shareProofPassword) Key() string {
+	return "password"
+}
+
+func (p shareProofPassword) Required(s Share) (string, bool) {
+	if s.Password == nil {
+		return "", false
+	}
+	return *s.Password, true
+}
+
+func (p shareProofPassword) Verify(s Share, proof Proof, req *http.Request) (Proof, error) {
+	if s.Password == nil {
+		return proof, NewError("No password required", 400)
+	}
+	v, ok := ShareProofVerifierPassword(*s.Password, proof.Value)
+	if !ok {
+		return proof, ErrInvalidPassword
+	}
+	proof.Value = v
+	return proof, nil
+}
+
+// shareProofEmail is the first step of the email proof: a code is sent to the person, the proof
+// gets remembered once they've given that code back
+type shareProofEmail struct{}
+
+func (p shareProofEmail) Key() string {
+	return "email"
+}
+
+func (p shareProofEmail) Required(s Share) (string, bool) {
+	if s.Users == nil {
+		return "", false
+	}
+	return *s.Users, true
+}
+
+func (p shareProofEmail) Verify(s Share, proof Proof, req *http.Request) (Proof, error) {
+	// find out if user is authorized
+	if s.Users == nil {
+		return proof, NewError("Authentication not required", 400)
+	}
+	v, ok := ShareProofVerifierEmail(*s.Users, proof.Value)
+	if !ok {
+		return proof, ErrNotAuthorized
+	}
+
+	// prepare the verification code, it only works for that link and that email. The id is handed
+	// back to the person who asked for the code, they give it along with the code
+	email := proof.Value
+	id := RandomString(32)
+	code := RandomString(shareProofCodeLength)
+	expire := time.Now().Add(shareProofCodeExpiry)
+	if _, err := DB.Exec(
+		"INSERT INTO ShareVerification(id, share, email, code, expire) VALUES(?, ?, ?, ?, ?)",
+		id, s.Id, email, code, expire.UnixNano()/1000000,
+	); err != nil {
+		return proof, err
+	}
+	e, err := EmailRender("verification", struct {
+		Code     string
+		Email    string
+		Share    string
+		Username string
+	}{code, email, s.Id, networkDriveUsernameEnc(v)})
+	if err != nil {
+		Log.Subsystem("share").Error("share %s: can't render the verification email %s", s.Id, err.Error())
+		return proof, NewError("Couldn't send email", 500)
+	}
+	e.To = []string{email}
+	e.Expire = &expire
+
+	proof.Id = id
+	proof.Key = "code"
+	proof.Value = ""
+	proof.Message = NewString("We've sent you a message with a verification code")
+	if err := EmailQueue(e); err != nil {
+		Log.Subsystem("share").Error("share %s: can't send the verification email %s", s.Id, err.Error())
+		return proof, NewError("Couldn't send email", 500)
+	}
+	return proof, nil
+}
+
+// shareProofCode is the second step of the email proof, it's never required on its own. The code
+// comes along with the id of the verification it was sent for. Wrong codes count as attempts against
+// that verification only, people trying to guess it can't revoke the codes sent to others
+type shareProofCode struct{}
+
+func (p shareProofCode) Key() string {
+	return "code"
+}
+
+func (p shareProofCode) Required(s Share) (string, bool) {
+	return "", false
+}
+
+func (p shareProofCode) Verify(s Share, proof Proof, req *http.Request) (Proof, error) {
+	now := time.Now().UnixNano() / 1000000
+	attempts := LockoutAttempts() // as with the lockout, 0 means no limit
+	var email, code string
+	err := DB.QueryRow(
+		"SELECT email, code FROM ShareVerification WHERE id = ?1 AND share = ?2 AND expire > ?3 AND (?4 <= 0 OR attempts < ?4)",
+		proof.Id, s.Id, now, attempts,
+	).Scan(&email, &code)
+	if err == nil && subtle.ConstantTimeCompare([]byte(code), []byte(strings.TrimSpace(proof.Value))) != 1 {
+		// the same code can be tried again until it runs out of attempts
+		revoked := false
+		if attempts > 0 {
+			DB.Exec("UPDATE ShareVerification SET attempts = attempts + 1 WHERE id = ?", proof.Id)
+			if r, err := DB.Exec("DELETE FROM ShareVerification WHERE id = ? AND attempts >= ?", proof.Id, attempts); err == nil {
+				if n, _ := r.RowsAffected(); n > 0 {
+					revoked = true
+					Log.Subsystem("share").Warning("share %s: too many wrong verification codes, the code sent to %s is revoked", s.Id, email)
+				}
+			}
+		}
+		if !revoked {
+			proof.Value = ""
+			return proof, NewError("Invalid verification code", 403)
+		}
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		proof.Id = ""
+		proof.Key = "email"
+		proof.Value = ""
+		return proof, NewError("Invalid verification code", 403)
+	} else if err != nil {
+		return proof, err
+	}
+
+	// cleanup so that the code can't be used again
+	DB.Exec("DELETE FROM ShareVerification WHERE share = ? AND email = ?", s.Id, email)
+	if s.Users == nil {
+		return proof, NewError("Authentication not required", 400)
+	}
+	user, ok := ShareProofVerifierEmail(*s.Users, email)
+	if !ok {
+		return proof, ErrNotAuthorized
+	}
+	proof.Key = "email"
+	proof.Value = user
+	return proof, nil
+}
+
+type shareProofTotp struct{}
+
+func (p shareProofTotp) Key() string {
+	return "totp"
+}
+
+func (p shareProofTotp) Required(s Share) (string, bool) {
+	if s.Totp == nil {
+		return "", false
+	}
+	return *s.Totp, true
+}
+
+func (p shareProofTotp) Verify(s Share, proof Proof, req *http.Request) (Proof, error) {
+	if s.Totp == nil {
+		return proof, NewError("No verification code required", 400)
+	}
+	secret, err := DecryptString(SecretKeyDerivateForProof, *s.Totp)
+	if err != nil {
+		return proof, NewError("Invalid verification code", 403)
+	}
+	step, ok := TotpVerify(secret, strings.TrimSpace(proof.Value))
+	if !ok {
+		return proof, NewError("Invalid verification code", 403)
+	}
+	// like for the admin, a code can only be used once. Recording the step only when it's newer than
+	// the last one makes it so 2 requests racing with the same code can't both get through
+	res, err := DB.Exec(
+		"INSERT INTO ShareTotp(share, last_step) VALUES(?, ?) ON CONFLICT(share) DO UPDATE SET last_step = excluded.last_step WHERE ShareTotp.last_step < excluded.last_step",
+		s.Id, step,
+	)
+	if err != nil {
+		return proof, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return proof, NewError("Invalid verification code", 403)
+	}
+	proof.Value = *s.Totp
+	return proof, nil
+}
@@ -0,0 +1,398 @@
+package model
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+// ShareUpload is a file that came in through a shared link. The entry is made before the upload
+// happens so that the limits of the link hold with concurrent uploads
+type ShareUpload struct {
+	Id       int64  `json:"-"`
+	Share    string `json:"-"`
+	Time     int64  `json:"time"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Identity string `json:"identity,omitempty"`
+	Notified int    `json:"-"`
+}
+
+// the channels an upload has been notified through. An upload is only marked as notified once all
+// of them went through so that a failing webhook doesn't send the same email over and over
+const (
+	shareUploadNotified        = 1
+	shareUploadNotifiedEmail   = 2
+	shareUploadNotifiedWebhook = 4
+)
+
+var (
+	ShareUploadDigest  func() time.Duration
+	ShareUploadWebhook func() bool
+
+	shareUploadLog        = Log.Subsystem("share")
+	shareUploadNotifyLock sync.Mutex
+
+	// the webhooks are given by the people sharing links, they can't be used to reach what's only
+	// available from the server. The check is made on the address being connected to so that a
+	// hostname can't resolve to something else after the link was saved
+	shareUploadWebhookClient = http.Client{
+		Timeout: 10000 * time.Millisecond,
+		Transport: NewTransformedTransport(http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   5000 * time.Millisecond,
+				KeepAlive: 5000 * time.Millisecond,
+				Control: func(network string, address string, c syscall.RawConn) error {
+					host, _, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					if !ShareUploadWebhookAllowed(net.ParseIP(host)) {
+						return fmt.Errorf("webhook can't reach %s", host)
+					}
+					return nil
+				},
+			}).DialContext,
+			TLSHandshakeTimeout:   5000 * time.Millisecond,
+			IdleConnTimeout:       5000 * time.Millisecond,
+			ResponseHeaderTimeout: 5000 * time.Millisecond,
+		}),
+	}
+)
+
+func init() {
+	ShareUploadDigest = func() time.Duration {
+		return time.Duration(Config.Get("features.share.upload_digest").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "upload_digest"
+			f.Type = "number"
+			f.Default = 60
+			f.Description = "Time in minutes between two digests of the files uploaded onto a shared link. Failed notifications are retried at the same pace"
+			f.Placeholder = fmt.Sprintf("Default: %dmn", f.Default)
+			return f
+		}).Int()) * time.Minute
+	}
+	ShareUploadDigest()
+	ShareUploadWebhook = func() bool {
+		return Config.Get("features.share.upload_webhook").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "upload_webhook"
+			f.Type = "boolean"
+			f.Default = false
+			f.Description = "Let the people sharing links be notified of the uploads through a webhook. The server then makes requests to the URLs they give"
+			return f
+		}).Bool()
+	}
+	ShareUploadWebhook()
+	EmailRegisterTemplate("upload", func() EmailTemplate {
+		return EmailTemplate{
+			Subject: "{{ len .Uploads }} new file(s) on the shared link '{{ .Share.Id }}'",
+			Html:    TmplEmailUpload(),
+			Text:    TmplEmailUploadText(),
+			Funcs: map[string]interface{}{
+				"size": shareUploadSize,
+				"date": func(t int64) string { return time.UnixMilli(t).Format(time.RFC1123) },
+			},
+		}
+	})
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ShareUpload(id INTEGER PRIMARY KEY AUTOINCREMENT, share VARCHAR(64) NOT NULL, time INTEGER NOT NULL, path VARCHAR(1024), size INTEGER NOT NULL DEFAULT 0, identity VARCHAR(256), done INTEGER NOT NULL DEFAULT 0, notified INTEGER NOT NULL DEFAULT 0, FOREIGN KEY (share) REFERENCES Share(id) ON UPDATE CASCADE ON DELETE CASCADE)"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_shareupload_share ON ShareUpload(share, done, notified)"); err == nil {
+			stmt.Exec()
+		}
+	}
+
+	go func() {
+		for {
+			if d := ShareUploadDigest(); d > time.Minute {
+				time.Sleep(d)
+			} else {
+				time.Sleep(time.Minute)
+			}
+			shareUploadNotifyPending()
+		}
+	}()
+}
+
+// ShareUploadTake makes room for a file about to be uploaded onto a shared link, as long as it fits in
+// the limits of the link. The returned id is to be given to either ShareUploadDone or ShareUploadRelease,
+// it's 0 for links that have neither notifications nor limits as their uploads aren't tracked
+func ShareUploadTake(s Share, path string, size int64, identity string) (int64, error) {
+	if s.Notify == nil && s.MaxUploads == nil && s.MaxUploadSize == nil && s.UploadExtensions == nil {
+		return 0, nil
+	}
+	if s.UploadExtensions != nil && *s.UploadExtensions != "" {
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+		allowed := false
+		for _, e := range strings.Split(*s.UploadExtensions, ",") {
+			if strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), ".")) == ext {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return 0, NewError("This type of file isn't accepted", 415)
+		}
+	}
+	if s.MaxUploadSize != nil && size < 0 {
+		return 0, NewError("The size of the file is required", 411)
+	}
+	if size < 0 {
+		size = 0
+	}
+	limit := func(max *int64) sql.NullInt64 {
+		if max == nil {
+			return sql.NullInt64{}
+		}
+		return sql.NullInt64{Int64: *max, Valid: true}
+	}
+	r, err := DB.Exec(
+		"INSERT INTO ShareUpload(share, time, path, size, identity) SELECT ?1, ?2, ?3, ?4, ?5 WHERE "+
+			"(?6 IS NULL OR (SELECT COUNT(*) FROM ShareUpload WHERE share = ?1) < ?6) AND "+
+			"(?7 IS NULL OR (SELECT COALESCE(SUM(size), 0) FROM ShareUpload WHERE share = ?1) + ?4 <= ?7)",
+		s.Id, time.Now().UnixNano()/1000000, path, size, identity, limit(s.MaxUploads), limit(s.MaxUploadSize),
+	)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		if s.MaxUploadSize != nil && size > 0 {
+			var count int64
+			if err := DB.QueryRow("SELECT COUNT(*) FROM ShareUpload WHERE share = ?", s.Id).Scan(&count); err == nil && (s.MaxUploads == nil || count < *s.MaxUploads) {
+				return 0, NewError("The file is bigger than what this link still accepts", 413)
+			}
+		}
+		return 0, NewError("This link doesn't accept any more files", 403)
+	}
+	return r.LastInsertId()
+}
+
+// ShareUploadDone records the upload as complete and notifies the owner of the link unless they'd rather
+// get a digest
+func ShareUploadDone(s Share, id int64, size int64) error {
+	if _, err := DB.Exec("UPDATE ShareUpload SET done = 1, size = ? WHERE id = ?", size, id); err != nil {
+		return err
+	}
+	if s.Notify == nil || s.Notify.Digest {
+		return nil
+	}
+	go shareUploadNotify(s)
+	return nil
+}
+
+func ShareUploadRelease(id int64) error {
+	_, err := DB.Exec("DELETE FROM ShareUpload WHERE id = ? AND done = 0", id)
+	return err
+}
+
+func shareUploadPending(share string) ([]ShareUpload, error) {
+	rows, err := DB.Query("SELECT id, share, time, path, size, identity, notified FROM ShareUpload WHERE share = ? AND done = 1 AND notified != ? ORDER BY id", share, shareUploadNotified)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	uploads := []ShareUpload{}
+	for rows.Next() {
+		var u ShareUpload
+		var identity sql.NullString
+		if err := rows.Scan(&u.Id, &u.Share, &u.Time, &u.Path, &u.Size, &identity, &u.Notified); err != nil {
+			return nil, err
+		}
+		u.Identity = identity.String
+		u.Name = filepath.Base(u.Path)
+		uploads = append(uploads, u)
+	}
+	return uploads, rows.Err()
+}
+
+// shareUploadNotifyPending sends the digests along with the notifications that previously failed
+func shareUploadNotifyPending() {
+	rows, err := DB.Query("SELECT DISTINCT share FROM ShareUpload WHERE done = 1 AND notified != ?", shareUploadNotified)
+	if err != nil {
+		shareUploadLog.Error("can't read the pending uploads %s", err.Error())
+		return
+	}
+	shares := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			shares = append(shares, id)
+		}
+	}
+	rows.Close()
+	for _, id := range shares {
+		if s, err := ShareGet(id); err == nil {
+			shareUploadNotify(s)
+		}
+	}
+}
+
+// shareUploadNotify tells the owner of the link about the uploads they haven't heard of yet. It's
+// serialised so that an upload can't be part of 2 notifications. Each channel only gets the uploads it
+// hasn't been told about, what went through isn't sent again when another channel fails
+func shareUploadNotify(s Share) {
+	shareUploadNotifyLock.Lock()
+	defer shareUploadNotifyLock.Unlock()
+	uploads, err := shareUploadPending(s.Id)
+	if err != nil {
+		shareUploadLog.Error("share %s: can't read the uploads %s", s.Id, err.Error())
+		return
+	} else if len(uploads) == 0 {
+		return
+	}
+	notify := func(flag int, send func([]ShareUpload) error) error {
+		pending := []ShareUpload{}
+		for _, u := range uploads {
+			if u.Notified&flag == 0 {
+				pending = append(pending, u)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		} else if send != nil {
+			if err := send(pending); err != nil {
+				return err
+			}
+		}
+		return shareUploadMark(pending, "notified | ?", flag)
+	}
+	var email, webhook func([]ShareUpload) error
+	if s.Notify != nil && s.Notify.Email != "" {
+		email = func(u []ShareUpload) error { return shareUploadNotifyEmail(s, u) }
+	}
+	if s.Notify != nil && s.Notify.Webhook != "" && ShareUploadWebhook() {
+		webhook = func(u []ShareUpload) error { return shareUploadNotifyWebhook(s, u) }
+	}
+	if err := notify(shareUploadNotifiedEmail, email); err != nil {
+		shareUploadLog.Error("share %s: can't send the upload notification %s", s.Id, err.Error())
+		return
+	}
+	if err := notify(shareUploadNotifiedWebhook, webhook); err != nil {
+		shareUploadLog.Error("share %s: can't call the upload webhook %s", s.Id, err.Error())
+		return
+	}
+	if err := shareUploadMark(uploads, "?", shareUploadNotified); err != nil {
+		shareUploadLog.Error("share %s: can't mark the uploads as notified %s", s.Id, err.Error())
+	}
+}
+
+func shareUploadMark(uploads []ShareUpload, value string, flag int) error {
+	ids := make([]string, len(uploads))
+	args := []interface{}{flag}
+	for i := range uploads {
+		ids[i] = "?"
+		args = append(args, uploads[i].Id)
+	}
+	_, err := DB.Exec("UPDATE ShareUpload SET notified = "+value+" WHERE id IN ("+strings.Join(ids, ",")+")", args...)
+	return err
+}
+
+func shareUploadNotifyEmail(s Share, uploads []ShareUpload) error {
+	e, err := EmailRender("upload", struct {
+		Share   Share
+		Uploads []ShareUpload
+	}{s, uploads})
+	if err != nil {
+		return err
+	}
+	for _, email := range strings.Split(s.Notify.Email, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			e.To = append(e.To, email)
+		}
+	}
+	return EmailQueue(e)
+}
+
+func shareUploadNotifyWebhook(s Share, uploads []ShareUpload) error {
+	body, err := json.Marshal(struct {
+		Event   string        `json:"event"`
+		Share   string        `json:"share"`
+		Path    string        `json:"path"`
+		Uploads []ShareUpload `json:"uploads"`
+	}{"share.upload", s.Id, s.Path, uploads})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.Notify.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := shareUploadWebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered with %d", res.StatusCode)
+	}
+	return nil
+}
+
+// ShareUploadWebhookAllowed tells if a webhook can be sent to the address, only public ones are
+func ShareUploadWebhookAllowed(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	// carrier grade NAT, as private as the ranges above for the servers sitting behind it
+	if _, cgnat, _ := net.ParseCIDR("100.64.0.0/10"); cgnat.Contains(ip) {
+		return false
+	}
+	return true
+}
+
+func shareUploadSize(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i += 1
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
+
+func TmplEmailUpload() string {
+	return `
+<!doctype html>
+<html>
+  <body style="font-family: sans-serif; color: #333;">
+    <p>New files have been uploaded onto the shared link <strong>{{ .Share.Id }}</strong> ({{ .Share.Path }}):</p>
+    <table cellpadding="6" style="border-collapse: collapse;">
+      <tr style="text-align: left;"><th>File</th><th>Size</th><th>From</th><th>Date</th></tr>
+      {{ range .Uploads }}
+      <tr><td>{{ .Name }}</td><td>{{ size .Size }}</td><td>{{ if .Identity }}{{ .Identity }}{{ else }}anonymous{{ end }}</td><td>{{ date .Time }}</td></tr>
+      {{ end }}
+    </table>
+  </body>
+</html>`
+}
+
+func TmplEmailUploadText() string {
+	return `New files have been uploaded onto the shared link {{ .Share.Id }} ({{ .Share.Path }}):
+{{ range .Uploads }}
+- {{ .Name }}, {{ size .Size }}, from {{ if .Identity }}{{ .Identity }}{{ else }}anonymous{{ end }} on {{ date .Time }}{{ end }}
+`
+}
@@ -0,0 +1,84 @@
+package model
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+// ShareWatermark is what the watermark of a view only link can refer to, eg:
+// "{{ .Email }} - {{ .Date }}". The email is the one the person proved to own
+type ShareWatermark struct {
+	Email string
+	Ip    string
+	Date  string
+	Share string
+}
+
+const ShareWatermarkDefault = "{{ if .Email }}{{ .Email }}{{ else }}{{ .Ip }}{{ end }} - {{ .Date }}"
+
+// ShareWatermarkText gives the text to stamp onto what a view only link serves to the person making
+// the request. Nothing gets served to people whose email isn't known, eg: links made before it was required
+func ShareWatermarkText(s Share, req *http.Request) (string, error) {
+	email := ShareProofGetIdentity(req, s)
+	if email == "" {
+		return "", ErrNotAuthorized
+	}
+	tmpl := ShareWatermarkDefault
+	if s.Watermark != nil {
+		tmpl = *s.Watermark
+	}
+	t, err := template.New("watermark").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err = t.Execute(&b, ShareWatermark{
+		Email: email,
+		Ip:    RemoteIP(req),
+		Date:  time.Now().Format("2006-01-02 15:04 MST"),
+		Share: s.Id,
+	}); err != nil {
+		return "", err
+	}
+	return strings.Join(strings.Fields(b.String()), " "), nil
+}
+
+// shareWatermarkConfigure checks the watermark of a link before it gets saved. A view only link handing
+// out the right to share would let people make another link onto the same files without any watermark.
+// The watermark is only worth something when it tells who's looking, which takes the email proof. As
+// files are opened rather than downloaded, a view only link can't count downloads either
+func shareWatermarkConfigure(s *Share) error {
+	if !s.ViewOnly {
+		s.Watermark = nil
+		return nil
+	}
+	if s.CanShare {
+		return NewError("A view only link can't be shared further", 400)
+	}
+	if s.Users == nil || strings.TrimSpace(*s.Users) == "" {
+		return NewError("A view only link has to ask for the email of the people using it", 400)
+	}
+	if s.MaxDownloads != nil || s.OneShot {
+		return NewError("A view only link can't limit its downloads", 400)
+	}
+	if s.Watermark == nil {
+		return nil
+	}
+	if strings.TrimSpace(*s.Watermark) == "" {
+		s.Watermark = nil
+		return nil
+	}
+	t, err := template.New("watermark").Parse(*s.Watermark)
+	if err == nil {
+		err = t.Execute(&bytes.Buffer{}, ShareWatermark{})
+	}
+	if err != nil {
+		return NewError("Invalid watermark", 400)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+// SignedUrl gives access to a single file without any cookie, eg: to embed it in a wiki. Everything is
+// carried by the URL and covered by its signature, the server only keeps a key version per user so
+// they can revoke all the URLs they've handed out at once, along with the session the file is read with.
+// People sharing the same backend each have their own key, one can't revoke nor use the URLs of another
+type SignedUrl struct {
+	Owner       string `json:"-"`
+	Backend     string `json:"-"`
+	Path        string `json:"path"`
+	Expire      int64  `json:"expire"`
+	Ip          string `json:"ip,omitempty"`
+	Disposition string `json:"disposition,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+}
+
+var (
+	SignedUrlEnable    func() bool
+	SignedUrlMaxExpiry func() time.Duration
+)
+
+func init() {
+	SignedUrlEnable = func() bool {
+		return Config.Get("features.signed_url.enable").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "enable"
+			f.Type = "enable"
+			f.Target = []string{"signed_url_max_expiry"}
+			f.Default = true
+			f.Description = "Let people make signed URLs to download a single file without being logged in, eg: to embed it somewhere else"
+			return f
+		}).Bool()
+	}
+	SignedUrlEnable()
+	SignedUrlMaxExpiry = func() time.Duration {
+		return time.Duration(Config.Get("features.signed_url.max_expiry").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "signed_url_max_expiry"
+			f.Name = "max_expiry"
+			f.Type = "number"
+			f.Default = 168
+			f.Description = "Number of hours a signed URL can remain valid. Set to 0 for no limit"
+			f.Placeholder = fmt.Sprintf("Default: %dh", f.Default)
+			return f
+		}).Int()) * time.Hour
+	}
+	SignedUrlMaxExpiry()
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS SignedUrlKey(owner VARCHAR(32) NOT NULL, backend VARCHAR(16) NOT NULL, version INTEGER NOT NULL DEFAULT 1, auth VARCHAR(4093) NOT NULL, CONSTRAINT pk_signedurlkey PRIMARY KEY(owner, backend))"); err == nil {
+		stmt.Exec()
+	}
+}
+
+// SignedUrlCreate signs the URL of a file on behalf of its owner. The session given as auth is the one
+// the file gets read with, its permissions are checked again on every download
+func SignedUrlCreate(u *SignedUrl, auth string) (url.Values, error) {
+	if !SignedUrlEnable() {
+		return nil, NewError("Feature isn't enable, contact your administrator", 405)
+	}
+	now := time.Now()
+	if u.Expire == 0 {
+		u.Expire = now.Add(24*time.Hour).UnixNano() / 1000000
+		if max := SignedUrlMaxExpiry(); max > 0 && max < 24*time.Hour {
+			u.Expire = now.Add(max).UnixNano() / 1000000
+		}
+	}
+	if u.Expire <= now.UnixNano()/1000000 {
+		return nil, NewError("The expiry is in the past", 400)
+	} else if max := SignedUrlMaxExpiry(); max > 0 && u.Expire > now.Add(max).UnixNano()/1000000 {
+		return nil, NewError(fmt.Sprintf("Signed URLs can't last more than %d hours", int(max.Hours())), 400)
+	}
+	if u.Ip != "" && net.ParseIP(u.Ip) == nil {
+		return nil, NewError("Invalid IP", 400)
+	}
+	switch u.Disposition {
+	case "", "inline", "attachment":
+	default:
+		return nil, NewError("The disposition is either inline or attachment", 400)
+	}
+	if strings.ContainsAny(u.Filename, "/\\\r\n\"") {
+		return nil, NewError("Invalid filename", 400)
+	}
+
+	if _, err := DB.Exec(
+		"INSERT INTO SignedUrlKey(owner, backend, version, auth) VALUES(?1, ?2, 1, ?3) "+
+			"ON CONFLICT(owner, backend) DO UPDATE SET auth = ?3",
+		u.Owner, u.Backend, auth,
+	); err != nil {
+		return nil, err
+	}
+	version, _, err := signedUrlKey(u.Owner, u.Backend)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Set("o", u.Owner)
+	q.Set("b", u.Backend)
+	q.Set("path", u.Path)
+	q.Set("expire", strconv.FormatInt(u.Expire, 10))
+	if u.Ip != "" {
+		q.Set("ip", u.Ip)
+	}
+	if u.Disposition != "" {
+		q.Set("disposition", u.Disposition)
+	}
+	if u.Filename != "" {
+		q.Set("filename", u.Filename)
+	}
+	q.Set("signature", signedUrlSignature(*u, version))
+	return q, nil
+}
+
+// SignedUrlVerify checks the query of a signed URL coming from the given IP. It gives back what the URL
+// is about and the session of its owner
+func SignedUrlVerify(q url.Values, ip string) (SignedUrl, string, error) {
+	if !SignedUrlEnable() {
+		return SignedUrl{}, "", NewError("Feature isn't enable, contact your administrator", 405)
+	}
+	u := SignedUrl{
+		Owner:       q.Get("o"),
+		Backend:     q.Get("b"),
+		Path:        q.Get("path"),
+		Ip:          q.Get("ip"),
+		Disposition: q.Get("disposition"),
+		Filename:    q.Get("filename"),
+	}
+	expire, err := strconv.ParseInt(q.Get("expire"), 10, 64)
+	if err != nil || u.Owner == "" || u.Backend == "" || u.Path == "" {
+		return u, "", ErrNotValid
+	}
+	u.Expire = expire
+	version, auth, err := signedUrlKey(u.Owner, u.Backend)
+	if err == sql.ErrNoRows {
+		return u, "", ErrNotAuthorized
+	} else if err != nil {
+		return u, "", err
+	}
+	if !hmac.Equal([]byte(q.Get("signature")), []byte(signedUrlSignature(u, version))) {
+		return u, "", ErrNotAuthorized
+	}
+	if time.Now().UnixNano()/1000000 > u.Expire {
+		return u, "", NewError("Link has expired", 410)
+	}
+	if u.Ip != "" && !net.ParseIP(u.Ip).Equal(net.ParseIP(ip)) {
+		return u, "", ErrNotAuthorized
+	}
+	return u, auth, nil
+}
+
+// SignedUrlOwner identifies the user signing URLs: the identity of their session when they have one,
+// it can only be set by an authentication plugin, the credentials they're connected with otherwise. The
+// timestamp of the login is left aside as it changes every time the user logs in again
+func SignedUrlOwner(ctx *App) string {
+	if id := ctx.Session["identity"]; id != "" {
+		return Hash("identity::"+id+SecretKeyDerivateForHash, 20)
+	}
+	credentials := make(map[string]string, len(ctx.Session))
+	for key, value := range ctx.Session {
+		if key != "timestamp" {
+			credentials[key] = value
+		}
+	}
+	session, _ := json.Marshal(credentials)
+	return Hash("session::"+string(session)+SecretKeyDerivateForHash, 20)
+}
+
+// SignedUrlRevoke invalidates every URL a user has signed so far on a backend by moving onto the next
+// key version. The URLs the same user signed while connected somewhere else are left alone
+func SignedUrlRevoke(owner string, backend string) error {
+	_, err := DB.Exec("UPDATE SignedUrlKey SET version = version + 1 WHERE owner = ? AND backend = ?", owner, backend)
+	return err
+}
+
+func signedUrlKey(owner string, backend string) (int64, string, error) {
+	var version int64
+	var auth string
+	err := DB.QueryRow("SELECT version, auth FROM SignedUrlKey WHERE owner = ? AND backend = ?", owner, backend).Scan(&version, &auth)
+	return version, auth, err
+}
+
+func signedUrlSignature(u SignedUrl, version int64) string {
+	mac := hmac.New(sha256.New, []byte(fmt.Sprintf("%s::signed_url::%s::%s::%d", SecretKeyDerivateForHash, u.Owner, u.Backend, version)))
+	mac.Write([]byte(strings.Join([]string{
+		u.Owner,
+		u.Backend,
+		u.Path,
+		strconv.FormatInt(u.Expire, 10),
+		u.Ip,
+		u.Disposition,
+		u.Filename,
+	}, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,169 @@
+package model
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"strings"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+)
+
+func init() {
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ApiToken(id VARCHAR(16) PRIMARY KEY, hash VARCHAR(64) NOT NULL, related_backend VARCHAR(16) NOT NULL, name VARCHAR(128), path VARCHAR(512) NOT NULL, permissions VARCHAR(64) NOT NULL, auth VARCHAR(4093) NOT NULL, expire INTEGER, created INTEGER NOT NULL, last_used INTEGER)"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX idx_apitoken_backend ON ApiToken(related_backend)"); err == nil {
+			stmt.Exec()
+		}
+	}
+}
+
+// TokenList gives back the tokens owned by a user. The secret part of a token is only ever known
+// at creation time, what we keep is a hash of it.
+func TokenList(backend string) ([]Token, error) {
+	rows, err := DB.Query("SELECT id, name, path, permissions, expire, created, last_used FROM ApiToken WHERE related_backend = ? ORDER BY created", backend)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []Token{}
+	for rows.Next() {
+		t, err := tokenScan(rows, false)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// TokenCreate persists a new token and fill t.Value with the string the user will need to send as
+// "Authorization: Bearer <token>"
+func TokenCreate(t *Token) error {
+	if t.Backend == "" || t.Auth == "" || t.Path == "" {
+		return ErrNotValid
+	} else if !t.CanRead && !t.CanWrite && !t.CanUpload && !t.CanShare {
+		return NewError("A token needs at least one permission", 400)
+	}
+	t.Id = RandomString(16)
+	t.Created = time.Now().UnixNano() / 1000000
+	secret := RandomString(48)
+	_, err := DB.Exec(
+		"INSERT INTO ApiToken(id, hash, related_backend, name, path, permissions, auth, expire, created) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		t.Id, tokenHash(secret), t.Backend, t.Name, t.Path, strings.Join(tokenPerms(*t), ","), t.Auth, t.Expire, t.Created,
+	)
+	if err != nil {
+		return err
+	}
+	t.Value = NewString(t.Id + "." + secret)
+	return nil
+}
+
+func TokenDelete(backend string, id string) error {
+	r, err := DB.Exec("DELETE FROM ApiToken WHERE id = ? AND related_backend = ?", id, backend)
+	if err != nil {
+		return err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// TokenVerify takes what was given in the Authorization header and gives back the matching token
+func TokenVerify(value string) (Token, error) {
+	var t Token
+	s := strings.SplitN(value, ".", 2)
+	if len(s) != 2 || s[0] == "" || s[1] == "" {
+		return t, ErrNotAuthorized
+	}
+	row := DB.QueryRow("SELECT id, name, path, permissions, expire, created, last_used, hash, related_backend, auth FROM ApiToken WHERE id = ?", s[0])
+	t, err := tokenScan(row, true)
+	if err == sql.ErrNoRows {
+		return t, ErrNotAuthorized
+	} else if err != nil {
+		return t, err
+	}
+	if subtle.ConstantTimeCompare([]byte(*t.Value), []byte(tokenHash(s[1]))) != 1 {
+		return Token{}, ErrNotAuthorized
+	}
+	t.Value = nil
+	if err = t.IsValid(); err != nil {
+		return Token{}, err
+	}
+
+	// no need to hammer the database on every single request
+	now := time.Now().UnixNano() / 1000000
+	if t.LastUsed == nil || now-*t.LastUsed > 60*1000 {
+		DB.Exec("UPDATE ApiToken SET last_used = ? WHERE id = ?", now, t.Id)
+	}
+	return t, nil
+}
+
+type tokenScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func tokenScan(row tokenScanner, private bool) (Token, error) {
+	var (
+		t        Token
+		name     sql.NullString
+		perms    string
+		expire   sql.NullInt64
+		lastUsed sql.NullInt64
+		hash     string
+		err      error
+	)
+	if private {
+		err = row.Scan(&t.Id, &name, &t.Path, &perms, &expire, &t.Created, &lastUsed, &hash, &t.Backend, &t.Auth)
+		t.Value = &hash
+	} else {
+		err = row.Scan(&t.Id, &name, &t.Path, &perms, &expire, &t.Created, &lastUsed)
+	}
+	if err != nil {
+		return t, err
+	}
+	t.Name = name.String
+	if expire.Valid {
+		t.Expire = &expire.Int64
+	}
+	if lastUsed.Valid {
+		t.LastUsed = &lastUsed.Int64
+	}
+	for _, p := range strings.Split(perms, ",") {
+		switch p {
+		case PermRead:
+			t.CanRead = true
+		case PermEdit:
+			t.CanWrite = true
+		case PermUpload:
+			t.CanUpload = true
+		case PermShare:
+			t.CanShare = true
+		}
+	}
+	return t, nil
+}
+
+func tokenPerms(t Token) []string {
+	perms := []string{}
+	if t.CanRead {
+		perms = append(perms, PermRead)
+	}
+	if t.CanWrite {
+		perms = append(perms, PermEdit)
+	}
+	if t.CanUpload {
+		perms = append(perms, PermUpload)
+	}
+	if t.CanShare {
+		perms = append(perms, PermShare)
+	}
+	return perms
+}
+
+// tokenHash is a plain sha256: the secret part of a token is 48 random characters, there's nothing to
+// guess from its hash
+func tokenHash(secret string) string {
+	return Hash(secret, 64)
+}
@@ -0,0 +1,471 @@
+package model
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	. "github.com/bingoohuang/filestash/server/common"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RoleAdmin    = "admin"
+	RoleEditor   = "editor"
+	RoleViewer   = "viewer"
+	RoleUploader = "uploader"
+
+	PermRead   = "read"
+	PermEdit   = "edit"
+	PermUpload = "upload"
+	PermShare  = "share"
+)
+
+var (
+	Roles = []string{RoleAdmin, RoleEditor, RoleViewer, RoleUploader}
+	Perms = []string{PermRead, PermEdit, PermUpload, PermShare}
+
+	userCache AppCache
+	ruleCache AppCache
+)
+
+type User struct {
+	Username   string   `json:"username"`
+	Password   *string  `json:"password,omitempty"`
+	Role       string   `json:"role"`
+	Connection string   `json:"connection,omitempty"`
+	Source     string   `json:"source"`
+	Disabled   bool     `json:"disabled"`
+	Groups     []string `json:"groups"`
+	Created    int64    `json:"created"`
+}
+
+type Group struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Members     []string `json:"members"`
+}
+
+type AccessRule struct {
+	Id          int64    `json:"id"`
+	Subject     string   `json:"subject"`
+	Path        string   `json:"path"`
+	Permissions []string `json:"permissions"`
+	Effect      string   `json:"effect"`
+}
+
+func init() {
+	userCache = NewQuickCache(10, 20)
+	ruleCache = NewQuickCache(10, 20)
+	Config.Get("auth.default_role").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Name = "default_role"
+		f.Type = "select"
+		f.Default = RoleEditor
+		f.Opts = Roles
+		f.Description = "Role given to users coming from an external directory (eg: LDAP) the first time they login"
+		return f
+	})
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS User(username VARCHAR(64) PRIMARY KEY, password VARCHAR(128), role VARCHAR(16) NOT NULL, connection VARCHAR(128), source VARCHAR(16) NOT NULL DEFAULT 'local', disabled BOOLEAN NOT NULL DEFAULT 0, created DATETIME DEFAULT CURRENT_TIMESTAMP)"); err == nil {
+		stmt.Exec()
+	}
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS UserGroup(name VARCHAR(64) PRIMARY KEY, description VARCHAR(512))"); err == nil {
+		stmt.Exec()
+	}
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS UserGroupMember(group_name VARCHAR(64), username VARCHAR(64), CONSTRAINT pk_member PRIMARY KEY(group_name, username), FOREIGN KEY (group_name) REFERENCES UserGroup(name) ON UPDATE CASCADE ON DELETE CASCADE, FOREIGN KEY (username) REFERENCES User(username) ON UPDATE CASCADE ON DELETE CASCADE)"); err == nil {
+		stmt.Exec()
+	}
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS AccessRule(id INTEGER PRIMARY KEY AUTOINCREMENT, subject VARCHAR(128) NOT NULL, path VARCHAR(512) NOT NULL, permissions VARCHAR(64) NOT NULL, effect VARCHAR(8) NOT NULL DEFAULT 'allow')"); err == nil {
+		stmt.Exec()
+	}
+}
+
+func UserList() ([]User, error) {
+	rows, err := DB.Query("SELECT username, role, connection, source, disabled, created FROM User ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	for rows.Next() {
+		u, err := userScan(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	for i := range users {
+		users[i].Groups, _ = userGroups(users[i].Username)
+	}
+	return users, nil
+}
+
+func UserGet(username string) (User, error) {
+	key := map[string]string{"username": username}
+	if u := userCache.Get(key); u != nil {
+		return u.(User), nil
+	}
+	row := DB.QueryRow("SELECT username, role, connection, source, disabled, created FROM User WHERE username = ?", username)
+	u, err := userScan(row)
+	if err == sql.ErrNoRows {
+		return u, ErrNotFound
+	} else if err != nil {
+		return u, err
+	}
+	if u.Groups, err = userGroups(username); err != nil {
+		return u, err
+	}
+	userCache.Set(key, u)
+	return u, nil
+}
+
+func UserUpsert(u *User) error {
+	if u.Username == "" {
+		return ErrNotValid
+	} else if !isRole(u.Role) {
+		return NewError("Unknown role", 400)
+	}
+	if u.Source == "" {
+		u.Source = "local"
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(
+		"INSERT INTO User(username, role, connection, source, disabled) VALUES($1, $2, $3, $4, $5) ON CONFLICT(username) DO UPDATE SET role = $2, connection = $3, disabled = $5",
+		u.Username, u.Role, u.Connection, u.Source, u.Disabled,
+	); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if u.Password != nil && *u.Password != PasswordDummy {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*u.Password), bcrypt.DefaultCost)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err = tx.Exec("UPDATE User SET password = ? WHERE username = ?", string(hashedPassword), u.Username); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if u.Groups != nil {
+		if _, err = tx.Exec("DELETE FROM UserGroupMember WHERE username = ?", u.Username); err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, g := range u.Groups {
+			if _, err = tx.Exec("INSERT INTO UserGroupMember(group_name, username) VALUES(?, ?)", g, u.Username); err != nil {
+				tx.Rollback()
+				return NewError("Unknown group '"+g+"'", 400)
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	userCache.Cache.Flush()
+	return nil
+}
+
+// UserProvision creates the account of a user coming from an external directory the first time they
+// login. Existing accounts are left untouched so that admins can change their role.
+func UserProvision(username string, source string) (User, error) {
+	if _, err := DB.Exec(
+		"INSERT INTO User(username, role, source) VALUES(?, ?, ?) ON CONFLICT(username) DO NOTHING",
+		username, Config.Get("auth.default_role").String(), source,
+	); err != nil {
+		return User{}, err
+	}
+	u, err := UserGet(username)
+	if err != nil {
+		return u, err
+	} else if u.Source != source {
+		return u, NewError("This account is managed by another authentication source", 403)
+	} else if u.Disabled {
+		return u, NewError("This account is disabled", 403)
+	}
+	return u, nil
+}
+
+func UserDelete(username string) error {
+	_, err := DB.Exec("DELETE FROM User WHERE username = ?", username)
+	userCache.Cache.Flush()
+	return err
+}
+
+func UserAuthenticate(username string, password string) (User, error) {
+	var hash sql.NullString
+	if err := DB.QueryRow("SELECT password FROM User WHERE username = ? AND source = 'local'", username).Scan(&hash); err != nil {
+		return User{}, ErrAuthenticationFailed
+	}
+	if !hash.Valid || bcrypt.CompareHashAndPassword([]byte(hash.String), []byte(password)) != nil {
+		return User{}, ErrAuthenticationFailed
+	}
+	u, err := UserGet(username)
+	if err != nil {
+		return u, err
+	} else if u.Disabled {
+		return u, NewError("This account is disabled", 403)
+	}
+	return u, nil
+}
+
+func userScan(row interface{ Scan(...interface{}) error }) (User, error) {
+	var u User
+	var connection sql.NullString
+	var created time.Time
+	if err := row.Scan(&u.Username, &u.Role, &connection, &u.Source, &u.Disabled, &created); err != nil {
+		return u, err
+	}
+	u.Connection = connection.String
+	u.Created = created.UnixNano() / int64(time.Millisecond)
+	return u, nil
+}
+
+func userGroups(username string) ([]string, error) {
+	rows, err := DB.Query("SELECT group_name FROM UserGroupMember WHERE username = ? ORDER BY group_name", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := []string{}
+	for rows.Next() {
+		var g string
+		if err = rows.Scan(&g); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func GroupList() ([]Group, error) {
+	rows, err := DB.Query("SELECT name, description FROM UserGroup ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	groups := []Group{}
+	for rows.Next() {
+		var g Group
+		var description sql.NullString
+		if err = rows.Scan(&g.Name, &description); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		g.Description = description.String
+		groups = append(groups, g)
+	}
+	rows.Close()
+	for i := range groups {
+		groups[i].Members = []string{}
+		rows, err := DB.Query("SELECT username FROM UserGroupMember WHERE group_name = ? ORDER BY username", groups[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var m string
+			if err = rows.Scan(&m); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			groups[i].Members = append(groups[i].Members, m)
+		}
+		rows.Close()
+	}
+	return groups, nil
+}
+
+func GroupUpsert(g *Group) error {
+	if g.Name == "" {
+		return ErrNotValid
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("INSERT INTO UserGroup(name, description) VALUES($1, $2) ON CONFLICT(name) DO UPDATE SET description = $2", g.Name, g.Description); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if g.Members != nil {
+		if _, err = tx.Exec("DELETE FROM UserGroupMember WHERE group_name = ?", g.Name); err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, m := range g.Members {
+			if _, err = tx.Exec("INSERT INTO UserGroupMember(group_name, username) VALUES(?, ?)", g.Name, m); err != nil {
+				tx.Rollback()
+				return NewError("Unknown user '"+m+"'", 400)
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	userCache.Cache.Flush()
+	return nil
+}
+
+func GroupDelete(name string) error {
+	_, err := DB.Exec("DELETE FROM UserGroup WHERE name = ?", name)
+	userCache.Cache.Flush()
+	return err
+}
+
+func AccessRuleList() ([]AccessRule, error) {
+	key := map[string]string{"rules": "all"}
+	if r := ruleCache.Get(key); r != nil {
+		return r.([]AccessRule), nil
+	}
+	rows, err := DB.Query("SELECT id, subject, path, permissions, effect FROM AccessRule ORDER BY length(path), id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []AccessRule{}
+	for rows.Next() {
+		var r AccessRule
+		var perms string
+		if err = rows.Scan(&r.Id, &r.Subject, &r.Path, &perms, &r.Effect); err != nil {
+			return nil, err
+		}
+		r.Permissions = strings.Split(perms, ",")
+		rules = append(rules, r)
+	}
+	ruleCache.Set(key, rules)
+	return rules, nil
+}
+
+func AccessRuleCreate(r *AccessRule) error {
+	if r.Effect == "" {
+		r.Effect = "allow"
+	}
+	if r.Effect != "allow" && r.Effect != "deny" {
+		return NewError("Effect must either be 'allow' or 'deny'", 400)
+	} else if !strings.HasPrefix(r.Subject, "user:") && !strings.HasPrefix(r.Subject, "group:") && r.Subject != "*" {
+		return NewError("Subject must be '*', 'user:<username>' or 'group:<name>'", 400)
+	} else if !strings.HasPrefix(r.Path, "/") {
+		return NewError("Path must be absolute", 400)
+	}
+	for _, p := range r.Permissions {
+		if !isPerm(p) {
+			return NewError("Unknown permission '"+p+"'", 400)
+		}
+	}
+	res, err := DB.Exec(
+		"INSERT INTO AccessRule(subject, path, permissions, effect) VALUES(?, ?, ?, ?)",
+		r.Subject, r.Path, strings.Join(r.Permissions, ","), r.Effect,
+	)
+	if err != nil {
+		return err
+	}
+	r.Id, _ = res.LastInsertId()
+	ruleCache.Cache.Flush()
+	return nil
+}
+
+func AccessRuleDelete(id int64) error {
+	_, err := DB.Exec("DELETE FROM AccessRule WHERE id = ?", id)
+	ruleCache.Cache.Flush()
+	return err
+}
+
+// userCan evaluates the permission of the user attached to the current session. Sessions without any
+// identity aren't subject to RBAC. The role gives the baseline which access rules can refine: on a
+// given path, the most specific rule wins and a deny wins over an allow that's as specific. Admins
+// aren't subject to access rules, that's what sets them apart from editors.
+func userCan(ctx *App, path string, perm string) bool {
+	identity := ctx.Session["identity"]
+	if identity == "" {
+		return true
+	}
+	u, err := UserGet(identity)
+	if err != nil || u.Disabled {
+		return false
+	}
+	allowed := roleCan(u.Role, perm)
+	if path == "" || u.Role == RoleAdmin {
+		return allowed
+	}
+	rules, err := AccessRuleList()
+	if err != nil {
+		Log.Warning("model::user access_rule %s", err.Error())
+		return false
+	}
+	depth := -1
+	for _, r := range rules {
+		if !ruleAppliesTo(r, u) || !ruleHasPerm(r, perm) || !ruleMatches(r, path) {
+			continue
+		}
+		if len(r.Path) > depth {
+			depth = len(r.Path)
+			allowed = r.Effect == "allow"
+		} else if r.Effect == "deny" {
+			allowed = false
+		}
+	}
+	return allowed
+}
+
+func roleCan(role string, perm string) bool {
+	switch role {
+	case RoleAdmin, RoleEditor:
+		return true
+	case RoleViewer:
+		return perm == PermRead
+	case RoleUploader:
+		return perm == PermUpload
+	}
+	return false
+}
+
+func ruleAppliesTo(r AccessRule, u User) bool {
+	if r.Subject == "*" || r.Subject == "user:"+u.Username {
+		return true
+	}
+	for _, g := range u.Groups {
+		if r.Subject == "group:"+g {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleMatches tells if a path is what a rule is about: the path itself or, for a folder, what's in it.
+// A rule on "/secret" doesn't apply to "/secretary"
+func ruleMatches(r AccessRule, path string) bool {
+	return path == r.Path || strings.HasPrefix(path, EnforceDirectory(r.Path))
+}
+
+func ruleHasPerm(r AccessRule, perm string) bool {
+	for _, p := range r.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func isRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func isPerm(perm string) bool {
+	for _, p := range Perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
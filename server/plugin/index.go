@@ -2,11 +2,15 @@ package plugin
 
 import (
 	. "github.com/bingoohuang/filestash/server/common"
+	_ "github.com/bingoohuang/filestash/server/plugin/plg_authenticate_account"
+	_ "github.com/bingoohuang/filestash/server/plugin/plg_authenticate_ldap"
 	_ "github.com/bingoohuang/filestash/server/plugin/plg_backend_backblaze"
 	_ "github.com/bingoohuang/filestash/server/plugin/plg_backend_dav"
 	_ "github.com/bingoohuang/filestash/server/plugin/plg_handler_console"
 	_ "github.com/bingoohuang/filestash/server/plugin/plg_handler_syncthing"
 	_ "github.com/bingoohuang/filestash/server/plugin/plg_security_svg"
+	_ "github.com/bingoohuang/filestash/server/plugin/plg_share_iprange"
+	_ "github.com/bingoohuang/filestash/server/plugin/plg_share_watermark"
 )
 
 func init() {
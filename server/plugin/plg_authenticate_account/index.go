@@ -0,0 +1,97 @@
+/*
+ * This plugin let users login with an account managed from the admin console. Each account is
+ * attached to one of the connection defined by the admin in which templated values like {{username}}
+ * are substituted, the same way it is done with the LDAP plugin.
+ */
+package plg_authenticate_account
+
+import (
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const AccountType = "account"
+
+func init() {
+	Backend.Register(AccountType, Account{})
+}
+
+type Account struct{}
+
+func (a Account) Init(params map[string]string, app *App) (IBackend, error) {
+	return Account{}, nil
+}
+
+func (a Account) LoginForm() Form {
+	return Form{
+		Elmnts: []FormElement{
+			{
+				Name:  "type",
+				Type:  "hidden",
+				Value: AccountType,
+			},
+			{
+				Name:        "username",
+				Type:        "text",
+				Placeholder: "Username",
+			},
+			{
+				Name:        "password",
+				Type:        "password",
+				Placeholder: "Password",
+			},
+		},
+	}
+}
+
+// Authenticate verifies the credentials of the account and gives back the session of the connection
+// the account is attached to.
+func (a Account) Authenticate(params map[string]string) (map[string]string, error) {
+	username := strings.TrimSpace(params["username"])
+	u, err := model.UserAuthenticate(username, params["password"])
+	if err != nil {
+		return nil, err
+	}
+	var template map[string]interface{}
+	for i := range Config.Conn {
+		if u.Connection != "" && Config.Conn[i]["label"] == u.Connection {
+			template = Config.Conn[i]
+			break
+		}
+	}
+	if template == nil {
+		return nil, NewError("Your account isn't attached to any storage, contact your administrator", 403)
+	}
+	session := ConnectionTemplateApply(template, map[string]string{
+		"username": u.Username,
+	})
+	session["identity"] = u.Username
+	session["timestamp"] = time.Now().String()
+	return session, nil
+}
+
+func (a Account) Ls(path string) ([]os.FileInfo, error) {
+	return nil, ErrNotAllowed
+}
+func (a Account) Cat(path string) (io.ReadCloser, error) {
+	return nil, ErrNotAllowed
+}
+func (a Account) Mkdir(path string) error {
+	return ErrNotAllowed
+}
+func (a Account) Rm(path string) error {
+	return ErrNotAllowed
+}
+func (a Account) Mv(from string, to string) error {
+	return ErrNotAllowed
+}
+func (a Account) Touch(path string) error {
+	return ErrNotAllowed
+}
+func (a Account) Save(path string, file io.Reader) error {
+	return ErrNotAllowed
+}
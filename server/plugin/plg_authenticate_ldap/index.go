@@ -0,0 +1,309 @@
+/*
+ * This plugin let users authenticate with their LDAP / Active Directory account. Once authenticated,
+ * the user is mapped, according to their group membership, onto one of the connection defined by the
+ * admin in which templated values like {{username}} are substituted. This way people land in their
+ * own home on a shared backend without ever seeing the storage credentials.
+ */
+package plg_authenticate_ldap
+
+import (
+	"crypto/tls"
+	"fmt"
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+	"github.com/go-ldap/ldap/v3"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const LdapType = "ldap"
+
+func init() {
+	Config.Get("auth.ldap.enable").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Name = "enable"
+		f.Type = "enable"
+		f.Target = []string{"ldap_url", "ldap_bind_dn", "ldap_bind_password", "ldap_base_dn", "ldap_user_filter", "ldap_username_attribute", "ldap_group_attribute", "ldap_group_mapping"}
+		f.Description = "Enable/Disable authentication against a LDAP or Active Directory server. Users need to pick the 'ldap' connection from the login screen"
+		f.Default = false
+		return f
+	})
+	Config.Get("auth.ldap.url").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Id = "ldap_url"
+		f.Name = "url"
+		f.Type = "text"
+		f.Description = "Location of the directory server. Use ldaps:// for an encrypted connection"
+		f.Placeholder = "Eg: ldap://ldap.example.com:389"
+		if u := os.Getenv("LDAP_URL"); u != "" {
+			f.Default = u
+			f.Placeholder = fmt.Sprintf("Default: '%s'", u)
+		}
+		return f
+	})
+	Config.Get("auth.ldap.bind_dn").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Id = "ldap_bind_dn"
+		f.Name = "bind_dn"
+		f.Type = "text"
+		f.Description = "Service account used to search for users. Leave empty for an anonymous search"
+		f.Placeholder = "Eg: cn=filestash,ou=services,dc=example,dc=com"
+		return f
+	})
+	Config.Get("auth.ldap.bind_password").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Id = "ldap_bind_password"
+		f.Name = "bind_password"
+		f.Type = "password"
+		f.Description = "Password of the service account"
+		return f
+	})
+	Config.Get("auth.ldap.base_dn").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Id = "ldap_base_dn"
+		f.Name = "base_dn"
+		f.Type = "text"
+		f.Description = "Where to start looking for users in the directory"
+		f.Placeholder = "Eg: dc=example,dc=com"
+		return f
+	})
+	Config.Get("auth.ldap.user_filter").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Id = "ldap_user_filter"
+		f.Name = "user_filter"
+		f.Type = "text"
+		f.Default = "(&(objectClass=person)(uid={{username}}))"
+		f.Description = "LDAP filter used to find the user. For Active Directory, use: (&(objectClass=user)(sAMAccountName={{username}}))"
+		f.Placeholder = "Default: (&(objectClass=person)(uid={{username}}))"
+		return f
+	})
+	Config.Get("auth.ldap.username_attribute").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Id = "ldap_username_attribute"
+		f.Name = "username_attribute"
+		f.Type = "text"
+		f.Default = "uid"
+		f.Description = "Attribute of the user entry holding the username as known by the directory. It's what {{username}} gets replaced with, whatever the case or spacing of what the user typed in. For Active Directory, use: sAMAccountName"
+		f.Placeholder = "Default: uid"
+		return f
+	})
+	Config.Get("auth.ldap.group_attribute").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Id = "ldap_group_attribute"
+		f.Name = "group_attribute"
+		f.Type = "text"
+		f.Default = "memberOf"
+		f.Description = "Attribute of the user entry that lists the groups the user belongs to"
+		f.Placeholder = "Default: memberOf"
+		return f
+	})
+	Config.Get("auth.ldap.group_mapping").Schema(func(f *FormElement) *FormElement {
+		if f == nil {
+			f = &FormElement{}
+		}
+		f.Id = "ldap_group_mapping"
+		f.Name = "group_mapping"
+		f.Type = "long_text"
+		f.Description = `One rule per line in the form: "group => connection label". The group is either the full DN or
+ the CN of a group and the first matching rule wins. Use "*" to match any authenticated user. Within the targeted
+ connection, {{username}} and {{email}} get replaced by the values of the authenticated user, eg: "path": "/home/{{username}}/"`
+		f.Placeholder = "Eg: cn=staff,ou=groups,dc=example,dc=com => Home"
+		return f
+	})
+
+	Backend.Register(LdapType, Ldap{})
+}
+
+type Ldap struct{}
+
+func (l Ldap) Init(params map[string]string, app *App) (IBackend, error) {
+	if !Config.Get("auth.ldap.enable").Bool() {
+		return nil, NewError("LDAP authentication isn't enabled", 405)
+	}
+	return Ldap{}, nil
+}
+
+func (l Ldap) LoginForm() Form {
+	return Form{
+		Elmnts: []FormElement{
+			{
+				Name:  "type",
+				Type:  "hidden",
+				Value: LdapType,
+			},
+			{
+				Name:        "username",
+				Type:        "text",
+				Placeholder: "Username",
+			},
+			{
+				Name:        "password",
+				Type:        "password",
+				Placeholder: "Password",
+			},
+		},
+	}
+}
+
+// Authenticate verifies the credentials against the directory and gives back the session of the
+// connection the user is mapped onto.
+func (l Ldap) Authenticate(params map[string]string) (map[string]string, error) {
+	username := strings.TrimSpace(params["username"])
+	password := params["password"]
+	if username == "" || password == "" {
+		return nil, ErrAuthenticationFailed
+	}
+
+	conn, err := ldapDial(Config.Get("auth.ldap.url").String())
+	if err != nil {
+		Log.Warning("plg_authenticate_ldap::dial %s", err.Error())
+		return nil, ErrNotReachable
+	}
+	defer conn.Close()
+
+	// Step1: find the user in the directory
+	if dn := Config.Get("auth.ldap.bind_dn").String(); dn != "" {
+		err = conn.Bind(dn, Config.Get("auth.ldap.bind_password").String())
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		Log.Warning("plg_authenticate_ldap::bind service account %s", err.Error())
+		return nil, NewError("Can't connect to the directory", 502)
+	}
+	usernameAttribute := Config.Get("auth.ldap.username_attribute").String()
+	groupAttribute := Config.Get("auth.ldap.group_attribute").String()
+	sr, err := conn.Search(ldap.NewSearchRequest(
+		Config.Get("auth.ldap.base_dn").String(),
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		strings.Replace(Config.Get("auth.ldap.user_filter").String(), "{{username}}", ldap.EscapeFilter(username), -1),
+		[]string{"dn", "mail", usernameAttribute, groupAttribute},
+		nil,
+	))
+	if err != nil {
+		Log.Warning("plg_authenticate_ldap::search %s", err.Error())
+		return nil, ErrAuthenticationFailed
+	} else if len(sr.Entries) != 1 {
+		return nil, ErrAuthenticationFailed
+	}
+	user := sr.Entries[0]
+
+	// Step2: verify the password of the user
+	if err = conn.Bind(user.DN, password); err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+
+	// Step3: find the connection the user is mapped onto. From there on, the user is known by the
+	// username the directory has, not by what was typed in the login form
+	if username = user.GetAttributeValue(usernameAttribute); username == "" {
+		Log.Warning("plg_authenticate_ldap::search no '%s' attribute for '%s'", usernameAttribute, user.DN)
+		return nil, ErrAuthenticationFailed
+	}
+	template := ldapFindConnection(user.GetAttributeValues(groupAttribute))
+	if template == nil {
+		Log.Info("plg_authenticate_ldap::mapping no connection for '%s'", username)
+		return nil, NewError("Your account isn't mapped onto any storage, contact your administrator", 403)
+	}
+	if _, err = model.UserProvision(username, LdapType); err != nil {
+		return nil, err
+	}
+	session := ConnectionTemplateApply(template, map[string]string{
+		"username": username,
+		"email":    user.GetAttributeValue("mail"),
+	})
+	session["identity"] = username
+	session["timestamp"] = time.Now().String()
+	return session, nil
+}
+
+func ldapDial(url string) (*ldap.Conn, error) {
+	if url == "" {
+		return nil, NewError("missing url", 500)
+	}
+	conn, err := ldap.DialURL(url, ldap.DialWithTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(10 * time.Second)
+	return conn, nil
+}
+
+func ldapFindConnection(groups []string) map[string]interface{} {
+	isMember := func(group string) bool {
+		if group == "*" {
+			return true
+		}
+		for _, g := range groups {
+			if strings.EqualFold(g, group) {
+				return true
+			}
+			if dn, err := ldap.ParseDN(g); err == nil && len(dn.RDNs) > 0 {
+				for _, attr := range dn.RDNs[0].Attributes {
+					if strings.EqualFold(attr.Type, "cn") && strings.EqualFold(attr.Value, group) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+
+	for _, line := range strings.Split(Config.Get("auth.ldap.group_mapping").String(), "\n") {
+		rule := strings.SplitN(line, "=>", 2)
+		if len(rule) != 2 {
+			continue
+		}
+		group := strings.TrimSpace(rule[0])
+		label := strings.TrimSpace(rule[1])
+		if group == "" || label == "" || !isMember(group) {
+			continue
+		}
+		for i := range Config.Conn {
+			if Config.Conn[i]["label"] == label {
+				return Config.Conn[i]
+			}
+		}
+		Log.Warning("plg_authenticate_ldap::mapping unknown connection '%s'", label)
+	}
+	return nil
+}
+
+func (l Ldap) Ls(path string) ([]os.FileInfo, error) {
+	return nil, ErrNotAllowed
+}
+func (l Ldap) Cat(path string) (io.ReadCloser, error) {
+	return nil, ErrNotAllowed
+}
+func (l Ldap) Mkdir(path string) error {
+	return ErrNotAllowed
+}
+func (l Ldap) Rm(path string) error {
+	return ErrNotAllowed
+}
+func (l Ldap) Mv(from string, to string) error {
+	return ErrNotAllowed
+}
+func (l Ldap) Touch(path string) error {
+	return ErrNotAllowed
+}
+func (l Ldap) Save(path string, file io.Reader) error {
+	return ErrNotAllowed
+}
@@ -0,0 +1,90 @@
+package plg_share_iprange
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+)
+
+// the "ip" proof restricts a shared link to a list of networks, eg: "10.0.0.0/8, 192.168.1.12". People
+// coming from elsewhere can't get through whatever other proof they give. Behind a reverse proxy, the
+// address checked is the one the proxy forwards as long as it's part of features.protection.trusted_proxies
+func init() {
+	model.ShareProofs.Register(iprange{})
+}
+
+type iprange struct{}
+
+func (p iprange) Key() string {
+	return "ip"
+}
+
+func (p iprange) Required(s Share) (string, bool) {
+	v, ok := s.Proofs["ip"]
+	return v, ok
+}
+
+func (p iprange) Verify(s Share, proof model.Proof, req *http.Request) (model.Proof, error) {
+	return proof, ErrNotValid
+}
+
+func (p iprange) Configure(s Share, value string) (string, error) {
+	networks, err := parse(value)
+	if err != nil {
+		return "", err
+	}
+	str := make([]string, len(networks))
+	for i := range networks {
+		str[i] = networks[i].String()
+	}
+	return strings.Join(str, ","), nil
+}
+
+func (p iprange) Check(s Share, req *http.Request) bool {
+	networks, err := parse(s.Proofs["ip"])
+	if err != nil {
+		return false
+	}
+	// X-Forwarded-For is only read from trusted proxies, anyone else could pick any address
+	ip := net.ParseIP(RemoteIP(req))
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parse(value string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, chunk := range strings.Split(value, ",") {
+		chunk = strings.TrimSpace(chunk)
+		if chunk == "" {
+			continue
+		}
+		cidr := chunk
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, NewError(fmt.Sprintf("Invalid network '%s'", chunk), 400)
+		}
+		networks = append(networks, n)
+	}
+	if len(networks) == 0 {
+		return nil, NewError("No network given", 400)
+	}
+	return networks, nil
+}
@@ -0,0 +1,74 @@
+package plg_share_watermark
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/f64"
+	"golang.org/x/image/math/fixed"
+)
+
+// watermarkAngle is how much the text is tilted, both onto images and PDFs
+const watermarkAngle = math.Pi / 6
+
+// watermarkImage tiles the text across the whole image. Jpeg stay jpeg, everything else becomes a png
+func watermarkImage(r io.Reader, text string) ([]byte, string, error) {
+	src, format, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+	b := src.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, src, b.Min, draw.Src)
+
+	size := math.Max(float64(min(b.Dx(), b.Dy()))/24, 10)
+	f, err := watermarkGetFont()
+	if err != nil {
+		return nil, "", err
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingNone})
+	if err != nil {
+		return nil, "", err
+	}
+	defer face.Close()
+	metrics := face.Metrics()
+	tile := image.NewRGBA(image.Rect(0, 0, font.MeasureString(face, text).Ceil()+1, (metrics.Ascent+metrics.Descent).Ceil()+1))
+	(&font.Drawer{
+		Dst:  tile,
+		Src:  image.NewUniform(color.NRGBA{128, 128, 128, 110}),
+		Face: face,
+		Dot:  fixed.Point26_6{X: 0, Y: metrics.Ascent},
+	}).DrawString(text)
+
+	// the text goes up to the right, on screen the y axis points down
+	cos, sin := math.Cos(-watermarkAngle), math.Sin(-watermarkAngle)
+	width, height := float64(tile.Bounds().Dx()), float64(tile.Bounds().Dy())
+	cx, cy := float64(b.Min.X)+float64(b.Dx())/2, float64(b.Min.Y)+float64(b.Dy())/2
+	reach := math.Hypot(float64(b.Dx()), float64(b.Dy()))/2 + width
+	for row, v := 0, -reach; v <= reach; row, v = row+1, v+height*4 {
+		u := -reach + float64(row%2)*(width+size*2)/2
+		for ; u <= reach; u += width + size*2 {
+			draw.ApproxBiLinear.Transform(dst, f64.Aff3{
+				cos, -sin, cx + u*cos - v*sin,
+				sin, cos, cy + u*sin + v*cos,
+			}, tile, tile.Bounds(), draw.Over, nil)
+		}
+	}
+
+	var out bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: 90})
+		return out.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&out, dst)
+	return out.Bytes(), "image/png", err
+}
@@ -0,0 +1,63 @@
+package plg_share_watermark
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	. "github.com/bingoohuang/filestash/server/common"
+	"github.com/bingoohuang/filestash/server/model"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+)
+
+// the files served by a view only link get stamped with who's looking at them and when. Only images
+// and PDFs can carry a watermark, other kind of files can't be opened from such a link
+func init() {
+	Hooks.Register.ProcessFileContentBeforeSend(func(reader io.ReadCloser, ctx *App, res *http.ResponseWriter, req *http.Request) (io.ReadCloser, error) {
+		if ctx.Share.Id == "" || !ctx.Share.ViewOnly {
+			return reader, nil
+		}
+		defer reader.Close()
+		text, err := model.ShareWatermarkText(ctx.Share, req)
+		if err == ErrNotAuthorized {
+			return nil, err
+		} else if err != nil {
+			Log.Subsystem("share").Request(ctx.RequestId).Error("share %s: invalid watermark %s", ctx.Share.Id, err.Error())
+			return nil, NewError("Invalid watermark", 500)
+		}
+
+		var out []byte
+		mType := GetMimeType(req.URL.Query().Get("path"))
+		switch mType {
+		case "image/jpeg", "image/png", "image/gif":
+			out, mType, err = watermarkImage(reader, text)
+		case "application/pdf":
+			out, err = watermarkPdf(reader, text)
+		default:
+			return nil, NewError("This file can't be opened from a view only link", 403)
+		}
+		if err != nil {
+			Log.Subsystem("share").Request(ctx.RequestId).Warning("share %s: can't watermark %s %s", ctx.Share.Id, req.URL.Query().Get("path"), err.Error())
+			return nil, NewError("This file can't be opened from a view only link", 403)
+		}
+		header := (*res).Header()
+		header.Set("Content-Type", mType)
+		header.Set("Content-Disposition", "inline")
+		header.Set("Cache-Control", "no-store")
+		return NewReadCloserFromBytes(out), nil
+	})
+}
+
+var (
+	watermarkFont     *sfnt.Font
+	watermarkFontErr  error
+	watermarkFontOnce sync.Once
+)
+
+func watermarkGetFont() (*sfnt.Font, error) {
+	watermarkFontOnce.Do(func() {
+		watermarkFont, watermarkFontErr = sfnt.Parse(goregular.TTF)
+	})
+	return watermarkFont, watermarkFontErr
+}
@@ -0,0 +1,477 @@
+package plg_share_watermark
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+var (
+	pdfObject    = regexp.MustCompile(`(?:^|[\r\n])\s*(\d+)\s+(\d+)\s+obj\b`)
+	pdfStream    = regexp.MustCompile(`>>\s*stream(?:\r\n|\n|\r)`)
+	pdfPage      = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfXref      = regexp.MustCompile(`/Type\s*/XRef\b`)
+	pdfObjStm    = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+	pdfContents  = regexp.MustCompile(`/Contents\s*(\d+\s+\d+\s+R|\[[^\]]*\])`)
+	pdfMediaBox  = regexp.MustCompile(`/MediaBox\s*\[\s*([-+.\d]+)\s+([-+.\d]+)\s+([-+.\d]+)\s+([-+.\d]+)\s*\]`)
+	pdfParent    = regexp.MustCompile(`/Parent\s+(\d+)\s+\d+\s+R`)
+	pdfRef       = regexp.MustCompile(`(\d+)\s+\d+\s+R\b`)
+	pdfRoot      = regexp.MustCompile(`/Root\s+(\d+\s+\d+\s+R)`)
+	pdfInfo      = regexp.MustCompile(`/Info\s+(\d+\s+\d+\s+R)`)
+	pdfId        = regexp.MustCompile(`/ID\s*\[[^\]]*\]`)
+	pdfSize      = regexp.MustCompile(`/Size\s+(\d+)`)
+	pdfLength    = regexp.MustCompile(`/Length\s+(\d+)(\s+\d+\s+R)?`)
+	pdfFilter    = regexp.MustCompile(`/Filter\s*(\[[^\]]*\]|/\w+)`)
+	pdfStartXref = regexp.MustCompile(`startxref\s+(\d+)`)
+)
+
+type pdfObj struct {
+	gen    int
+	dict   string // what comes before the stream if any
+	body   []byte // everything in between obj and endobj
+	stream []byte // the raw data of the stream, nil when the object isn't one
+}
+
+// watermarkPdf rewrites the whole document: every page gets a single content stream made of its
+// original content followed by the watermark, and only the objects the document still refers to are
+// kept. The original content streams and the previous revisions of the file are left out so that the
+// watermark can't be peeled off by going back to them. The text is drawn from the outline of its
+// glyphs so that the pages don't need any new resource. Encrypted documents, the ones keeping their
+// objects in object streams and pages whose content is encoded with anything but flate can't be stamped
+func watermarkPdf(r io.Reader, text string) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data[:min(len(data), 1024)]), []byte("%PDF-")) {
+		return nil, fmt.Errorf("not a pdf")
+	}
+	objs, maxNum := pdfParse(data)
+
+	// what we need to know from the trailer, either a classic one or the dictionary of an xref stream
+	if pdfStartXref.FindIndex(data) == nil {
+		return nil, fmt.Errorf("no startxref")
+	}
+	trailer := ""
+	if i := bytes.LastIndex(data, []byte("trailer")); i >= 0 {
+		trailer = string(data[i:])
+	} else {
+		nums := make([]int, 0)
+		for num, o := range objs {
+			if pdfXref.MatchString(o.dict) {
+				nums = append(nums, num)
+			}
+		}
+		sort.Ints(nums)
+		if len(nums) > 0 {
+			trailer = objs[nums[len(nums)-1]].dict
+		}
+	}
+	if strings.Contains(trailer, "/Encrypt") {
+		return nil, fmt.Errorf("encrypted pdf")
+	}
+	root := pdfRoot.FindStringSubmatch(trailer)
+	if root == nil {
+		return nil, fmt.Errorf("no root")
+	}
+	info := pdfInfo.FindStringSubmatch(trailer)
+	size := maxNum + 1
+	if s := pdfSize.FindStringSubmatch(trailer); s != nil {
+		if n, _ := strconv.Atoi(s[1]); n > size {
+			size = n
+		}
+	}
+
+	// a page hidden in an object stream would be served without any watermark
+	pages := make([]int, 0)
+	for num, o := range objs {
+		if pdfObjStm.MatchString(o.dict) {
+			return nil, fmt.Errorf("object streams aren't supported")
+		} else if pdfPage.MatchString(o.dict) {
+			pages = append(pages, num)
+		}
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no page found")
+	}
+	sort.Ints(pages)
+
+	path, advance, err := pdfTextPath(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// the content of a page might leave the graphic state in any condition, it gets wrapped in a q/Q
+	// pair so that the watermark starts from a clean slate
+	stamps := map[[4]float64]string{}
+	for _, num := range pages {
+		page := objs[num]
+		box := pdfPageMediaBox(objs, page)
+		stamp, ok := stamps[box]
+		if !ok {
+			stamp = pdfStamp(box, path, advance)
+			stamps[box] = stamp
+		}
+
+		var content bytes.Buffer
+		content.WriteString("q\n")
+		dict := page.dict
+		m := pdfContents.FindStringSubmatchIndex(dict)
+		if m != nil {
+			value := dict[m[2]:m[3]]
+			refs := []string{value}
+			if strings.HasPrefix(value, "[") {
+				refs = pdfRef.FindAllString(value, -1)
+			} else if target, ok := objs[pdfRefNum(value)]; ok && target.stream == nil {
+				refs = pdfRef.FindAllString(target.dict, -1)
+			}
+			for _, ref := range refs {
+				b, err := pdfStreamDecode(objs, objs[pdfRefNum(ref)])
+				if err != nil {
+					return nil, fmt.Errorf("page %d: %s", num, err.Error())
+				}
+				content.Write(b)
+				content.WriteString("\n")
+			}
+		}
+		content.WriteString("Q\n")
+		content.WriteString(stamp)
+
+		var b bytes.Buffer
+		w := zlib.NewWriter(&b)
+		if _, err := w.Write(content.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		ref := fmt.Sprintf("%d 0 R", size)
+		objs[size] = pdfObj{
+			dict:   fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>", b.Len()),
+			body:   append(append([]byte(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n", b.Len())), b.Bytes()...), []byte("\nendstream")...),
+			stream: b.Bytes(),
+		}
+		size += 1
+
+		if m != nil {
+			dict = dict[:m[0]] + "/Contents " + ref + dict[m[1]:]
+		} else if i := strings.LastIndex(dict, ">>"); i >= 0 {
+			dict = dict[:i] + "/Contents " + ref + " " + dict[i:]
+		} else {
+			return nil, fmt.Errorf("invalid page %d", num)
+		}
+		dict = strings.TrimSpace(dict)
+		objs[num] = pdfObj{gen: page.gen, dict: dict, body: []byte(dict)}
+	}
+
+	// only what can be reached from the trailer makes it to the new file, which leaves out the
+	// content the pages used to have
+	keep := map[int]bool{}
+	queue := []int{pdfRefNum(root[1])}
+	if info != nil {
+		queue = append(queue, pdfRefNum(info[1]))
+	}
+	for len(queue) > 0 {
+		num := queue[0]
+		queue = queue[1:]
+		o, ok := objs[num]
+		if !ok || keep[num] {
+			continue
+		}
+		keep[num] = true
+		refs := o.body
+		if o.stream != nil {
+			refs = []byte(o.dict)
+		}
+		for _, ref := range pdfRef.FindAllSubmatch(refs, -1) {
+			n, _ := strconv.Atoi(string(ref[1]))
+			queue = append(queue, n)
+		}
+	}
+
+	var out bytes.Buffer
+	header := data[bytes.Index(data, []byte("%PDF-")):]
+	if i := bytes.IndexAny(header, "\r\n"); i > 0 && i < 16 {
+		out.Write(header[:i])
+	} else {
+		out.WriteString("%PDF-1.4")
+	}
+	out.WriteString("\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, size)
+	gens := make([]int, size)
+	for num := 0; num < size; num++ {
+		if !keep[num] {
+			continue
+		}
+		o := objs[num]
+		offsets[num], gens[num] = out.Len(), o.gen
+		fmt.Fprintf(&out, "%d %d obj\n", num, o.gen)
+		out.Write(o.body)
+		out.WriteString("\nendobj\n")
+	}
+
+	// a single cross reference section where the objects that were left out are chained as free
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n", size)
+	nextFree := func(num int) int {
+		for n := num + 1; n < size; n++ {
+			if !keep[n] {
+				return n
+			}
+		}
+		return 0
+	}
+	for num := 0; num < size; num++ {
+		if num == 0 {
+			fmt.Fprintf(&out, "%010d 65535 f\r\n", nextFree(0))
+		} else if !keep[num] {
+			fmt.Fprintf(&out, "%010d 00000 f\r\n", nextFree(num))
+		} else {
+			fmt.Fprintf(&out, "%010d %05d n\r\n", offsets[num], gens[num])
+		}
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %s", size, root[1])
+	if info != nil {
+		fmt.Fprintf(&out, " /Info %s", info[1])
+	}
+	if id := pdfId.FindString(trailer); id != "" {
+		fmt.Fprintf(&out, " %s", id)
+	}
+	fmt.Fprintf(&out, " >>\nstartxref\n%d\n%%%%EOF\n", xref)
+	return out.Bytes(), nil
+}
+
+// pdfParse reads the objects of the document. The latest definition of an object is the one that
+// counts. The data of a stream is skipped over using its length so that it can't be mistaken for objects
+func pdfParse(data []byte) (map[int]pdfObj, int) {
+	objs := map[int]pdfObj{}
+	maxNum := 0
+	for pos := 0; pos < len(data); {
+		m := pdfObject.FindSubmatchIndex(data[pos:])
+		if m == nil {
+			break
+		}
+		start := pos + m[1]
+		num, _ := strconv.Atoi(string(data[pos+m[2] : pos+m[3]]))
+		gen, _ := strconv.Atoi(string(data[pos+m[4] : pos+m[5]]))
+		o := pdfObj{gen: gen}
+
+		end := bytes.Index(data[start:], []byte("endobj"))
+		if end < 0 {
+			break
+		}
+		if s := pdfStream.FindIndex(data[start : start+end]); s != nil {
+			o.dict = string(data[start : start+s[0]+2])
+			begin := start + s[1]
+			stop := -1
+			if l := pdfLength.FindStringSubmatch(o.dict); l != nil && l[2] == "" {
+				n, _ := strconv.Atoi(l[1])
+				if begin+n <= len(data) && bytes.HasPrefix(bytes.TrimLeft(data[begin+n:], "\r\n \t"), []byte("endstream")) {
+					stop = begin + n
+				}
+			}
+			if stop < 0 {
+				i := bytes.Index(data[begin:], []byte("endstream"))
+				if i < 0 {
+					break
+				}
+				stop = begin + i
+			}
+			o.stream = data[begin:stop]
+			after := stop + len("endstream")
+			if end = bytes.Index(data[after:], []byte("endobj")); end < 0 {
+				break
+			}
+			end += after - start
+		} else {
+			o.dict = string(data[start : start+end])
+		}
+		o.body = bytes.TrimSpace(data[start : start+end])
+		objs[num] = o
+		if num > maxNum {
+			maxNum = num
+		}
+		pos = start + end + len("endobj")
+	}
+	return objs, maxNum
+}
+
+// pdfStreamDecode gives the content of a stream, as long as it's either not encoded or compressed
+// with flate which is what content streams come as in practice
+func pdfStreamDecode(objs map[int]pdfObj, o pdfObj) ([]byte, error) {
+	if o.stream == nil {
+		return nil, fmt.Errorf("not a stream")
+	}
+	data := o.stream
+	if l := pdfLength.FindStringSubmatch(o.dict); l != nil && l[2] != "" {
+		// the length given by another object is only known once every object has been read
+		if target, ok := objs[pdfRefNum(l[1]+l[2])]; ok {
+			if n, err := strconv.Atoi(strings.TrimSpace(target.dict)); err == nil && n <= len(data) {
+				data = data[:n]
+			}
+		}
+	}
+	filters := []string{}
+	if m := pdfFilter.FindStringSubmatch(o.dict); m != nil {
+		filters = strings.Fields(strings.NewReplacer("[", " ", "]", " ", "/", " /").Replace(m[1]))
+	}
+	switch {
+	case len(filters) == 0:
+		return data, nil
+	case len(filters) == 1 && filters[0] == "/FlateDecode" && !strings.Contains(o.dict, "/DecodeParms"):
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("unsupported filter %s", strings.Join(filters, " "))
+}
+
+// pdfPageMediaBox gives the size of a page, which can be inherited from the page tree. Pages which
+// don't have any are given the size of a letter
+func pdfPageMediaBox(objs map[int]pdfObj, page pdfObj) [4]float64 {
+	o := page
+	for i := 0; i < 32; i++ {
+		if m := pdfMediaBox.FindStringSubmatch(o.dict); m != nil {
+			box := [4]float64{}
+			for j := range box {
+				box[j], _ = strconv.ParseFloat(m[j+1], 64)
+			}
+			return box
+		}
+		parent := pdfParent.FindStringSubmatch(o.dict)
+		if parent == nil {
+			break
+		}
+		n, _ := strconv.Atoi(parent[1])
+		next, ok := objs[n]
+		if !ok {
+			break
+		}
+		o = next
+	}
+	return [4]float64{0, 0, 612, 792}
+}
+
+func pdfRefNum(ref string) int {
+	f := strings.Fields(ref)
+	if len(f) == 0 {
+		return -1
+	}
+	n, _ := strconv.Atoi(f[0])
+	return n
+}
+
+// pdfStamp draws the outline of the text tilted and repeated over the whole page
+func pdfStamp(box [4]float64, path string, advance float64) string {
+	width, height := math.Abs(box[2]-box[0]), math.Abs(box[3]-box[1])
+	size := math.Max(math.Min(width, height)/24, 8)
+	scale := size / 1000
+	textWidth := advance * scale
+	cos, sin := math.Cos(watermarkAngle), math.Sin(watermarkAngle)
+	cx, cy := (box[0]+box[2])/2, (box[1]+box[3])/2
+	reach := math.Hypot(width, height)/2 + textWidth
+
+	var b strings.Builder
+	b.WriteString("q\n0.5 0.5 0.5 RG\n")
+	fmt.Fprintf(&b, "%.2f w\n", 0.4/scale)
+	for row, v := 0, -reach; v <= reach; row, v = row+1, v+size*4 {
+		u := -reach + float64(row%2)*(textWidth+size*2)/2
+		for ; u <= reach; u += textWidth + size*2 {
+			fmt.Fprintf(
+				&b, "q %.4f %.4f %.4f %.4f %.2f %.2f cm\n%sS Q\n",
+				scale*cos, scale*sin, -scale*sin, scale*cos,
+				cx+u*cos-v*sin, cy+u*sin+v*cos, path,
+			)
+		}
+	}
+	b.WriteString("Q\n")
+	return b.String()
+}
+
+// pdfTextPath gives the outline of the text as a pdf path, with an em of 1000 units, along with its width
+func pdfTextPath(text string) (string, float64, error) {
+	f, err := watermarkGetFont()
+	if err != nil {
+		return "", 0, err
+	}
+	var buf sfnt.Buffer
+	ppem := fixed.I(1000)
+	unit := func(v fixed.Int26_6) float64 {
+		return float64(v) / 64
+	}
+
+	var b strings.Builder
+	x := 0.0
+	prev := sfnt.GlyphIndex(0)
+	for i, r := range text {
+		g, err := f.GlyphIndex(&buf, r)
+		if err != nil {
+			return "", 0, err
+		}
+		if i > 0 {
+			if k, err := f.Kern(&buf, prev, g, ppem, font.HintingNone); err == nil {
+				x += unit(k)
+			}
+		}
+		prev = g
+		segments, err := f.LoadGlyph(&buf, g, ppem, nil)
+		if err != nil {
+			return "", 0, err
+		}
+		// glyphs have their y axis pointing down whereas pdf has it pointing up
+		px, py := 0.0, 0.0
+		open := false
+		point := func(p fixed.Point26_6) (float64, float64) {
+			return x + unit(p.X), -unit(p.Y)
+		}
+		for _, s := range segments {
+			switch s.Op {
+			case sfnt.SegmentOpMoveTo:
+				if open {
+					b.WriteString("h\n")
+				}
+				open = true
+				px, py = point(s.Args[0])
+				fmt.Fprintf(&b, "%.0f %.0f m\n", px, py)
+			case sfnt.SegmentOpLineTo:
+				px, py = point(s.Args[0])
+				fmt.Fprintf(&b, "%.0f %.0f l\n", px, py)
+			case sfnt.SegmentOpQuadTo:
+				qx, qy := point(s.Args[0])
+				ex, ey := point(s.Args[1])
+				fmt.Fprintf(
+					&b, "%.0f %.0f %.0f %.0f %.0f %.0f c\n",
+					px+(qx-px)*2/3, py+(qy-py)*2/3, ex+(qx-ex)*2/3, ey+(qy-ey)*2/3, ex, ey,
+				)
+				px, py = ex, ey
+			case sfnt.SegmentOpCubeTo:
+				c1x, c1y := point(s.Args[0])
+				c2x, c2y := point(s.Args[1])
+				px, py = point(s.Args[2])
+				fmt.Fprintf(&b, "%.0f %.0f %.0f %.0f %.0f %.0f c\n", c1x, c1y, c2x, c2y, px, py)
+			}
+		}
+		if open {
+			b.WriteString("h\n")
+		}
+		advance, err := f.GlyphAdvance(&buf, g, ppem, font.HintingNone)
+		if err != nil {
+			return "", 0, err
+		}
+		x += unit(advance)
+	}
+	return b.String(), x, nil
+}
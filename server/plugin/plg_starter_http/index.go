@@ -5,13 +5,17 @@ import (
 	"github.com/bingoohuang/filestash/server/common"
 	"github.com/bingoohuang/gg/pkg/netx/freeport"
 	"github.com/gorilla/mux"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 )
 
-func Register(port int) int {
+// Register serves the application on the given host, all interfaces when empty, and on the first
+// free port starting from the one we're given
+func Register(host string, port int) int {
 	port = freeport.PortStart(port)
-	addr := fmt.Sprintf(":%d", port)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
 
 	common.Hooks.Register.Starter(func(r *mux.Router) {
 		common.Log.Info("[http] starting ...")
@@ -68,6 +68,17 @@ func init() {
 	}
 	blacklist_format()
 
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		bin := bin
+		Hooks.Register.HealthCheck(bin, false, func() error {
+			if !plugin_enable() {
+				return ErrHealthSkipped
+			}
+			_, err := exec.LookPath(bin)
+			return err
+		})
+	}
+
 	if !plugin_enable() {
 		return
 	} else if !ffmpegIsInstalled {
@@ -202,7 +213,9 @@ func hls_transcode(ctx App, res http.ResponseWriter, req *http.Request) {
 	var str bytes.Buffer
 	cmd.Stdout = res
 	cmd.Stderr = &str
+	MetricTranscodes.Inc()
 	_ = cmd.Run()
+	MetricTranscodes.Dec()
 }
 
 type FFProbeData struct {